@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"math"
 	"strconv"
 	"strings"
 
@@ -50,7 +51,7 @@ func main() {
 		// Парсим данные из Excel
 		productName := strings.TrimSpace(row[1])
 		materialName := strings.TrimSpace(row[4])
-		article := strings.TrimSpace(row[2])
+		article := strings.ToUpper(strings.TrimSpace(row[2]))
 		typeName := strings.TrimSpace(row[0])
 
 		minPrice, err := parseDecimal(row[3])
@@ -144,6 +145,10 @@ func parseDecimal(s string) (float64, error) {
 	if err != nil {
 		return 0, fmt.Errorf("невалидное число: %v", err)
 	}
+	// ParseFloat понимает "NaN" и "Inf" - в ячейке цены это мусор, а не число
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("невалидное число: %s", s)
+	}
 
 	return value, nil
 }
@@ -1,17 +1,59 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
 	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/gin-gonic/gin/render"
+	"github.com/go-playground/validator/v10"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/joho/godotenv"
+	"github.com/xuri/excelize/v2"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
 )
 
 // ============ МОДЕЛИ ============
@@ -23,749 +65,10641 @@ type ProductWithTime struct {
 	MinPrice            float64 `json:"min_price"`
 	Article             string  `json:"article"`
 	TotalProductionTime float64 `json:"total_production_time"`
+	IsActive            bool    `json:"is_active"`
+	ImageURL            string  `json:"image_url"` // пустая строка - картинки нет
+	MaterialID          int     `json:"-"`         // отдаются только с ?expand=refs, см. ProductExpanded
+	TypeID              int     `json:"-"`
+}
+
+// ProductWorkshop - цех в маршруте продукта со своим временем
+type ProductWorkshop struct {
+	WorkshopID     int     `json:"workshop_id"`
+	WorkshopName   string  `json:"workshop_name"`
+	ProductionTime float64 `json:"production_time"`
+	StepOrder      int     `json:"step_order"`
+}
+
+// ProductWithWorkshops - продукт вместе с разбивкой по цехам
+type ProductWithWorkshops struct {
+	ProductWithTime
+	Workshops []ProductWorkshop `json:"workshops"`
+}
+
+// ProductRef - ссылка на справочник: id и название
+type ProductRef struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// ProductExpanded - продукт из списка с вложениями по ?expand=.
+// Невключённые вложения в JSON не попадают, плоские поля остаются как есть
+type ProductExpanded struct {
+	ProductWithTime
+	Material  *ProductRef       `json:"material,omitempty"`
+	Type      *ProductRef       `json:"type,omitempty"`
+	Workshops []ProductWorkshop `json:"workshops,omitzero"`
+	LinkCount *int              `json:"link_count,omitempty"` // число цехов, только с ?zero_time_links=true
+}
+
+// MaterialDetails - материал со всеми полями справочника, для карточки продукта
+type MaterialDetails struct {
+	ID                int      `json:"id"`
+	MaterialName      string   `json:"material_name"`
+	WastingPercentage *float64 `json:"wasting_percentage"`
+	Cost              *float64 `json:"cost"`
+}
+
+// ProductFull - всё для страницы продукта одним ответом (/api/products/:id/full).
+// Части, которые не загрузились, равны nil и перечислены в meta.failed
+type ProductFull struct {
+	ProductWithTime
+	Material  *MaterialDetails  `json:"material"`
+	Type      *ProductType      `json:"type"`
+	Workshops []ProductWorkshop `json:"workshops"`
+}
+
+// SortKey - одно поле сортировки списка продуктов
+type SortKey struct {
+	Field string `json:"field"`
+	Desc  bool   `json:"desc"`
+}
+
+// ProductListOptions - параметры выборки списка продуктов
+type ProductListOptions struct {
+	Sort       []SortKey
+	Limit      int // 0 - без ограничения
+	Offset     int
+	ActiveOnly bool // только активные (для витрины)
+	NoPrice    bool // только без цены (min_price = 0 или NULL) - отчёт о неполных данных
+	// только с цехами, у которых всё время нулевое или не задано - связи, созданные без времени
+	ZeroTimeLinks bool
+	TypeID        int    // 0 - любой тип
+	MaterialID    int    // 0 - любой материал
+	Search        string // подстрока в названии, артикуле или материале, как в SearchProducts
+	ExcludeIDs    []int  // кроме этих продуктов (уже показанных в интерфейсе)
+	// мультивыбор в фасетах: тип/материал из списка. С type_id/material_id условия складываются через AND
+	TypeIDs     []int
+	MaterialIDs []int
+	TimeMode    string // timeModeSum (по умолчанию) или timeModeMax
+	MaxRows     int    // абсолютный потолок строк в одном ответе (MAX_RESPONSE_ROWS); 0 - без потолка
+	// дерево условий из POST /api/products/search, уже проверенное validate; складывается с остальными через AND
+	Filter *FilterExpr
 }
 
 // ============ СЛОЙ БД (repository) ============
 
-// GetAllProducts получает все продукты со временем производства
-func GetAllProducts(ctx context.Context, pool *pgxpool.Pool) ([]ProductWithTime, error) {
-	query := `
-		SELECT 
+// ErrProductNotFound - продукта с таким ID нет
+var ErrProductNotFound = errors.New("продукт не найден")
+
+// ErrInvalidProductID - ID продукта в запросе не положительное целое
+var ErrInvalidProductID = errors.New("неверный ID продукта")
+
+// maxDBID - наибольший id в БД: все id - SERIAL (int4). Число больше на 64-битной
+// платформе разбирается в int, но такой строки не может быть, запрос в БД бесполезен
+const maxDBID = math.MaxInt32
+
+// errInvalidID - id не целое число от 1 до maxDBID
+var errInvalidID = fmt.Errorf("id должен быть целым числом от 1 до %d", maxDBID)
+
+// parseID строго разбирает id из пути или query: "12abc", "-1", "0" и переполнение int4 - errInvalidID
+func parseID(raw string) (int, error) {
+	id, err := strconv.Atoi(raw)
+	if err != nil || id <= 0 || id > maxDBID {
+		return 0, errInvalidID
+	}
+	return id, nil
+}
+
+// parseProductID строго разбирает ID из пути (см. parseID), ошибка - ErrInvalidProductID
+func parseProductID(raw string) (int, error) {
+	id, err := parseID(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidProductID, raw)
+	}
+	return id, nil
+}
+
+// productSortColumns - whitelist полей сортировки: имя из API -> колонка в запросе
+var productSortColumns = map[string]string{
+	"id":       "p.id",
+	"name":     "p.product_name",
+	"type":     "pt.type_name",
+	"material": "m.material_name",
+	"price":    "p.min_price",
+	"article":  "p.article",
+	// имя выходной колонки, а не p.total_production_time: с time_mode=max в ней подзапрос,
+	// и сортировать надо по тому времени, что отдаётся
+	"time": "total_production_time",
+}
+
+// ParseProductSort разбирает параметр sort вида "type,name desc".
+// Порядок ключей сохраняется, каждый ключ проверяется по whitelist
+func ParseProductSort(raw string) ([]SortKey, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+
+	var keys []SortKey
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(raw, ",") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("неверный ключ сортировки '%s'", strings.TrimSpace(part))
+		}
+
+		field := strings.ToLower(fields[0])
+		if _, ok := productSortColumns[field]; !ok {
+			return nil, fmt.Errorf("нельзя сортировать по полю '%s'", fields[0])
+		}
+		if seen[field] {
+			return nil, fmt.Errorf("поле '%s' указано в сортировке дважды", field)
+		}
+		seen[field] = true
+
+		key := SortKey{Field: field}
+		if len(fields) == 2 {
+			switch strings.ToLower(fields[1]) {
+			case "asc":
+			case "desc":
+				key.Desc = true
+			default:
+				return nil, fmt.Errorf("неверное направление сортировки '%s' (asc или desc)", fields[1])
+			}
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// buildProductsOrderBy собирает ORDER BY из уже провалидированных ключей.
+// В конце всегда p.id: при равных ценах/названиях порядок иначе не определён,
+// и между страницами строки могут повторяться или пропадать
+func buildProductsOrderBy(keys []SortKey) string {
+	parts := make([]string, 0, len(keys)+1)
+	for _, key := range keys {
+		part := productSortColumns[key.Field]
+		if key.Desc {
+			part += " DESC"
+		}
+		parts = append(parts, part)
+		if key.Field == "id" {
+			// id уникален, ключи после него ничего не меняют
+			return strings.Join(parts, ", ")
+		}
+	}
+	parts = append(parts, "p.id")
+	return strings.Join(parts, ", ")
+}
+
+// buildProductsWhere собирает WHERE для списка продуктов из фильтров.
+// Возвращает пустую строку, если фильтров нет; значения идут только через args
+func buildProductsWhere(opts ProductListOptions) (string, []any) {
+	var conditions []string
+	var args []any
+
+	if opts.ActiveOnly {
+		conditions = append(conditions, "p.is_active")
+	}
+	if opts.NoPrice {
+		conditions = append(conditions, "(p.min_price = 0 OR p.min_price IS NULL)")
+	}
+	if opts.ZeroTimeLinks {
+		// По самим связям, а не по кешированному total_production_time: кеш мог и разойтись
+		conditions = append(conditions, `p.id IN (
+			SELECT product_id FROM products_workshop
+			GROUP BY product_id
+			HAVING COALESCE(SUM(production_time), 0) = 0
+		)`)
+	}
+	if len(opts.ExcludeIDs) > 0 {
+		args = append(args, opts.ExcludeIDs)
+		conditions = append(conditions, fmt.Sprintf("p.id <> ALL($%d)", len(args)))
+	}
+	if opts.TypeID > 0 {
+		args = append(args, opts.TypeID)
+		conditions = append(conditions, fmt.Sprintf("p.type_id = $%d", len(args)))
+	}
+	if opts.MaterialID > 0 {
+		args = append(args, opts.MaterialID)
+		conditions = append(conditions, fmt.Sprintf("p.material_id = $%d", len(args)))
+	}
+	if len(opts.TypeIDs) > 0 {
+		args = append(args, opts.TypeIDs)
+		conditions = append(conditions, fmt.Sprintf("p.type_id = ANY($%d)", len(args)))
+	}
+	if len(opts.MaterialIDs) > 0 {
+		args = append(args, opts.MaterialIDs)
+		conditions = append(conditions, fmt.Sprintf("p.material_id = ANY($%d)", len(args)))
+	}
+	if opts.Search != "" {
+		args = append(args, "%"+escapeLike(opts.Search)+"%")
+		conditions = append(conditions, fmt.Sprintf(
+			"(p.product_name ILIKE $%[1]d OR p.article ILIKE $%[1]d OR m.material_name ILIKE $%[1]d)", len(args)))
+	}
+	if opts.Filter != nil {
+		conditions = append(conditions, opts.Filter.sql(&args, opts.TimeMode))
+	}
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// ============ ВЫРАЖЕНИЯ ФИЛЬТРОВ ============
+
+// FilterExpr - узел дерева фильтра POST /api/products/search: группа and/or из вложенных
+// узлов или одно условие field op value. В узле задано ровно одно из and, or, field.
+// Например (тип 1 или 2) и цена меньше 5000:
+//
+//	{"and": [{"or": [{"field": "type_id", "op": "eq", "value": 1},
+//	                 {"field": "type_id", "op": "eq", "value": 2}]},
+//	         {"field": "min_price", "op": "lt", "value": 5000}]}
+type FilterExpr struct {
+	And   []FilterExpr    `json:"and,omitempty"`
+	Or    []FilterExpr    `json:"or,omitempty"`
+	Field string          `json:"field,omitempty"`
+	Op    string          `json:"op,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+
+	value any // Value, разобранное validate по типу поля
+}
+
+// filterKind - тип значения поля фильтра
+type filterKind int
+
+const (
+	filterInt filterKind = iota
+	filterNumber
+	filterString
+	filterBool
+)
+
+// filterField - поле, доступное в фильтре. В SQL попадают только эти выражения
+// и номера параметров, значения всегда передаются параметрами
+type filterField struct {
+	expr string
+	kind filterKind
+}
+
+var filterFields = map[string]filterField{
+	"id":                    {"p.id", filterInt},
+	"type_id":               {"p.type_id", filterInt},
+	"material_id":           {"p.material_id", filterInt},
+	"product_name":          {"p.product_name", filterString},
+	"article":               {"COALESCE(p.article, '')", filterString},
+	"material_name":         {"m.material_name", filterString},
+	"type_name":             {"pt.type_name", filterString},
+	"min_price":             {"COALESCE(p.min_price, 0)", filterNumber},
+	"total_production_time": {"p.total_production_time", filterNumber},
+	"is_active":             {"p.is_active", filterBool},
+}
+
+// filterComparisons - операторы сравнения; in (= ANY) и contains (ILIKE) собираются отдельно
+var filterComparisons = map[string]string{
+	"eq":  "=",
+	"ne":  "<>",
+	"lt":  "<",
+	"lte": "<=",
+	"gt":  ">",
+	"gte": ">=",
+}
+
+// Ограничения размера фильтра: дерево приходит от клиента и целиком становится одним WHERE
+const (
+	maxFilterDepth      = 5
+	maxFilterConditions = 50
+	maxFilterInValues   = 100
+)
+
+// allows - применим ли оператор к полю: порядок только у чисел, contains только у строк
+func (ff filterField) allows(op string) bool {
+	switch op {
+	case "eq", "ne":
+		return true
+	case "lt", "lte", "gt", "gte":
+		return ff.kind == filterInt || ff.kind == filterNumber
+	case "in":
+		return ff.kind != filterBool
+	case "contains":
+		return ff.kind == filterString
+	}
+	return false
+}
+
+// validate проверяет дерево и разбирает значения условий. Неизвестные поля и операторы,
+// пустые группы и значения не того типа - ошибка с указанием поля
+func (f *FilterExpr) validate(depth int, conditions *int) error {
+	if depth > maxFilterDepth {
+		return fmt.Errorf("фильтр вложен глубже %d уровней", maxFilterDepth)
+	}
+	set := 0
+	for _, present := range []bool{f.And != nil, f.Or != nil, f.Field != ""} {
+		if present {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("в узле фильтра должно быть ровно одно из and, or, field")
+	}
+
+	if f.Field == "" {
+		if f.Op != "" || f.Value != nil {
+			return errors.New("op и value задаются только вместе с field")
+		}
+		group := f.And
+		if f.Or != nil {
+			group = f.Or
+		}
+		if len(group) == 0 {
+			return errors.New("группа and/or не может быть пустой")
+		}
+		for i := range group {
+			if err := group[i].validate(depth+1, conditions); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	*conditions++
+	if *conditions > maxFilterConditions {
+		return fmt.Errorf("в фильтре больше %d условий", maxFilterConditions)
+	}
+	field, ok := filterFields[f.Field]
+	if !ok {
+		return fmt.Errorf("неизвестное поле фильтра %q", f.Field)
+	}
+	if _, ok := filterComparisons[f.Op]; !ok && f.Op != "in" && f.Op != "contains" {
+		return fmt.Errorf("неизвестный оператор %q (допустимы eq, ne, lt, lte, gt, gte, in, contains)", f.Op)
+	}
+	if !field.allows(f.Op) {
+		return fmt.Errorf("оператор %s не применим к полю %s", f.Op, f.Field)
+	}
+	if f.Value == nil {
+		return fmt.Errorf("поле %s: не задано value", f.Field)
+	}
+
+	var err error
+	if f.Op == "in" {
+		f.value, err = parseFilterList(field.kind, f.Value)
+	} else {
+		f.value, err = parseFilterValue(field.kind, f.Value)
+	}
+	if err != nil {
+		return fmt.Errorf("поле %s: %w", f.Field, err)
+	}
+	return nil
+}
+
+// parseFilterValue разбирает одно значение по типу поля; null не допускается
+func parseFilterValue(kind filterKind, raw json.RawMessage) (any, error) {
+	if string(raw) == "null" {
+		return nil, errors.New("value не может быть null")
+	}
+	switch kind {
+	case filterInt:
+		var v int
+		if err := json.Unmarshal(raw, &v); err != nil || v <= 0 || v > maxDBID {
+			return nil, fmt.Errorf("value должно быть целым от 1 до %d", maxDBID)
+		}
+		return v, nil
+	case filterNumber:
+		var v float64
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, errors.New("value должно быть числом")
+		}
+		return v, nil
+	case filterString:
+		var v string
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, errors.New("value должно быть строкой")
+		}
+		return v, nil
+	default:
+		var v bool
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, errors.New("value должно быть true или false")
+		}
+		return v, nil
+	}
+}
+
+// parseFilterList разбирает value оператора in: непустой массив значений поля.
+// Срез типизированный ([]int, []float64, []string), чтобы pgx передал его массивом для ANY
+func parseFilterList(kind filterKind, raw json.RawMessage) (any, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(raw, &items); err != nil || len(items) == 0 || len(items) > maxFilterInValues {
+		return nil, fmt.Errorf("value для in должно быть массивом от 1 до %d значений", maxFilterInValues)
+	}
+	switch kind {
+	case filterInt:
+		return collectFilterList[int](kind, items)
+	case filterNumber:
+		return collectFilterList[float64](kind, items)
+	default:
+		return collectFilterList[string](kind, items)
+	}
+}
+
+func collectFilterList[T any](kind filterKind, items []json.RawMessage) ([]T, error) {
+	list := make([]T, 0, len(items))
+	for _, item := range items {
+		v, err := parseFilterValue(kind, item)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v.(T))
+	}
+	return list, nil
+}
+
+// sql переводит проверенное дерево в условие WHERE, дописывая значения в args
+func (f *FilterExpr) sql(args *[]any, timeMode string) string {
+	if f.Field == "" {
+		group, joiner := f.And, " AND "
+		if f.Or != nil {
+			group, joiner = f.Or, " OR "
+		}
+		parts := make([]string, len(group))
+		for i := range group {
+			parts[i] = group[i].sql(args, timeMode)
+		}
+		return "(" + strings.Join(parts, joiner) + ")"
+	}
+
+	field := filterFields[f.Field]
+	expr := field.expr
+	if f.Field == "total_production_time" {
+		// Фильтр по тому же времени, что отдаётся в списке
+		expr = productTimeExpr(timeMode)
+	}
+	switch f.Op {
+	case "in":
+		*args = append(*args, f.value)
+		return fmt.Sprintf("%s = ANY($%d)", expr, len(*args))
+	case "contains":
+		*args = append(*args, "%"+escapeLike(f.value.(string))+"%")
+		return fmt.Sprintf("%s ILIKE $%d", expr, len(*args))
+	}
+	*args = append(*args, f.value)
+	return fmt.Sprintf("%s %s $%d", expr, filterComparisons[f.Op], len(*args))
+}
+
+// productColumns - колонки ProductWithTime в порядке полей структуры. Любой запрос,
+// отдающий продукт, берёт их отсюда и читает через productScanDest: новая колонка
+// добавляется в одном месте и не забывается в части запросов
+const productColumns = `
 			p.id,
 			p.product_name,
 			m.material_name,
 			pt.type_name,
-			p.min_price,
-			p.article,
-			COALESCE(SUM(pw.production_time), 0) as total_production_time
+			COALESCE(p.min_price, 0) AS min_price,
+			COALESCE(p.article, '') AS article,
+			p.total_production_time,
+			p.is_active,
+			COALESCE(p.image_url, '') AS image_url,
+			p.material_id,
+			p.type_id`
+
+// productFrom - соединения, которые нужны для productColumns
+const productFrom = `
 		FROM products p
 		JOIN materials m ON p.material_id = m.id
-		JOIN products_types pt ON p.type_id = pt.id
-		LEFT JOIN products_workshop pw ON pw.product_id = p.id
-		GROUP BY p.id, p.product_name, m.material_name, pt.type_name, p.min_price, p.article
-		ORDER BY p.id
-	`
+		JOIN products_types pt ON p.type_id = pt.id`
 
-	rows, err := pool.Query(ctx, query)
+// productSelect - основа запросов продукта, дальше дописываются WHERE/ORDER BY
+const productSelect = `
+		SELECT ` + productColumns + productFrom
+
+// Режимы времени продукта (?time_mode=). sum - цеха работают по очереди, время - сумма шагов
+// маршрута (кешируется в products.total_production_time). max - цеха работают параллельно,
+// время - самый долгий шаг (критический путь), считается по связям при каждом запросе
+const (
+	timeModeSum = "sum"
+	timeModeMax = "max"
+)
+
+// productMaxTimeExpr - время продукта для time_mode=max; без цехов - 0, как и у суммы
+const productMaxTimeExpr = `COALESCE((
+				SELECT MAX(pw.production_time) FROM products_workshop pw WHERE pw.product_id = p.id
+			), 0)`
+
+// productTimeExpr - время продукта в SQL для режима: кешированная сумма или productMaxTimeExpr
+func productTimeExpr(timeMode string) string {
+	if timeMode == timeModeMax {
+		return productMaxTimeExpr
+	}
+	return "p.total_production_time"
+}
+
+// productSelectFor - productSelect с нужным режимом времени: для max колонка
+// total_production_time заменяется подзапросом, остальные колонки и Scan те же
+func productSelectFor(timeMode string) string {
+	if timeMode != timeModeMax {
+		return productSelect
+	}
+	return strings.Replace(productSelect, "p.total_production_time,", productMaxTimeExpr+" AS total_production_time,", 1)
+}
+
+// productScanDest - приёмники Scan для productColumns. Дополнительные колонки
+// после productColumns добавляются через append
+func productScanDest(p *ProductWithTime) []any {
+	return []any{
+		&p.ID,
+		&p.ProductName,
+		&p.MaterialName,
+		&p.TypeName,
+		&p.MinPrice,
+		&p.Article,
+		&p.TotalProductionTime,
+		&p.IsActive,
+		&p.ImageURL,
+		&p.MaterialID,
+		&p.TypeID,
+	}
+}
+
+// buildProductsQuery собирает запрос списка продуктов целиком: колонки, фильтры, сортировку
+// и страницу. Отдельно от выполнения, чтобы ?explain=true показывал ровно тот же SQL
+func buildProductsQuery(opts ProductListOptions) (string, []any) {
+	query := productSelectFor(opts.TimeMode)
+
+	where, args := buildProductsWhere(opts)
+	query += where + " ORDER BY " + buildProductsOrderBy(opts.Sort)
+
+	if opts.Limit > 0 {
+		args = append(args, opts.Limit, opts.Offset)
+		query += fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+	}
+	return query, args
+}
+
+// buildProductsCountQuery - COUNT(*) по тем же фильтрам, что в buildProductsQuery
+func buildProductsCountQuery(opts ProductListOptions) (string, []any) {
+	where, args := buildProductsWhere(opts)
+	// Те же соединения, что в списке: фильтры могут ссылаться на m и pt
+	return `
+		SELECT COUNT(*)` + productFrom + where, args
+}
+
+// GetProductIDs возвращает только id продуктов под фильтрами в порядке списка, не больше limit.
+// Время выбирается колонкой total_production_time, чтобы sort=time с time_mode=max шёл по
+// тому же времени, что и в списке (productSortColumns ссылается на имя выходной колонки)
+func GetProductIDs(ctx context.Context, pool *pgxpool.Pool, opts ProductListOptions, limit int) ([]int, error) {
+	where, args := buildProductsWhere(opts)
+	args = append(args, limit)
+	query := `
+		SELECT p.id, ` + productTimeExpr(opts.TimeMode) + ` AS total_production_time` + productFrom + where + `
+		ORDER BY ` + buildProductsOrderBy(opts.Sort) + fmt.Sprintf(" LIMIT $%d", len(args))
+
+	rows, err := pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (int, error) {
+		var id int
+		var total float64
+		err := row.Scan(&id, &total)
+		return id, err
+	})
 	if err != nil {
 		return nil, err
 	}
+	if ids == nil {
+		ids = []int{}
+	}
+	return ids, nil
+}
+
+// GetAllProducts получает все продукты со временем производства
+// Время берётся из кешированной колонки products.total_production_time (с time_mode=max - из связей)
+func GetAllProducts(ctx context.Context, pool *pgxpool.Pool, opts ProductListOptions) ([]ProductWithTime, error) {
+	query, args := buildProductsQuery(opts)
+
+	return retryRead(ctx, func() ([]ProductWithTime, error) {
+		rows, err := pool.Query(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		var products []ProductWithTime
+		for rows.Next() {
+			var p ProductWithTime
+			err := rows.Scan(productScanDest(&p)...)
+			if err != nil {
+				return nil, err
+			}
+			products = append(products, p)
+		}
+
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+
+		return products, nil
+	})
+}
+
+// StreamProducts отдаёт продукты по одному в fn, не собирая весь список в памяти.
+// Используется экспортом: каталог может быть большим. Ошибка fn прерывает чтение
+func StreamProducts(ctx context.Context, pool *pgxpool.Pool, opts ProductListOptions, fn func(ProductWithTime) error) error {
+	query, args := buildProductsQuery(opts)
+
+	rows, err := pool.Query(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	return scanProductRows(rows, fn)
+}
+
+// StreamProductsSnapshot - StreamProducts вместе с COUNT по тем же фильтрам в одном снимке
+// REPEATABLE READ: total, переданный в start до первой строки, совпадает с числом строк потока,
+// даже если каталог меняется во время выгрузки. Ошибка start прерывает выгрузку
+func StreamProductsSnapshot(ctx context.Context, pool *pgxpool.Pool, opts ProductListOptions, start func(total int) error, fn func(ProductWithTime) error) error {
+	countQuery, countArgs := buildProductsCountQuery(opts)
+	query, args := buildProductsQuery(opts)
+
+	return withReadSnapshot(ctx, pool, func(tx pgx.Tx) error {
+		var total int
+		if err := tx.QueryRow(ctx, countQuery, countArgs...).Scan(&total); err != nil {
+			return err
+		}
+		if err := start(total); err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		return scanProductRows(rows, fn)
+	})
+}
+
+// scanProductRows читает строки buildProductsQuery и передаёт их fn по одной
+func scanProductRows(rows pgx.Rows, fn func(ProductWithTime) error) error {
 	defer rows.Close()
 
-	var products []ProductWithTime
 	for rows.Next() {
 		var p ProductWithTime
-		err := rows.Scan(
-			&p.ID,
-			&p.ProductName,
-			&p.MaterialName,
-			&p.TypeName,
-			&p.MinPrice,
-			&p.Article,
-			&p.TotalProductionTime,
-		)
+		err := rows.Scan(productScanDest(&p)...)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if err := fn(p); err != nil {
+			return err
 		}
-		products = append(products, p)
 	}
 
-	if err = rows.Err(); err != nil {
+	return rows.Err()
+}
+
+// PriceBounds - диапазон min_price для набора фильтров; nil - под фильтры ничего не попало
+type PriceBounds struct {
+	MinPrice *float64 `json:"min_price"`
+	MaxPrice *float64 `json:"max_price"`
+	Count    int      `json:"count"`
+}
+
+// GetPriceBounds считает минимальную и максимальную цену продуктов под фильтрами одним запросом.
+// Продукты без цены (NULL или 0) в диапазон не входят, но учитываются в Count
+func GetPriceBounds(ctx context.Context, pool *pgxpool.Pool, opts ProductListOptions) (*PriceBounds, error) {
+	where, args := buildProductsWhere(opts)
+	query := `
+		SELECT MIN(NULLIF(p.min_price, 0)), MAX(NULLIF(p.min_price, 0)), COUNT(*)` + productFrom + where
+
+	var bounds PriceBounds
+	if err := pool.QueryRow(ctx, query, args...).Scan(&bounds.MinPrice, &bounds.MaxPrice, &bounds.Count); err != nil {
 		return nil, err
 	}
+	return &bounds, nil
+}
+
+// CountProducts возвращает количество продуктов с учётом фильтров
+func CountProducts(ctx context.Context, pool *pgxpool.Pool, opts ProductListOptions) (int, error) {
+	query, args := buildProductsCountQuery(opts)
+
+	return retryRead(ctx, func() (int, error) {
+		var total int
+		err := pool.QueryRow(ctx, query, args...).Scan(&total)
+		return total, err
+	})
+}
+
+// ErrResponseTooLarge - запрошенная страница больше потолка строк одного ответа
+var ErrResponseTooLarge = errors.New("слишком много строк для одного ответа")
+
+// checkResponseRows сверяет limit страницы с opts.MaxRows. Потолок не зависит от
+// MAX_PAGE_SIZE: он страхует и те пути, где limit задаётся не из запроса
+func checkResponseRows(opts ProductListOptions) error {
+	if opts.MaxRows > 0 && opts.Limit > opts.MaxRows {
+		return fmt.Errorf("%w: запрошено %d, допустимо не больше %d - запрашивайте по страницам через limit и offset",
+			ErrResponseTooLarge, opts.Limit, opts.MaxRows)
+	}
+	return nil
+}
 
+// errTooManyRows - список без страницы вышел бы больше потолка maxRows
+func errTooManyRows(maxRows int) error {
+	return fmt.Errorf("%w: в ответе было бы больше %d строк - запрашивайте по страницам через limit и offset",
+		ErrResponseTooLarge, maxRows)
+}
+
+// GetProductsCapped получает список без страницы, но не больше opts.MaxRows строк:
+// читается на одну строку больше потолка, и лишняя строка означает ErrResponseTooLarge
+func GetProductsCapped(ctx context.Context, pool *pgxpool.Pool, opts ProductListOptions) ([]ProductWithTime, error) {
+	if opts.MaxRows <= 0 {
+		return GetAllProducts(ctx, pool, opts)
+	}
+	opts.Limit, opts.Offset = opts.MaxRows+1, 0
+	products, err := GetAllProducts(ctx, pool, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(products) > opts.MaxRows {
+		return nil, errTooManyRows(opts.MaxRows)
+	}
 	return products, nil
 }
 
-// GetProductByID получает один продукт по ID со временем производства
+// GetProductsPaginated получает страницу продуктов и общее количество.
+// Страница больше opts.MaxRows - ErrResponseTooLarge до обращения к БД
+func GetProductsPaginated(ctx context.Context, pool *pgxpool.Pool, opts ProductListOptions) ([]ProductWithTime, int, error) {
+	if err := checkResponseRows(opts); err != nil {
+		return nil, 0, err
+	}
+
+	total, err := CountProducts(ctx, pool, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	products, err := GetAllProducts(ctx, pool, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return products, total, nil
+}
+
+// GetProductByID получает один продукт по ID со временем производства.
+// Если продукта нет - ErrProductNotFound, любая другая ошибка - сбой БД
 func GetProductByID(ctx context.Context, pool *pgxpool.Pool, id int) (*ProductWithTime, error) {
-	query := `
-		SELECT 
-			p.id,
-			p.product_name,
-			m.material_name,
-			pt.type_name,
-			p.min_price,
-			p.article,
-			COALESCE(SUM(pw.production_time), 0) as total_production_time
+	return GetProductByIDWithTimeMode(ctx, pool, id, timeModeSum)
+}
+
+// GetProductByIDWithTimeMode - GetProductByID с выбором режима времени (timeModeSum/timeModeMax)
+func GetProductByIDWithTimeMode(ctx context.Context, pool *pgxpool.Pool, id int, timeMode string) (*ProductWithTime, error) {
+	query := productSelectFor(timeMode) + `
+		WHERE p.id = $1
+	`
+
+	var p ProductWithTime
+	_, err := retryRead(ctx, func() (struct{}, error) {
+		return struct{}{}, pool.QueryRow(ctx, query, id).Scan(productScanDest(&p)...)
+	})
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrProductNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения продукта %d: %w", id, err)
+	}
+
+	return &p, nil
+}
+
+// GetProductMaterial - материал продукта целиком. Ищется через продукт, поэтому
+// запрос не ждёт, пока прочитан сам продукт; нет продукта - ErrProductNotFound
+func GetProductMaterial(ctx context.Context, pool *pgxpool.Pool, productID int) (*MaterialDetails, error) {
+	var m MaterialDetails
+	err := pool.QueryRow(ctx, `
+		SELECT m.id, m.material_name, m.wasting_percentage, m.cost
 		FROM products p
 		JOIN materials m ON p.material_id = m.id
+		WHERE p.id = $1
+	`, productID).Scan(&m.ID, &m.MaterialName, &m.WastingPercentage, &m.Cost)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrProductNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// GetProductTypeOf - тип продукта с родителем, как GetProductMaterial
+func GetProductTypeOf(ctx context.Context, pool *pgxpool.Pool, productID int) (*ProductType, error) {
+	var t ProductType
+	err := pool.QueryRow(ctx, `
+		SELECT pt.id, pt.type_name, pt.parent_id
+		FROM products p
 		JOIN products_types pt ON p.type_id = pt.id
-		LEFT JOIN products_workshop pw ON pw.product_id = p.id
 		WHERE p.id = $1
-		GROUP BY p.id, p.product_name, m.material_name, pt.type_name, p.min_price, p.article
+	`, productID).Scan(&t.ID, &t.TypeName, &t.ParentID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrProductNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// GetProductByArticle ищет продукты по артикулу без учёта регистра.
+// Возвращает срез: артикул уникален по индексу, но вызывающий сам решает,
+// что делать, если найдётся больше одного (старые данные до нормализации)
+func GetProductByArticle(ctx context.Context, pool *pgxpool.Pool, article string) ([]ProductWithTime, error) {
+	// Условия на пустой/NULL артикул повторяют предикат idx_products_article - без них индекс не используется
+	query := productSelect + `
+		WHERE UPPER(p.article) = $1 AND p.article IS NOT NULL AND p.article <> ''
+		ORDER BY p.id
+	`
+
+	rows, err := pool.Query(ctx, query, normalizeArticle(article))
+	if err != nil {
+		return nil, err
+	}
+	return scanProducts(rows)
+}
+
+// FindProductByNameAndRefs ищет продукт по составному ключу productNameRefsIndex.
+// nil без ошибки - такого нет (его могли удалить после конфликта)
+func FindProductByNameAndRefs(ctx context.Context, pool *pgxpool.Pool, name string, materialID, typeID int) (*ProductWithTime, error) {
+	query := productSelect + `
+		WHERE LOWER(p.product_name) = LOWER($1) AND p.material_id = $2 AND p.type_id = $3
+	`
+
+	var p ProductWithTime
+	err := pool.QueryRow(ctx, query, name, materialID, typeID).Scan(productScanDest(&p)...)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// GetProductsByArticles получает продукты по списку уже нормализованных артикулов одним запросом.
+// Сравнение как в GetProductByArticle - по UPPER(article), через индекс idx_products_article
+func GetProductsByArticles(ctx context.Context, pool *pgxpool.Pool, articles []string) ([]ProductWithTime, error) {
+	query := productSelect + `
+		WHERE UPPER(p.article) = ANY($1) AND p.article IS NOT NULL AND p.article <> ''
+		ORDER BY p.id
+	`
+
+	rows, err := pool.Query(ctx, query, articles)
+	if err != nil {
+		return nil, err
+	}
+	return scanProducts(rows)
+}
+
+// GetProductsByIDs получает продукты по списку ID одним запросом
+func GetProductsByIDs(ctx context.Context, pool *pgxpool.Pool, ids []int) ([]ProductWithTime, error) {
+	query := productSelect + `
+		WHERE p.id = ANY($1)
+		ORDER BY p.id
+	`
+
+	return retryRead(ctx, func() ([]ProductWithTime, error) {
+		rows, err := pool.Query(ctx, query, ids)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		var products []ProductWithTime
+		for rows.Next() {
+			var p ProductWithTime
+			err := rows.Scan(productScanDest(&p)...)
+			if err != nil {
+				return nil, err
+			}
+			products = append(products, p)
+		}
+
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+
+		return products, nil
+	})
+}
+
+// ProductChange - продукт из ленты изменений с моментом последнего изменения
+type ProductChange struct {
+	ProductWithTime
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// GetProductChanges возвращает продукты, созданные или изменённые после since,
+// в порядке изменения. updated_at ведёт триггер в БД, created_at <= updated_at всегда,
+// поэтому достаточно одного условия
+func GetProductChanges(ctx context.Context, pool *pgxpool.Pool, since time.Time) ([]ProductChange, error) {
+	query := `
+		SELECT ` + productColumns + `,
+			p.updated_at
+		` + productFrom + `
+		WHERE p.updated_at > $1
+		ORDER BY p.updated_at, p.id
+	`
+
+	rows, err := pool.Query(ctx, query, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []ProductChange{}
+	for rows.Next() {
+		var p ProductChange
+		err := rows.Scan(append(productScanDest(&p.ProductWithTime), &p.UpdatedAt)...)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// GetRecentProducts возвращает limit последних изменённых продуктов, новые первыми.
+// ORDER BY ... LIMIT идёт по idx_products_updated_at с конца, без сортировки всей таблицы
+func GetRecentProducts(ctx context.Context, pool *pgxpool.Pool, limit int) ([]ProductChange, error) {
+	query := `
+		SELECT ` + productColumns + `,
+			p.updated_at
+		` + productFrom + `
+		ORDER BY p.updated_at DESC, p.id DESC
+		LIMIT $1
+	`
+
+	rows, err := pool.Query(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	products := []ProductChange{}
+	for rows.Next() {
+		var p ProductChange
+		err := rows.Scan(append(productScanDest(&p.ProductWithTime), &p.UpdatedAt)...)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return products, nil
+}
+
+// ProductSearchResult - найденный продукт и поля, в которых нашлось совпадение
+type ProductSearchResult struct {
+	ProductWithTime
+	MatchedFields []string `json:"matched_fields"` // "product_name", "article", "material_name"
+	// Similarity - лучшее сходство по триграммам среди полей (0..1), только в нечётком поиске
+	Similarity *float64 `json:"similarity,omitempty"`
+}
+
+// escapeLike экранирует спецсимволы LIKE, чтобы % и _ из строки поиска искались буквально
+func escapeLike(raw string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(raw)
+}
+
+// SearchProducts ищет подстроку без учёта регистра в названии, артикуле ИЛИ материале.
+// Совпадения по названию идут первыми, за ними по артикулу, потом по материалу
+func SearchProducts(ctx context.Context, pool *pgxpool.Pool, search string, limit, offset int) ([]ProductSearchResult, error) {
+	query := `
+		SELECT ` + productColumns + `,
+			p.product_name ILIKE $1 AS name_match,
+			COALESCE(p.article, '') ILIKE $1 AS article_match,
+			m.material_name ILIKE $1 AS material_match
+		` + productFrom + `
+		WHERE p.product_name ILIKE $1
+			OR p.article ILIKE $1
+			OR m.material_name ILIKE $1
+		ORDER BY name_match DESC, article_match DESC, p.product_name, p.id
+		LIMIT $2 OFFSET $3
+	`
+
+	rows, err := pool.Query(ctx, query, "%"+escapeLike(search)+"%", limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []ProductSearchResult{}
+	for rows.Next() {
+		var p ProductSearchResult
+		var nameMatch, articleMatch, materialMatch bool
+		err := rows.Scan(append(productScanDest(&p.ProductWithTime), &nameMatch, &articleMatch, &materialMatch)...)
+		if err != nil {
+			return nil, err
+		}
+
+		p.MatchedFields = []string{}
+		if nameMatch {
+			p.MatchedFields = append(p.MatchedFields, "product_name")
+		}
+		if articleMatch {
+			p.MatchedFields = append(p.MatchedFields, "article")
+		}
+		if materialMatch {
+			p.MatchedFields = append(p.MatchedFields, "material_name")
+		}
+		results = append(results, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// SearchProductsFuzzy - поиск с опечатками через pg_trgm: продукт подходит, если сходство
+// названия, артикула или материала со строкой не ниже threshold. Оператор % (а с ним
+// GIN-индексы gin_trgm_ops из schema.sql) берёт порог из pg_trgm.similarity_threshold,
+// поэтому он выставляется на время транзакции. Сортировка по убыванию сходства
+func SearchProductsFuzzy(ctx context.Context, pool *pgxpool.Pool, search string, threshold float64, limit, offset int) ([]ProductSearchResult, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `SELECT set_config('pg_trgm.similarity_threshold', $1, true)`,
+		strconv.FormatFloat(threshold, 'f', -1, 64))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка установки порога сходства: %w", err)
+	}
+
+	query := `
+		SELECT ` + productColumns + `,
+			similarity(p.product_name, $1) AS name_sim,
+			similarity(COALESCE(p.article, ''), $1) AS article_sim,
+			similarity(m.material_name, $1) AS material_sim
+		` + productFrom + `
+		WHERE p.product_name % $1
+			OR p.article % $1
+			OR m.material_name % $1
+		ORDER BY GREATEST(similarity(p.product_name, $1), similarity(COALESCE(p.article, ''), $1),
+			similarity(m.material_name, $1)) DESC, p.product_name, p.id
+		LIMIT $2 OFFSET $3
+	`
+
+	rows, err := tx.Query(ctx, query, search, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []ProductSearchResult{}
+	for rows.Next() {
+		var p ProductSearchResult
+		var nameSim, articleSim, materialSim float64
+		err := rows.Scan(append(productScanDest(&p.ProductWithTime), &nameSim, &articleSim, &materialSim)...)
+		if err != nil {
+			return nil, err
+		}
+
+		p.MatchedFields = []string{}
+		if nameSim >= threshold {
+			p.MatchedFields = append(p.MatchedFields, "product_name")
+		}
+		if articleSim >= threshold {
+			p.MatchedFields = append(p.MatchedFields, "article")
+		}
+		if materialSim >= threshold {
+			p.MatchedFields = append(p.MatchedFields, "material_name")
+		}
+		best := max(nameSim, articleSim, materialSim)
+		p.Similarity = &best
+		results = append(results, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// scanProducts читает строки с колонками ProductWithTime в порядке полей структуры
+func scanProducts(rows pgx.Rows) ([]ProductWithTime, error) {
+	defer rows.Close()
+
+	products := []ProductWithTime{}
+	for rows.Next() {
+		var p ProductWithTime
+		err := rows.Scan(productScanDest(&p)...)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return products, nil
+}
+
+// similarPriceBand - ширина ценового коридора похожих продуктов (±20% от цены исходного)
+const similarPriceBand = 0.2
+
+// GetSimilarProducts ищет продукты того же типа и материала в ценовом коридоре вокруг
+// цены исходного продукта, ближайшие по цене - первыми
+func GetSimilarProducts(ctx context.Context, pool *pgxpool.Pool, productID int) ([]ProductWithTime, error) {
+	var typeID, materialID int
+	var price float64
+	err := pool.QueryRow(ctx,
+		`SELECT type_id, material_id, COALESCE(min_price, 0) FROM products WHERE id = $1`,
+		productID,
+	).Scan(&typeID, &materialID, &price)
+	if err == pgx.ErrNoRows {
+		return nil, ErrProductNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	query := productSelect + `
+		WHERE p.type_id = $1 AND p.material_id = $2 AND p.id <> $3
+			AND p.min_price BETWEEN $4 AND $5
+		ORDER BY ABS(p.min_price - $6), p.id
+		LIMIT 10
+	`
+
+	rows, err := pool.Query(ctx, query,
+		typeID, materialID, productID,
+		price*(1-similarPriceBand), price*(1+similarPriceBand), price,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanProducts(rows)
+}
+
+// GetWorkshopsByProductIDs получает цеха сразу для нескольких продуктов (без N+1)
+// Возвращает map: product_id -> цеха продукта
+func GetWorkshopsByProductIDs(ctx context.Context, pool *pgxpool.Pool, ids []int) (map[int][]ProductWorkshop, error) {
+	query := `
+		SELECT pw.product_id, w.id, w.name, COALESCE(pw.production_time, 0), pw.step_order
+		FROM products_workshop pw
+		JOIN workshops w ON pw.workshop_id = w.id
+		WHERE pw.product_id = ANY($1)
+		ORDER BY pw.product_id, pw.step_order, w.name
+	`
+
+	rows, err := pool.Query(ctx, query, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[int][]ProductWorkshop)
+	for rows.Next() {
+		var productID int
+		var w ProductWorkshop
+		if err := rows.Scan(&productID, &w.WorkshopID, &w.WorkshopName, &w.ProductionTime, &w.StepOrder); err != nil {
+			return nil, err
+		}
+		result[productID] = append(result[productID], w)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// GetLinkCountsByProductIDs - число цехов в маршруте для нескольких продуктов.
+// Продукта без цехов в map нет
+func GetLinkCountsByProductIDs(ctx context.Context, pool *pgxpool.Pool, ids []int) (map[int]int, error) {
+	query := `
+		SELECT product_id, COUNT(*)
+		FROM products_workshop
+		WHERE product_id = ANY($1)
+		GROUP BY product_id
+	`
+
+	rows, err := pool.Query(ctx, query, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[int]int)
+	for rows.Next() {
+		var productID, count int
+		if err := rows.Scan(&productID, &count); err != nil {
+			return nil, err
+		}
+		result[productID] = count
+	}
+
+	return result, rows.Err()
+}
+
+// WorkshopMatrix - разреженная матрица продукт x цех для тепловой карты маршрутов.
+// Cells - тройки [индекс в ProductIDs, индекс в WorkshopIDs, время]: id не повторяются в каждой ячейке
+type WorkshopMatrix struct {
+	ProductIDs  []int        `json:"product_ids"`
+	WorkshopIDs []int        `json:"workshop_ids"`
+	Cells       [][3]float64 `json:"cells"`
+}
+
+// GetWorkshopMatrix строит матрицу одним запросом по products_workshop.
+// productIDs пустой - все продукты. Продукты и цеха без связей в матрицу не попадают
+func GetWorkshopMatrix(ctx context.Context, pool *pgxpool.Pool, productIDs []int) (*WorkshopMatrix, error) {
+	query := `
+		SELECT product_id, workshop_id, COALESCE(production_time, 0)
+		FROM products_workshop
+		WHERE cardinality($1::int[]) = 0 OR product_id = ANY($1)
+		ORDER BY product_id, workshop_id
+	`
+
+	if productIDs == nil {
+		productIDs = []int{}
+	}
+	rows, err := pool.Query(ctx, query, productIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matrix := &WorkshopMatrix{ProductIDs: []int{}, WorkshopIDs: []int{}, Cells: [][3]float64{}}
+	workshopIndex := map[int]int{}
+	for rows.Next() {
+		var productID, workshopID int
+		var productionTime float64
+		if err := rows.Scan(&productID, &workshopID, &productionTime); err != nil {
+			return nil, err
+		}
+
+		// Строки отсортированы по product_id - новый продукт всегда последний
+		if n := len(matrix.ProductIDs); n == 0 || matrix.ProductIDs[n-1] != productID {
+			matrix.ProductIDs = append(matrix.ProductIDs, productID)
+		}
+		wi, ok := workshopIndex[workshopID]
+		if !ok {
+			wi = len(matrix.WorkshopIDs)
+			workshopIndex[workshopID] = wi
+			matrix.WorkshopIDs = append(matrix.WorkshopIDs, workshopID)
+		}
+		matrix.Cells = append(matrix.Cells, [3]float64{float64(len(matrix.ProductIDs) - 1), float64(wi), productionTime})
+	}
+
+	return matrix, rows.Err()
+}
+
+// GetProductWorkshops получает маршрут продукта: цеха в порядке step_order.
+// limit = 0 - весь маршрут, иначе страница шагов с offset
+func GetProductWorkshops(ctx context.Context, pool *pgxpool.Pool, productID int, limit, offset int) ([]ProductWorkshop, error) {
+	query := productRouteQuery
+
+	args := []any{productID}
+	if limit > 0 {
+		args = append(args, limit, offset)
+		query += " LIMIT $2 OFFSET $3"
+	}
+
+	rows, err := pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanRoute(rows)
+}
+
+// productRouteQuery - маршрут продукта $1 в порядке шагов.
+// production_time в схеме допускает NULL (связь создана без времени): шаг отдаётся с 0,
+// а SUM/MAX итога (total_production_time, time_mode=max) NULL пропускают - сумма шагов
+// маршрута всегда совпадает с итогом продукта. Все выборки шагов делают тот же COALESCE
+const productRouteQuery = `
+		SELECT w.id, w.name, COALESCE(pw.production_time, 0), pw.step_order
+		FROM products_workshop pw
+		JOIN workshops w ON pw.workshop_id = w.id
+		WHERE pw.product_id = $1
+		ORDER BY pw.step_order, w.name, w.id`
+
+// scanRoute читает строки productRouteQuery и закрывает rows
+func scanRoute(rows pgx.Rows) ([]ProductWorkshop, error) {
+	defer rows.Close()
+
+	workshops := []ProductWorkshop{}
+	for rows.Next() {
+		var w ProductWorkshop
+		if err := rows.Scan(&w.WorkshopID, &w.WorkshopName, &w.ProductionTime, &w.StepOrder); err != nil {
+			return nil, err
+		}
+		workshops = append(workshops, w)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return workshops, nil
+}
+
+// CountProductWorkshops возвращает число шагов в маршруте продукта
+func CountProductWorkshops(ctx context.Context, pool *pgxpool.Pool, productID int) (int, error) {
+	var total int
+	err := pool.QueryRow(ctx, `SELECT COUNT(*) FROM products_workshop WHERE product_id = $1`, productID).Scan(&total)
+	return total, err
+}
+
+// ErrWorkshopOrderMismatch - новый порядок не совпадает с текущим набором цехов продукта
+var ErrWorkshopOrderMismatch = errors.New("порядок цехов не совпадает с маршрутом продукта")
+
+// ReorderProductWorkshops выставляет step_order цехам продукта в порядке workshopIDs.
+// Набор id должен в точности совпадать с текущими цехами продукта
+func ReorderProductWorkshops(ctx context.Context, pool *pgxpool.Pool, productID int, workshopIDs []int) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err = lockProduct(ctx, tx, productID); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(ctx,
+		`SELECT workshop_id FROM products_workshop WHERE product_id = $1 FOR UPDATE`,
+		productID,
+	)
+	if err != nil {
+		return fmt.Errorf("ошибка получения цехов продукта: %w", err)
+	}
+	current := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("ошибка получения цехов продукта: %w", err)
+		}
+		current[id] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("ошибка получения цехов продукта: %w", err)
+	}
+
+	// Проверяем, что набор совпадает: та же длина, без дублей и без чужих цехов
+	if len(workshopIDs) != len(current) {
+		return fmt.Errorf("%w: у продукта %d цехов, передано %d", ErrWorkshopOrderMismatch, len(current), len(workshopIDs))
+	}
+	seen := make(map[int]bool)
+	for _, id := range workshopIDs {
+		if seen[id] {
+			return fmt.Errorf("%w: цех %d указан дважды", ErrWorkshopOrderMismatch, id)
+		}
+		if !current[id] {
+			return fmt.Errorf("%w: цех %d не входит в маршрут продукта", ErrWorkshopOrderMismatch, id)
+		}
+		seen[id] = true
+	}
+
+	query := `UPDATE products_workshop SET step_order = $3 WHERE product_id = $1 AND workshop_id = $2`
+	for i, id := range workshopIDs {
+		if _, err = tx.Exec(ctx, query, productID, id, i+1); err != nil {
+			return fmt.Errorf("ошибка обновления порядка цеха %d: %w", id, err)
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("ошибка коммита транзакции: %w", err)
+	}
+
+	return nil
+}
+
+// ErrWorkshopAlreadyLinked - цех уже есть в маршруте продукта
+var ErrWorkshopAlreadyLinked = errors.New("цех уже добавлен к продукту")
+
+// ErrWorkshopNotFound - цеха с таким ID нет
+var ErrWorkshopNotFound = errors.New("цех не найден")
+
+// ErrWorkshopNotLinked - цеха нет в маршруте продукта
+var ErrWorkshopNotLinked = errors.New("цех не входит в маршрут продукта")
+
+// MissingWorkshopsError - в запросе есть несуществующие цеха. errors.Is(err, ErrWorkshopNotFound) == true
+type MissingWorkshopsError struct {
+	IDs []int
+}
+
+func (e *MissingWorkshopsError) Error() string {
+	ids := make([]string, len(e.IDs))
+	for i, id := range e.IDs {
+		ids[i] = strconv.Itoa(id)
+	}
+	return fmt.Sprintf("%s: %s", ErrWorkshopNotFound, strings.Join(ids, ", "))
+}
+
+func (e *MissingWorkshopsError) Unwrap() error {
+	return ErrWorkshopNotFound
+}
+
+// checkWorkshopsExist проверяет все workshop_id одним запросом до вставки,
+// чтобы сообщить обо всех неверных id сразу, а не упасть на первом FK
+func checkWorkshopsExist(ctx context.Context, tx pgx.Tx, workshops []WorkshopInput) error {
+	if len(workshops) == 0 {
+		return nil
+	}
+	ids := make([]int, len(workshops))
+	for i, w := range workshops {
+		ids[i] = w.WorkshopID
+	}
+
+	rows, err := tx.Query(ctx, `SELECT id FROM workshops WHERE id = ANY($1)`, ids)
+	if err != nil {
+		return fmt.Errorf("ошибка проверки цехов: %w", err)
+	}
+	existing, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return fmt.Errorf("ошибка проверки цехов: %w", err)
+	}
+
+	found := make(map[int]bool, len(existing))
+	for _, id := range existing {
+		found[id] = true
+	}
+	var missing []int
+	for _, id := range ids {
+		if !found[id] {
+			missing = append(missing, id)
+			found[id] = true // повторы во входных данных не дублируем в ошибке
+		}
+	}
+	if len(missing) > 0 {
+		return &MissingWorkshopsError{IDs: missing}
+	}
+	return nil
+}
+
+// AddProductWorkshop добавляет цех в конец маршрута продукта и возвращает новое суммарное время.
+// Маршрут длиннее maxWorkshops - ErrTooManyWorkshops: цеха считаются под блокировкой продукта,
+// параллельные добавления не обойдут лимит
+func AddProductWorkshop(ctx context.Context, pool *pgxpool.Pool, productID int, input WorkshopInput, maxWorkshops int, totals *totalRecomputer) (float64, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err = lockProduct(ctx, tx, productID); err != nil {
+		return 0, err
+	}
+
+	query := `
+		INSERT INTO products_workshop (product_id, workshop_id, production_time, step_order)
+		SELECT $1, $2, $3, COALESCE(MAX(step_order), 0) + 1
+		FROM products_workshop
+		WHERE product_id = $1
+	`
+	_, err = tx.Exec(ctx, query, productID, input.WorkshopID, input.ProductionTime)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "23505": // unique_violation
+			return 0, fmt.Errorf("%w: цех %d уже есть в маршруте продукта", ErrWorkshopAlreadyLinked, input.WorkshopID)
+		case "23503": // foreign_key_violation
+			return 0, fmt.Errorf("%w: цех %d", ErrWorkshopNotFound, input.WorkshopID)
+		}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("ошибка добавления цеха %d: %w", input.WorkshopID, err)
+	}
+
+	var count int
+	err = tx.QueryRow(ctx, `SELECT COUNT(*) FROM products_workshop WHERE product_id = $1`, productID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка подсчёта цехов маршрута: %w", err)
+	}
+	if count > maxWorkshops {
+		return 0, fmt.Errorf("%w: станет %d, максимум %d на продукт", ErrTooManyWorkshops, count, maxWorkshops)
+	}
+
+	total, err := totals.sync(ctx, tx, productID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("ошибка коммита транзакции: %w", err)
+	}
+	totals.schedule(productID)
+
+	return total, nil
+}
+
+// UpdateWorkshopTime меняет время одного цеха в маршруте продукта и возвращает новое суммарное время.
+// ErrProductNotFound - нет продукта, ErrWorkshopNotLinked - цеха нет в его маршруте
+func UpdateWorkshopTime(ctx context.Context, pool *pgxpool.Pool, productID, workshopID int, productionTime float64, totals *totalRecomputer) (float64, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err = lockProduct(ctx, tx, productID); err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec(ctx, `
+		UPDATE products_workshop
+		SET production_time = $3
+		WHERE product_id = $1 AND workshop_id = $2
+	`, productID, workshopID, productionTime)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка изменения времени цеха %d: %w", workshopID, err)
+	}
+	if result.RowsAffected() == 0 {
+		return 0, ErrWorkshopNotLinked
+	}
+
+	total, err := totals.sync(ctx, tx, productID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("ошибка коммита транзакции: %w", err)
+	}
+	totals.schedule(productID)
+
+	return total, nil
+}
+
+// insertWorkshopLinks добавляет цеха продукта, step_order - порядок во входных данных.
+// Несуществующие цеха проверяются заранее (MissingWorkshopsError), ошибки FK/уникальности
+// при вставке (цех удалили параллельно, цех указан дважды) превращаются в ErrWorkshopNotFound/ErrWorkshopAlreadyLinked
+//
+// Инвариант: строки вставляются строго по возрастанию workshop_id. Вставка берёт блокировки
+// (уникальный индекс, FK на workshops) в порядке вставки, и если два параллельных запроса
+// идут по пересекающимся наборам цехов в разном порядке, они могут зайти в deadlock.
+// Единый порядок исключает это. step_order при этом берётся из исходного порядка
+func insertWorkshopLinks(ctx context.Context, tx pgx.Tx, productID int, workshops []WorkshopInput) error {
+	if err := checkWorkshopsExist(ctx, tx, workshops); err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO products_workshop (product_id, workshop_id, production_time, step_order)
+		VALUES ($1, $2, $3, $4)
+	`
+
+	for _, i := range workshopInsertOrder(workshops) {
+		workshop := workshops[i]
+		_, err := tx.Exec(ctx, query, productID, workshop.WorkshopID, workshop.ProductionTime, i+1)
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			switch pgErr.Code {
+			case "23505": // unique_violation
+				return fmt.Errorf("%w: цех %d указан дважды", ErrWorkshopAlreadyLinked, workshop.WorkshopID)
+			case "23503": // foreign_key_violation
+				return fmt.Errorf("%w: цех %d", ErrWorkshopNotFound, workshop.WorkshopID)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("ошибка добавления цеха %d: %w", workshop.WorkshopID, err)
+		}
+	}
+
+	return nil
+}
+
+// workshopInsertOrder - индексы workshops по возрастанию workshop_id (см. инвариант insertWorkshopLinks).
+// Сортировка устойчивая: повтор цеха остаётся на своей позиции и даёт понятную ошибку уникальности
+func workshopInsertOrder(workshops []WorkshopInput) []int {
+	order := make([]int, len(workshops))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return workshops[order[a]].WorkshopID < workshops[order[b]].WorkshopID
+	})
+	return order
+}
+
+// ReplaceProductWorkshops полностью заменяет маршрут продукта и возвращает новое суммарное время
+func ReplaceProductWorkshops(ctx context.Context, pool *pgxpool.Pool, productID int, workshops []WorkshopInput, totals *totalRecomputer) (float64, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err = lockProduct(ctx, tx, productID); err != nil {
+		return 0, err
+	}
+
+	if _, err = tx.Exec(ctx, `DELETE FROM products_workshop WHERE product_id = $1`, productID); err != nil {
+		return 0, fmt.Errorf("ошибка удаления старых цехов: %w", err)
+	}
+
+	if err = insertWorkshopLinks(ctx, tx, productID, workshops); err != nil {
+		return 0, err
+	}
+
+	total, err := totals.sync(ctx, tx, productID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("ошибка коммита транзакции: %w", err)
+	}
+	totals.schedule(productID)
+
+	return total, nil
+}
+
+// ErrTooManyWorkshops - после изменения в маршруте окажется больше цехов, чем разрешено
+var ErrTooManyWorkshops = errors.New("слишком много цехов в маршруте")
+
+// MergeProductWorkshops добавляет или обновляет переданные цеха, не трогая остальные связи продукта:
+// новым цехам ставится время и место в конце маршрута (в порядке входных данных), у уже
+// связанных меняется только время. maxWorkshops ограничивает итоговый размер маршрута.
+// Возвращает новое суммарное время
+func MergeProductWorkshops(ctx context.Context, pool *pgxpool.Pool, productID int, workshops []WorkshopInput, maxWorkshops int, totals *totalRecomputer) (float64, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err = lockProduct(ctx, tx, productID); err != nil {
+		return 0, err
+	}
+	if err = checkWorkshopsExist(ctx, tx, workshops); err != nil {
+		return 0, err
+	}
+
+	seen := make(map[int]bool, len(workshops))
+	for _, w := range workshops {
+		if seen[w.WorkshopID] {
+			return 0, fmt.Errorf("%w: цех %d указан дважды", ErrWorkshopAlreadyLinked, w.WorkshopID)
+		}
+		seen[w.WorkshopID] = true
+	}
+
+	var lastStep int
+	err = tx.QueryRow(ctx, `SELECT COALESCE(MAX(step_order), 0) FROM products_workshop WHERE product_id = $1`, productID).Scan(&lastStep)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения маршрута продукта: %w", err)
+	}
+
+	// Тот же порядок вставки по workshop_id, что в insertWorkshopLinks (защита от deadlock).
+	// step_order уже связанных цехов ON CONFLICT не меняет
+	query := `
+		INSERT INTO products_workshop (product_id, workshop_id, production_time, step_order)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (product_id, workshop_id) DO UPDATE SET production_time = EXCLUDED.production_time
+	`
+	order := make([]int, len(workshops))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return workshops[order[a]].WorkshopID < workshops[order[b]].WorkshopID
+	})
+	for _, i := range order {
+		w := workshops[i]
+		_, err = tx.Exec(ctx, query, productID, w.WorkshopID, w.ProductionTime, lastStep+i+1)
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23503" { // цех удалили после проверки
+			return 0, fmt.Errorf("%w: %d", ErrWorkshopNotFound, w.WorkshopID)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("ошибка сохранения цеха %d: %w", w.WorkshopID, err)
+		}
+	}
+
+	// Уже связанные цеха оставили пропуски в step_order новых - нумеруем маршрут заново подряд
+	var count int
+	err = tx.QueryRow(ctx, `
+		WITH renumbered AS (
+			UPDATE products_workshop pw
+			SET step_order = r.step
+			FROM (
+				SELECT id, ROW_NUMBER() OVER (ORDER BY step_order, id) AS step
+				FROM products_workshop
+				WHERE product_id = $1
+			) r
+			WHERE pw.id = r.id AND pw.step_order <> r.step
+		)
+		SELECT COUNT(*) FROM products_workshop WHERE product_id = $1
+	`, productID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка нумерации маршрута: %w", err)
+	}
+	if count > maxWorkshops {
+		return 0, fmt.Errorf("%w: станет %d, максимум %d на продукт", ErrTooManyWorkshops, count, maxWorkshops)
+	}
+
+	total, err := totals.sync(ctx, tx, productID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("ошибка коммита транзакции: %w", err)
+	}
+	totals.schedule(productID)
+
+	return total, nil
+}
+
+// WorkshopAssignResult - итог массового добавления цеха
+type WorkshopAssignResult struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Skipped int `json:"skipped"` // цех уже был в маршруте (без update_existing или с тем же временем)
+}
+
+// AssignWorkshop добавляет цех в маршрут каждого продукта из productIDs одной транзакцией:
+// новым шагом в конце маршрута с временем productionTime. У продуктов, где цех уже есть,
+// с updateExisting обновляется время, иначе связь не трогается. Все продукты должны
+// существовать, и ни у одного маршрут не должен превысить maxWorkshops - иначе не меняется ничего
+func AssignWorkshop(ctx context.Context, pool *pgxpool.Pool, workshopID int, productIDs []int, productionTime float64, updateExisting bool, maxWorkshops int) (*WorkshopAssignResult, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var id int
+	err = tx.QueryRow(ctx, `SELECT id FROM workshops WHERE id = $1 FOR KEY SHARE`, workshopID).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrWorkshopNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения цеха %d: %w", workshopID, err)
+	}
+
+	// Строки продуктов блокируются по возрастанию id, как в lockProduct для одного продукта:
+	// параллельное изменение маршрута не разойдётся с пересчётом времени ниже
+	rows, err := tx.Query(ctx, `SELECT id FROM products WHERE id = ANY($1) ORDER BY id FOR UPDATE`, productIDs)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка блокировки продуктов: %w", err)
+	}
+	locked, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return nil, fmt.Errorf("ошибка блокировки продуктов: %w", err)
+	}
+	if len(locked) != len(productIDs) {
+		found := make(map[int]bool, len(locked))
+		for _, id := range locked {
+			found[id] = true
+		}
+		var missing []string
+		for _, id := range productIDs {
+			if !found[id] {
+				missing = append(missing, strconv.Itoa(id))
+			}
+		}
+		return nil, fmt.Errorf("%w: %s", ErrProductNotFound, strings.Join(missing, ", "))
+	}
+
+	var fullID, count int
+	err = tx.QueryRow(ctx, `
+		SELECT pw.product_id, COUNT(*)
+		FROM products_workshop pw
+		WHERE pw.product_id = ANY($1)
+			AND NOT EXISTS (
+				SELECT 1 FROM products_workshop x WHERE x.product_id = pw.product_id AND x.workshop_id = $2
+			)
+		GROUP BY pw.product_id
+		HAVING COUNT(*) >= $3
+		ORDER BY pw.product_id
+		LIMIT 1
+	`, productIDs, workshopID, maxWorkshops).Scan(&fullID, &count)
+	if err == nil {
+		return nil, fmt.Errorf("%w: у продукта %d уже %d, максимум %d на продукт", ErrTooManyWorkshops, fullID, count, maxWorkshops)
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("ошибка проверки размера маршрутов: %w", err)
+	}
+
+	conflict := `DO NOTHING`
+	if updateExisting {
+		conflict = `DO UPDATE SET production_time = EXCLUDED.production_time
+			WHERE products_workshop.production_time IS DISTINCT FROM EXCLUDED.production_time`
+	}
+	// xmax = 0 только у вставленной строки, у обновлённой - id транзакции
+	rows, err = tx.Query(ctx, `
+		INSERT INTO products_workshop (product_id, workshop_id, production_time, step_order)
+		SELECT p.id, $2, $3, COALESCE((
+			SELECT MAX(pw.step_order) FROM products_workshop pw WHERE pw.product_id = p.id
+		), 0) + 1
+		FROM unnest($1::int[]) AS p(id)
+		ORDER BY p.id
+		ON CONFLICT (product_id, workshop_id) `+conflict+`
+		RETURNING xmax = 0
+	`, productIDs, workshopID, productionTime)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка добавления цеха %d: %w", workshopID, err)
+	}
+	inserted, err := pgx.CollectRows(rows, pgx.RowTo[bool])
+	if err != nil {
+		return nil, fmt.Errorf("ошибка добавления цеха %d: %w", workshopID, err)
+	}
+
+	result := &WorkshopAssignResult{}
+	for _, created := range inserted {
+		if created {
+			result.Created++
+		} else {
+			result.Updated++
+		}
+	}
+	result.Skipped = len(productIDs) - len(inserted)
+
+	if result.Created+result.Updated > 0 {
+		_, err = tx.Exec(ctx, `
+			UPDATE products p
+			SET total_production_time = t.total
+			FROM (
+				SELECT product_id, COALESCE(SUM(production_time), 0) AS total
+				FROM products_workshop
+				WHERE product_id = ANY($1)
+				GROUP BY product_id
+			) t
+			WHERE p.id = t.product_id AND p.total_production_time IS DISTINCT FROM t.total
+		`, productIDs)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка пересчёта времени производства: %w", err)
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("ошибка коммита транзакции: %w", err)
+	}
+
+	return result, nil
+}
+
+// ParseIDList разбирает список ID через запятую ("1,2,3"), дубли отбрасываются
+func ParseIDList(raw string) ([]int, error) {
+	var ids []int
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := parseID(part)
+		if err != nil {
+			return nil, fmt.Errorf("неверный id '%s'", part)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// CreateProductInput - данные для создания продукта
+// Вместо min_price можно передать markup_percent - тогда цена считается от себестоимости материала.
+// Вместо material_id/type_id можно передать material_name/type_name (для выгрузок, где есть только
+// названия): они ищутся без учёта регистра, а с create_missing=true недостающие создаются
+type CreateProductInput struct {
+	ProductName   string   `json:"product_name" binding:"required"`
+	MaterialID    int      `json:"material_id" binding:"required_without=MaterialName,excluded_with=MaterialName,omitempty,gt=0"`
+	MaterialName  string   `json:"material_name"`
+	TypeID        int      `json:"type_id" binding:"required_without=TypeName,excluded_with=TypeName,omitempty,gt=0"`
+	TypeName      string   `json:"type_name"`
+	CreateMissing bool     `json:"create_missing"`
+	MinPrice      *float64 `json:"min_price"` // nil - не передана: цену можно задать наценкой
+	MarkupPercent *float64 `json:"markup_percent" binding:"omitempty,gte=0"`
+	Article       string   `json:"article"`
+	ImageURL      string   `json:"image_url" binding:"omitempty,http_url"` // пустая строка - без картинки
+}
+
+// ErrUnknownReference - материал или тип, указанный по названию, не найден
+var ErrUnknownReference = errors.New("справочник не содержит такого значения")
+
+// ErrInvalidReference - id материала или типа после подстановки названий не положительный
+var ErrInvalidReference = errors.New("неверные данные")
+
+// resolveProductRefs подставляет material_id/type_id по названиям из input внутри транзакции вставки.
+// Без create_missing неизвестное название - ErrUnknownReference. Затем итоговые id всегда проходят
+// validateProductRefs - и заданные числом, и подставленные по названию
+func resolveProductRefs(ctx context.Context, tx pgx.Tx, input *CreateProductInput) error {
+	if input.MaterialName != "" {
+		id, err := resolveReferenceID(ctx, tx, "materials", input.MaterialName, input.CreateMissing)
+		if err != nil {
+			return err
+		}
+		input.MaterialID = id
+	}
+	if input.TypeName != "" {
+		id, err := resolveReferenceID(ctx, tx, "types", input.TypeName, input.CreateMissing)
+		if err != nil {
+			return err
+		}
+		input.TypeID = id
+	}
+	if err := validateProductRefs(input.MaterialID, input.TypeID, nil); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidReference, err)
+	}
+	return nil
+}
+
+// referenceNameQueries - поиск и создание записи справочника по названию; kind - как в notifyReferenceChanged
+var referenceNameQueries = map[string]struct {
+	title, find, insert string
+}{
+	"materials": {
+		title:  "материал",
+		find:   `SELECT id FROM materials WHERE LOWER(material_name) = LOWER($1) ORDER BY id LIMIT 2`,
+		insert: `INSERT INTO materials (material_name) VALUES ($1) RETURNING id`,
+	},
+	"types": {
+		title:  "тип продукции",
+		find:   `SELECT id FROM products_types WHERE LOWER(type_name) = LOWER($1) ORDER BY id LIMIT 2`,
+		insert: `INSERT INTO products_types (type_name) VALUES ($1) RETURNING id`,
+	},
+}
+
+// resolveReferenceID ищет запись справочника по названию. Несколько записей с одним названием -
+// ошибка: молча выбрать одну из них значило бы угадывать
+func resolveReferenceID(ctx context.Context, tx pgx.Tx, kind, name string, createMissing bool) (int, error) {
+	q := referenceNameQueries[kind]
+	name = strings.TrimSpace(name)
+
+	rows, err := tx.Query(ctx, q.find, name)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка поиска: %s %q: %w", q.title, name, err)
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return 0, fmt.Errorf("ошибка поиска: %s %q: %w", q.title, name, err)
+	}
+
+	switch {
+	case len(ids) == 1:
+		return ids[0], nil
+	case len(ids) > 1:
+		return 0, fmt.Errorf("%w: %s %q встречается несколько раз, укажите id", ErrUnknownReference, q.title, name)
+	case !createMissing:
+		return 0, fmt.Errorf("%w: %s %q не найден (create_missing=true - создать)", ErrUnknownReference, q.title, name)
+	}
+
+	// Новая запись без коэффициентов (wasting_percentage/type_ratio): их заполняют потом в справочнике
+	var id int
+	if err := tx.QueryRow(ctx, q.insert, name).Scan(&id); err != nil {
+		return 0, fmt.Errorf("ошибка создания: %s %q: %w", q.title, name, err)
+	}
+	// Другие экземпляры сбросят кеш после COMMIT
+	if err := notifyReferenceChanged(ctx, tx, kind); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// WorkshopInput - данные о цехе для продукта
+type WorkshopInput struct {
+	WorkshopID     int     `json:"workshop_id" binding:"required,gt=0"`
+	ProductionTime float64 `json:"production_time" binding:"required,gt=0"`
+}
+
+// CreateProductWithWorkshopsInput - данные для создания продукта с цехами
+type CreateProductWithWorkshopsInput struct {
+	ProductName   string          `json:"product_name" binding:"required"`
+	MaterialID    int             `json:"material_id" binding:"required,gt=0"`
+	TypeID        int             `json:"type_id" binding:"required,gt=0"`
+	MinPrice      *float64        `json:"min_price"`
+	MarkupPercent *float64        `json:"markup_percent" binding:"omitempty,gte=0"`
+	Article       string          `json:"article"`
+	ImageURL      string          `json:"image_url" binding:"omitempty,http_url"`
+	Workshops     []WorkshopInput `json:"workshops"` // массив цехов
+}
+
+// validateProductRefs проверяет, что id материала, типа и цехов положительные.
+// Дублирует binding-теги для путей без биндинга (HTML-форма), чтобы вместо FK-ошибки из БД был понятный 400
+func validateProductRefs(materialID, typeID int, workshops []WorkshopInput) error {
+	if materialID <= 0 {
+		return fmt.Errorf("material_id должен быть положительным")
+	}
+	if typeID <= 0 {
+		return fmt.Errorf("type_id должен быть положительным")
+	}
+	for _, w := range workshops {
+		if w.WorkshopID <= 0 {
+			return fmt.Errorf("workshop_id должен быть положительным")
+		}
+	}
+	return nil
+}
+
+// isHTTPURL - та же проверка, что binding-тег http_url, для HTML-формы
+func isHTTPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	return scheme == "http" || scheme == "https"
+}
+
+// CreateProductResult - результат создания продукта
+type CreateProductResult struct {
+	ProductID int
+	Product   ProductWithTime   // строка продукта сразу после вставки (total_production_time - без цехов)
+	Workshops []ProductWorkshop // маршрут, как он записан; заполняет только CreateProductWithWorkshops
+	Warnings  []string          // мягкие предупреждения: продукт создан, но стоит проверить данные
+}
+
+// lowPriceRatio - цена ниже этой доли от средней по типу даёт предупреждение
+const lowPriceRatio = 0.5
+
+// CreateProduct создаёт новый продукт и возвращает его ID
+// Если артикул не передан, он генерируется в той же транзакции (см. generateArticle)
+func CreateProduct(ctx context.Context, pool *pgxpool.Pool, input CreateProductInput, articlePattern *regexp.Regexp) (*CreateProductResult, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	result, err := insertProduct(ctx, tx, input, articlePattern)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("ошибка коммита транзакции: %w", err)
+	}
+
+	return result, nil
+}
+
+// ErrArticleTaken - артикул уже занят другим продуктом (без учёта регистра)
+var ErrArticleTaken = errors.New("артикул уже используется")
+
+// ErrDuplicateProduct - продукт с таким названием (без учёта регистра), материалом и типом уже есть
+var ErrDuplicateProduct = errors.New("продукт с таким названием, материалом и типом уже существует")
+
+// productNameRefsIndex - уникальный индекс (LOWER(product_name), material_id, type_id) из schema.sql
+const productNameRefsIndex = "idx_products_name_material_type"
+
+// DuplicateProductError - вставка упёрлась в productNameRefsIndex. Id уже найденные по
+// названиям справочников: вызывающий по ним ищет существующий продукт (FindProductByNameAndRefs)
+type DuplicateProductError struct {
+	ProductName string
+	MaterialID  int
+	TypeID      int
+}
+
+func (e *DuplicateProductError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrDuplicateProduct, e.ProductName)
+}
+
+func (e *DuplicateProductError) Unwrap() error { return ErrDuplicateProduct }
+
+// productUniqueViolation различает нарушения уникальности продукта по имени индекса:
+// составной ключ - *DuplicateProductError, артикул - ErrArticleTaken. Индекс с другим именем
+// (база старше schema.sql) считается артикулом, как было до составного ключа. nil - не 23505
+func productUniqueViolation(err error, article string, input CreateProductInput) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != "23505" { // unique_violation
+		return nil
+	}
+	if pgErr.ConstraintName == productNameRefsIndex {
+		return &DuplicateProductError{ProductName: input.ProductName, MaterialID: input.MaterialID, TypeID: input.TypeID}
+	}
+	return fmt.Errorf("%w: %s", ErrArticleTaken, article)
+}
+
+// normalizeArticle приводит артикул к единому виду: без пробелов по краям, в верхнем регистре.
+// Так "abc-1" и "ABC-1" - один и тот же артикул
+func normalizeArticle(raw string) string {
+	return strings.ToUpper(strings.TrimSpace(raw))
+}
+
+// ErrGeneratedArticleMismatch - сгенерированный артикул не проходит ARTICLE_PATTERN
+// (например, префикс из кириллического названия типа при латинском шаблоне)
+var ErrGeneratedArticleMismatch = errors.New("сгенерированный артикул не соответствует ARTICLE_PATTERN")
+
+// insertProduct вставляет строку продукта внутри транзакции:
+// генерирует артикул при необходимости и собирает предупреждения по цене.
+// Сгенерированный артикул сверяется с articlePattern (nil - без проверки) так же,
+// как переданный клиентом: иначе в базу попадали бы артикулы, которые API сам отвергает
+func insertProduct(ctx context.Context, tx pgx.Tx, input CreateProductInput, articlePattern *regexp.Regexp) (*CreateProductResult, error) {
+	if err := resolveProductRefs(ctx, tx, &input); err != nil {
+		return nil, err
+	}
+
+	var err error
+	article := normalizeArticle(input.Article)
+	if article == "" {
+		article, err = generateArticle(ctx, tx, input.TypeID)
+		if err != nil {
+			return nil, err
+		}
+		if articlePattern != nil && !articlePattern.MatchString(article) {
+			return nil, fmt.Errorf("%w: %s не подходит под %s, укажите артикул явно",
+				ErrGeneratedArticleMismatch, article, articlePattern)
+		}
+	}
+
+	minPrice, err := inputMinPrice(ctx, tx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	// Считаем до вставки, чтобы новый продукт не влиял на среднее
+	warnings, err := priceWarnings(ctx, tx, input.TypeID, minPrice)
+	if err != nil {
+		return nil, err
+	}
+
+	// Вставленная строка сразу читается с названиями материала и типа - тем, кто
+	// отдаёт созданный продукт, не нужен повторный запрос. JOIN не теряет строку:
+	// материал и тип проверены внешними ключами
+	query := `
+		WITH p AS (
+			INSERT INTO products (product_name, material_id, type_id, min_price, article, image_url)
+			VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''))
+			RETURNING *
+		)
+		SELECT ` + productColumns + `
+		FROM p
+		JOIN materials m ON p.material_id = m.id
+		JOIN products_types pt ON p.type_id = pt.id
+	`
+
+	var product ProductWithTime
+	err = tx.QueryRow(ctx, query,
+		input.ProductName,
+		input.MaterialID,
+		input.TypeID,
+		minPrice,
+		article,
+		strings.TrimSpace(input.ImageURL),
+	).Scan(productScanDest(&product)...)
+
+	if uniqueErr := productUniqueViolation(err, article, input); uniqueErr != nil {
+		return nil, uniqueErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания продукта: %w", err)
+	}
+
+	return &CreateProductResult{ProductID: product.ID, Product: product, Warnings: warnings}, nil
+}
+
+// ErrInvalidPricing - цену нельзя определить по переданным данным
+var ErrInvalidPricing = errors.New("неверные параметры цены")
+
+// inputMinPrice возвращает цену для записи: переданную min_price или рассчитанную по наценке.
+// Без обоих полей цена 0
+func inputMinPrice(ctx context.Context, tx pgx.Tx, input CreateProductInput) (float64, error) {
+	if input.MarkupPercent != nil {
+		return priceFromMarkup(ctx, tx, input.MinPrice, input.MaterialID, *input.MarkupPercent)
+	}
+	if input.MinPrice != nil {
+		return *input.MinPrice, nil
+	}
+	return 0, nil
+}
+
+// priceFromMarkup считает min_price = себестоимость материала * (1 + наценка/100).
+// Себестоимость читается в той же транзакции, что и вставка продукта.
+// Переданная вместе с наценкой min_price - даже 0 - ошибка
+func priceFromMarkup(ctx context.Context, tx pgx.Tx, minPrice *float64, materialID int, markupPercent float64) (float64, error) {
+	if minPrice != nil {
+		return 0, fmt.Errorf("%w: укажите либо min_price, либо markup_percent", ErrInvalidPricing)
+	}
+
+	var cost *float64
+	err := tx.QueryRow(ctx, `SELECT cost FROM materials WHERE id = $1`, materialID).Scan(&cost)
+	if err == pgx.ErrNoRows {
+		return 0, fmt.Errorf("%w: материал с id %d не найден", ErrInvalidPricing, materialID)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения себестоимости материала: %w", err)
+	}
+	if cost == nil {
+		return 0, fmt.Errorf("%w: у материала %d не задана себестоимость", ErrInvalidPricing, materialID)
+	}
+
+	// Округляем до копеек, как хранится в DECIMAL(10,2). Огромная наценка даёт +Inf,
+	// которое postgres отклонил бы невнятным переполнением numeric
+	price := math.Round(*cost*(1+markupPercent/100)*100) / 100
+	if math.IsInf(price, 0) || math.IsNaN(price) {
+		return 0, fmt.Errorf("%w: наценка %v даёт бесконечную цену", ErrInvalidPricing, markupPercent)
+	}
+	return price, nil
+}
+
+// priceWarnings предупреждает, если цена сильно ниже средней по типу продукции
+func priceWarnings(ctx context.Context, tx pgx.Tx, typeID int, minPrice float64) ([]string, error) {
+	warnings := []string{}
+
+	var avgPrice *float64
+	query := `SELECT AVG(min_price) FROM products WHERE type_id = $1 AND min_price > 0`
+	if err := tx.QueryRow(ctx, query, typeID).Scan(&avgPrice); err != nil {
+		return nil, fmt.Errorf("ошибка расчёта средней цены типа: %w", err)
+	}
+
+	if avgPrice != nil && minPrice < *avgPrice*lowPriceRatio {
+		warnings = append(warnings, fmt.Sprintf(
+			"минимальная цена %.2f более чем на %.0f%% ниже средней по типу (%.2f)",
+			minPrice, (1-lowPriceRatio)*100, *avgPrice))
+	}
+
+	return warnings, nil
+}
+
+// UpsertResult - итог пакетного upsert по артикулу
+type UpsertResult struct {
+	Created int   `json:"created"`
+	Updated int   `json:"updated"`
+	IDs     []int `json:"ids"` // id продуктов в порядке входных строк
+}
+
+// priceChangeGuard - защита пакетного импорта от опечатки, переписывающей все цены
+// (например, цены в рублях вместо копеек): если больше MaxShare обновлённых цен изменились
+// больше чем на MaxChange (доли: 0.2 = 20%), пакет откатывается
+type priceChangeGuard struct {
+	MaxShare  float64
+	MaxChange float64
+}
+
+// priceGuardMinRows - на меньшем числе сравнимых цен защита не срабатывает: доля
+// по двум-трём строкам ничего не говорит, а так правят цены вручную
+const priceGuardMinRows = 10
+
+// priceGuardExamples - сколько самых больших изменений показать в ошибке
+const priceGuardExamples = 10
+
+// PriceChange - цена продукта до и после импорта
+type PriceChange struct {
+	Article  string  `json:"article"`
+	OldPrice float64 `json:"old_price"`
+	NewPrice float64 `json:"new_price"`
+}
+
+// PriceGuardError - импорт изменил слишком много цен слишком сильно и был откачен
+type PriceGuardError struct {
+	Compared int           `json:"compared"` // обновлённых продуктов с ценой до импорта
+	Changed  int           `json:"changed"`  // из них изменились больше допустимого
+	Examples []PriceChange `json:"examples"` // самые большие изменения
+}
+
+func (e *PriceGuardError) Error() string {
+	return fmt.Sprintf("цены %d из %d обновлённых продуктов изменились слишком сильно", e.Changed, e.Compared)
+}
+
+// check сравнивает цены до и после. Продукты без цены до импорта не учитываются:
+// изменение от нуля в процентах не считается
+func (g *priceChangeGuard) check(changes []PriceChange) error {
+	var big []PriceChange
+	compared := 0
+	for _, ch := range changes {
+		if ch.OldPrice <= 0 {
+			continue
+		}
+		compared++
+		if math.Abs(ch.NewPrice-ch.OldPrice)/ch.OldPrice > g.MaxChange {
+			big = append(big, ch)
+		}
+	}
+	if compared < priceGuardMinRows || float64(len(big)) <= float64(compared)*g.MaxShare {
+		return nil
+	}
+
+	relative := func(ch PriceChange) float64 { return math.Abs(ch.NewPrice-ch.OldPrice) / ch.OldPrice }
+	sort.Slice(big, func(i, j int) bool { return relative(big[i]) > relative(big[j]) })
+	return &PriceGuardError{
+		Compared: compared,
+		Changed:  len(big),
+		Examples: big[:min(len(big), priceGuardExamples)],
+	}
+}
+
+// UpsertProducts создаёт или обновляет продукты по артикулу одной транзакцией.
+// Строки с пустым артикулом всегда вставляются (артикул генерируется).
+// Любая ошибка откатывает весь пакет. С guard (nil - без проверки) цены обновлённых продуктов
+// сравниваются с прежними до коммита, и при срабатывании возвращается *PriceGuardError
+func UpsertProducts(ctx context.Context, pool *pgxpool.Pool, inputs []CreateProductInput, guard *priceChangeGuard, articlePattern *regexp.Regexp) (*UpsertResult, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Прежние цены по артикулам пакета. Строки блокируются: цена не должна поменяться
+	// между чтением и сравнением
+	var oldPrices map[string]float64
+	var priceChanges []PriceChange
+	if guard != nil {
+		articles := make([]string, 0, len(inputs))
+		for _, input := range inputs {
+			if article := normalizeArticle(input.Article); article != "" {
+				articles = append(articles, article)
+			}
+		}
+		rows, err := tx.Query(ctx, `
+			SELECT UPPER(article), COALESCE(min_price, 0)::float8
+			FROM products
+			WHERE UPPER(article) = ANY($1) AND article IS NOT NULL AND article <> ''
+			ORDER BY id
+			FOR UPDATE
+		`, articles)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения прежних цен: %w", err)
+		}
+		oldPrices = make(map[string]float64)
+		for rows.Next() {
+			var article string
+			var price float64
+			if err := rows.Scan(&article, &price); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("ошибка чтения прежних цен: %w", err)
+			}
+			oldPrices[article] = price
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("ошибка чтения прежних цен: %w", err)
+		}
+	}
+
+	// xmax = 0 только у только что вставленной строки - так отличаем insert от update
+	query := `
+		INSERT INTO products (product_name, material_id, type_id, min_price, article, image_url)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''))
+		ON CONFLICT ((UPPER(article))) WHERE article IS NOT NULL AND article <> '' DO UPDATE SET
+			product_name = EXCLUDED.product_name,
+			material_id = EXCLUDED.material_id,
+			type_id = EXCLUDED.type_id,
+			min_price = EXCLUDED.min_price,
+			image_url = EXCLUDED.image_url,
+			article = EXCLUDED.article -- старые записи в другом регистре приводятся к нормальному виду
+		RETURNING id, (xmax = 0) AS inserted, COALESCE(min_price, 0)::float8
+	`
+
+	result := &UpsertResult{IDs: make([]int, 0, len(inputs))}
+	for i, input := range inputs {
+		article := normalizeArticle(input.Article)
+		if article == "" {
+			created, err := insertProduct(ctx, tx, input, articlePattern)
+			if err != nil {
+				return nil, fmt.Errorf("строка %d: %w", i+1, err)
+			}
+			result.Created++
+			result.IDs = append(result.IDs, created.ProductID)
+			continue
+		}
+
+		if err := resolveProductRefs(ctx, tx, &input); err != nil {
+			return nil, fmt.Errorf("строка %d (артикул %s): %w", i+1, article, err)
+		}
+		minPrice, err := inputMinPrice(ctx, tx, input)
+		if err != nil {
+			return nil, fmt.Errorf("строка %d (артикул %s): %w", i+1, article, err)
+		}
+
+		var id int
+		var inserted bool
+		var newPrice float64
+		err = tx.QueryRow(ctx, query,
+			input.ProductName,
+			input.MaterialID,
+			input.TypeID,
+			minPrice,
+			article,
+			strings.TrimSpace(input.ImageURL),
+		).Scan(&id, &inserted, &newPrice)
+		if uniqueErr := productUniqueViolation(err, article, input); uniqueErr != nil {
+			return nil, fmt.Errorf("строка %d (артикул %s): %w", i+1, article, uniqueErr)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("строка %d (артикул %s): %w", i+1, article, err)
+		}
+
+		if inserted {
+			result.Created++
+		} else {
+			result.Updated++
+			if oldPrice, ok := oldPrices[article]; ok {
+				priceChanges = append(priceChanges, PriceChange{Article: article, OldPrice: oldPrice, NewPrice: newPrice})
+			}
+		}
+		if oldPrices != nil {
+			// Повтор артикула в пакете сравнивается с ценой, записанной первой строкой
+			oldPrices[article] = newPrice
+		}
+		result.IDs = append(result.IDs, id)
+	}
+
+	if guard != nil {
+		if err := guard.check(priceChanges); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("ошибка коммита транзакции: %w", err)
+	}
+
+	return result, nil
+}
+
+// articlePrefix строит префикс артикула из названия типа: первые 3 буквы в верхнем регистре
+func articlePrefix(typeName string) string {
+	var prefix []rune
+	for _, r := range typeName {
+		if unicode.IsLetter(r) {
+			prefix = append(prefix, unicode.ToUpper(r))
+			if len(prefix) == 3 {
+				break
+			}
+		}
+	}
+	if len(prefix) == 0 {
+		return "PRD"
+	}
+	return string(prefix)
+}
+
+// articleLockClass - первый ключ pg_advisory_xact_lock(int, int) для нумерации артикулов,
+// второй - hashtext(префикс). Отдельный класс не пересекается с другими advisory-блокировками
+const articleLockClass = 1001
+
+// generateArticle генерирует следующий артикул для типа вида "TBL-000123".
+// Нумерация общая для префикса, а не для типа: «Стол письменный» и «Столик» оба дают СТО.
+// Поэтому очередь строится транзакционной advisory-блокировкой на префикс, а не блокировкой
+// строки типа: параллельные создания с одним префиксом ждут друг друга до COMMIT и не
+// получают одинаковый номер, остальные записи в products_types и products не блокируются
+func generateArticle(ctx context.Context, tx pgx.Tx, typeID int) (string, error) {
+	var typeName string
+	err := tx.QueryRow(ctx, `SELECT type_name FROM products_types WHERE id = $1`, typeID).Scan(&typeName)
+	if err == pgx.ErrNoRows {
+		return "", fmt.Errorf("тип продукции с id %d не найден", typeID)
+	}
+	if err != nil {
+		return "", fmt.Errorf("ошибка получения типа продукции: %w", err)
+	}
+
+	prefix := articlePrefix(typeName)
+
+	// Блокировка снимается только с транзакцией, то есть после вставки продукта с этим номером.
+	// В READ COMMITTED следующий запрос берёт новый снимок и видит номер, занятый предыдущим
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1, hashtext($2))`, articleLockClass, prefix); err != nil {
+		return "", fmt.Errorf("ошибка блокировки нумерации артикулов %s: %w", prefix, err)
+	}
+
+	// Префикс состоит только из букв, поэтому его можно подставить в регулярку
+	query := `
+		SELECT COALESCE(MAX(substring(article FROM '[0-9]+$')::int), 0)
+		FROM products
+		WHERE article ~ $1
+	`
+	var lastNumber int
+	if err := tx.QueryRow(ctx, query, "^"+prefix+"-[0-9]+$").Scan(&lastNumber); err != nil {
+		return "", fmt.Errorf("ошибка поиска последнего артикула: %w", err)
+	}
+
+	return fmt.Sprintf("%s-%06d", prefix, lastNumber+1), nil
+}
+
+// parseArticleNumber разбирает артикул формата generateArticle ("TBL-000123"): префикс из букв,
+// дефис и номер. ok=false - артикул задан вручную в другом формате
+func parseArticleNumber(article string) (prefix string, number int, ok bool) {
+	prefix, digits, found := strings.Cut(normalizeArticle(article), "-")
+	if !found || prefix == "" || digits == "" {
+		return "", 0, false
+	}
+	for _, r := range prefix {
+		if !unicode.IsLetter(r) {
+			return "", 0, false
+		}
+	}
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return "", 0, false
+		}
+	}
+	number, err := strconv.Atoi(digits)
+	if err != nil || number <= 0 {
+		return "", 0, false
+	}
+	return prefix, number, true
+}
+
+// ArticleGap - непрерывный диапазон свободных номеров, границы включительно
+type ArticleGap struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+// ArticlePrefixGaps - пропуски в нумерации одного префикса: номера от 1 до Max, которых нет
+type ArticlePrefixGaps struct {
+	Prefix       string       `json:"prefix"`
+	Used         int          `json:"used"` // сколько разных номеров занято
+	Max          int          `json:"max"`
+	MissingCount int          `json:"missing_count"`
+	Gaps         []ArticleGap `json:"gaps"`
+}
+
+// ArticleGapsReport - пропуски по всем префиксам; Unparsed - артикулы не в формате generateArticle
+type ArticleGapsReport struct {
+	Prefixes []ArticlePrefixGaps `json:"prefixes"`
+	Unparsed int                 `json:"unparsed"`
+}
+
+// FindArticleGaps ищет свободные номера в автоматических артикулах. Нумерация generateArticle
+// идёт от MAX+1, поэтому номера удалённых продуктов сами не переиспользуются
+func FindArticleGaps(ctx context.Context, pool *pgxpool.Pool) (*ArticleGapsReport, error) {
+	rows, err := pool.Query(ctx, `SELECT article FROM products WHERE article IS NOT NULL AND article <> ''`)
+	if err != nil {
+		return nil, err
+	}
+	articles, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ArticleGapsReport{Prefixes: []ArticlePrefixGaps{}}
+	numbers := map[string][]int{}
+	for _, article := range articles {
+		prefix, number, ok := parseArticleNumber(article)
+		if !ok {
+			report.Unparsed++
+			continue
+		}
+		numbers[prefix] = append(numbers[prefix], number)
+	}
+
+	for prefix, used := range numbers {
+		sort.Ints(used)
+		gaps := ArticlePrefixGaps{Prefix: prefix, Gaps: []ArticleGap{}}
+		next := 1 // первый номер, который ещё не встретился
+		for _, n := range used {
+			if n == next-1 {
+				continue // дубль номера (например, разный регистр в старых данных)
+			}
+			gaps.Used++
+			if n > next {
+				gaps.Gaps = append(gaps.Gaps, ArticleGap{From: next, To: n - 1})
+				gaps.MissingCount += n - next
+			}
+			next = n + 1
+		}
+		gaps.Max = next - 1
+		report.Prefixes = append(report.Prefixes, gaps)
+	}
+	sort.Slice(report.Prefixes, func(i, j int) bool { return report.Prefixes[i].Prefix < report.Prefixes[j].Prefix })
+
+	return report, nil
+}
+
+func GetAllWorkshops(ctx context.Context, pool *pgxpool.Pool) ([]Workshop, error) {
+	query := `SELECT id, name FROM workshops ORDER BY name`
+
+	return retryRead(ctx, func() ([]Workshop, error) {
+		rows, err := pool.Query(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		var workshops []Workshop
+		for rows.Next() {
+			var w Workshop
+			err := rows.Scan(&w.ID, &w.Name)
+			if err != nil {
+				return nil, err
+			}
+			workshops = append(workshops, w)
+		}
+
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+
+		return workshops, nil
+	})
+}
+
+// CreateProductWithWorkshops создаёт продукт И связи с цехами в одной транзакции
+func CreateProductWithWorkshops(ctx context.Context, pool *pgxpool.Pool, input CreateProductWithWorkshopsInput, articlePattern *regexp.Regexp) (*CreateProductResult, error) {
+	// Начинаем транзакцию
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback(ctx) // откатываем если что-то пойдёт не так
+
+	// Запрос 1: Создаём продукт
+	result, err := insertProduct(ctx, tx, CreateProductInput{
+		ProductName:   input.ProductName,
+		MaterialID:    input.MaterialID,
+		TypeID:        input.TypeID,
+		MinPrice:      input.MinPrice,
+		MarkupPercent: input.MarkupPercent,
+		Article:       input.Article,
+		ImageURL:      input.ImageURL,
+	}, articlePattern)
+	if err != nil {
+		return nil, err
+	}
+	productID := result.ProductID
+
+	// Запрос 2: Добавляем связи с цехами (если есть)
+	if err = insertWorkshopLinks(ctx, tx, productID, input.Workshops); err != nil {
+		return nil, err
+	}
+
+	// Запрос 3: Обновляем кешированное время производства. Сумма та же, что запишется
+	// в products, поэтому продукт для ответа собирается без повторного чтения
+	total, err := syncProductTotalTime(ctx, tx, productID)
+	if err != nil {
+		return nil, err
+	}
+	result.Product.TotalProductionTime = total
+
+	// Запрос 4: Маршрут для ответа - читаем записанное, а не пересказываем input:
+	// так видны нормализованный порядок шагов и названия цехов
+	rows, err := tx.Query(ctx, productRouteQuery, productID)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения маршрута: %w", err)
+	}
+	if result.Workshops, err = scanRoute(rows); err != nil {
+		return nil, fmt.Errorf("ошибка чтения маршрута: %w", err)
+	}
+
+	// Коммитим транзакцию
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("ошибка коммита транзакции: %w", err)
+	}
+
+	return result, nil
+}
+
+// NewProductTypeInput - новый тип продукции, создаваемый вместе с первым продуктом
+type NewProductTypeInput struct {
+	TypeName  string  `json:"type_name" binding:"required"`
+	TypeRatio float64 `json:"type_ratio" binding:"required,gt=0"`
+}
+
+// CreateProductWithNewTypeInput - продукт без type_id: тип создаётся в той же транзакции
+type CreateProductWithNewTypeInput struct {
+	Type          NewProductTypeInput `json:"type" binding:"required"`
+	ProductName   string              `json:"product_name" binding:"required"`
+	MaterialID    int                 `json:"material_id" binding:"required,gt=0"`
+	MinPrice      *float64            `json:"min_price"`
+	MarkupPercent *float64            `json:"markup_percent" binding:"omitempty,gte=0"`
+	Article       string              `json:"article"`
+	ImageURL      string              `json:"image_url" binding:"omitempty,http_url"`
+}
+
+// CreateProductWithNewTypeResult - id созданных типа и продукта
+type CreateProductWithNewTypeResult struct {
+	TypeID int
+	CreateProductResult
+}
+
+// ErrProductTypeExists - тип с таким названием уже есть
+var ErrProductTypeExists = errors.New("тип продукции с таким названием уже существует")
+
+// CreateProductWithNewType создаёт тип продукции и первый продукт этого типа одной транзакцией:
+// если продукт не создался, тип тоже откатывается и не остаётся пустым
+func CreateProductWithNewType(ctx context.Context, pool *pgxpool.Pool, input CreateProductWithNewTypeInput, articlePattern *regexp.Regexp) (*CreateProductWithNewTypeResult, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	typeName := strings.TrimSpace(input.Type.TypeName)
+
+	var exists bool
+	err = tx.QueryRow(ctx,
+		`SELECT EXISTS(SELECT 1 FROM products_types WHERE LOWER(type_name) = LOWER($1))`,
+		typeName,
+	).Scan(&exists)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка проверки типа продукции: %w", err)
+	}
+	if exists {
+		return nil, fmt.Errorf("%w: %s", ErrProductTypeExists, typeName)
+	}
+
+	var typeID int
+	err = tx.QueryRow(ctx,
+		`INSERT INTO products_types (type_name, type_ratio) VALUES ($1, $2) RETURNING id`,
+		typeName, input.Type.TypeRatio,
+	).Scan(&typeID)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания типа продукции: %w", err)
+	}
+
+	created, err := insertProduct(ctx, tx, CreateProductInput{
+		ProductName:   input.ProductName,
+		MaterialID:    input.MaterialID,
+		TypeID:        typeID,
+		MinPrice:      input.MinPrice,
+		MarkupPercent: input.MarkupPercent,
+		Article:       input.Article,
+		ImageURL:      input.ImageURL,
+	}, articlePattern)
+	if err != nil {
+		return nil, err
+	}
+
+	// Другие экземпляры сбросят кеш типов после COMMIT
+	if err = notifyReferenceChanged(ctx, tx, "types"); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("ошибка коммита транзакции: %w", err)
+	}
+
+	return &CreateProductWithNewTypeResult{TypeID: typeID, CreateProductResult: *created}, nil
+}
+
+// syncProductTotalTime пересчитывает products.total_production_time для одного продукта
+// и возвращает новое значение. Вызывается внутри транзакции после любого изменения products_workshop.
+//
+// Пересчёт идёт в той же транзакции под lockProduct: ручки возвращают новое суммарное время,
+// и следующее чтение не должно видеть старое. Правки маршрута существующего продукта могут
+// откладывать запись окном TOTAL_RECOMPUTE_WINDOW, см. totalRecomputer.
+// Повторную запись убирает условие IS DISTINCT FROM: если сумма не изменилась (то же время
+// прислали ещё раз, поменяли порядок), строка не обновляется и updated_at не сдвигается
+func syncProductTotalTime(ctx context.Context, tx pgx.Tx, productID int) (float64, error) {
+	query := `
+		WITH t AS (
+			SELECT COALESCE(SUM(production_time), 0) AS total
+			FROM products_workshop
+			WHERE product_id = $1
+		), updated AS (
+			UPDATE products p
+			SET total_production_time = t.total
+			FROM t
+			WHERE p.id = $1 AND p.total_production_time IS DISTINCT FROM t.total
+		)
+		SELECT total FROM t
+	`
+	var total float64
+	if err := tx.QueryRow(ctx, query, productID).Scan(&total); err != nil {
+		return 0, fmt.Errorf("ошибка пересчёта времени производства: %w", err)
+	}
+	return total, nil
+}
+
+// totalRecomputer откладывает запись total_production_time при правках маршрута и пишет её
+// пачкой раз в window: серия правок одного продукта за окно (ползунок времени в интерфейсе
+// шлёт PATCH на каждое движение) даёт один UPDATE вместо десятка, а продукты из разных
+// запросов пересчитываются одним запросом. pending - множество id, повтор не копится.
+//
+// Ответ ручки не устаревает: сумму для него считает SELECT в транзакции правки, откладывается
+// только запись в products. Списки и отчёты видят прежнее время не дольше window.
+// id добавляется после COMMIT правки, поэтому пересчёт, прочитавший маршрут до чужого COMMIT,
+// догоняется следующим сбросом. nil - пересчёт в транзакции правки, как без окна
+type totalRecomputer struct {
+	pool    *pgxpool.Pool
+	window  time.Duration
+	mu      sync.Mutex
+	pending map[int]struct{}
+	wake    chan struct{}
+	flushMu sync.Mutex // сброс из run и последний сброс при остановке не идут одновременно
+}
+
+// newTotalRecomputer - window <= 0 выключает отложенный пересчёт (nil)
+func newTotalRecomputer(pool *pgxpool.Pool, window time.Duration) *totalRecomputer {
+	if window <= 0 {
+		return nil
+	}
+	return &totalRecomputer{
+		pool:    pool,
+		window:  window,
+		pending: make(map[int]struct{}),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// sync возвращает новое суммарное время продукта внутри транзакции правки. Без окна
+// сразу пишет его в products (syncProductTotalTime), с окном только считает
+func (r *totalRecomputer) sync(ctx context.Context, tx pgx.Tx, productID int) (float64, error) {
+	if r == nil {
+		return syncProductTotalTime(ctx, tx, productID)
+	}
+	var total float64
+	err := tx.QueryRow(ctx, `
+		SELECT COALESCE(SUM(production_time), 0)::float8 FROM products_workshop WHERE product_id = $1
+	`, productID).Scan(&total)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка расчёта времени производства: %w", err)
+	}
+	return total, nil
+}
+
+// schedule ставит продукты в очередь пересчёта. Вызывается после COMMIT правки
+func (r *totalRecomputer) schedule(productIDs ...int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	for _, id := range productIDs {
+		r.pending[id] = struct{}{}
+	}
+	r.mu.Unlock()
+
+	select {
+	case r.wake <- struct{}{}:
+	default: // сброс уже запланирован
+	}
+}
+
+// run ждёт первую правку, копит остальные window и сбрасывает, пока не отменён ctx.
+// Правки, пришедшие после отмены, сбрасывает flush при остановке
+func (r *totalRecomputer) run(ctx context.Context) {
+	if r == nil {
+		return
+	}
+	timer := time.NewTimer(r.window)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.wake:
+		}
+		timer.Reset(r.window)
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		if err := r.flush(ctx); err != nil {
+			log.Printf("Ошибка отложенного пересчёта времени производства: %v", err)
+		}
+	}
+}
+
+// flush пересчитывает время всех накопленных продуктов одним UPDATE. При ошибке id
+// возвращаются в очередь и пересчитаются следующим сбросом
+func (r *totalRecomputer) flush(ctx context.Context) error {
+	if r == nil {
+		return nil
+	}
+	r.flushMu.Lock()
+	defer r.flushMu.Unlock()
+
+	r.mu.Lock()
+	ids := make([]int, 0, len(r.pending))
+	for id := range r.pending {
+		ids = append(ids, id)
+	}
+	r.pending = make(map[int]struct{})
+	r.mu.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	_, err := r.pool.Exec(ctx, `
+		UPDATE products p
+		SET total_production_time = t.total
+		FROM (
+			SELECT ids.id, COALESCE(SUM(pw.production_time), 0) AS total
+			FROM unnest($1::int[]) AS ids(id)
+			LEFT JOIN products_workshop pw ON pw.product_id = ids.id
+			GROUP BY ids.id
+		) t
+		WHERE p.id = t.id AND p.total_production_time IS DISTINCT FROM t.total
+	`, ids)
+	if err != nil {
+		r.schedule(ids...)
+		return fmt.Errorf("пересчёт %d продуктов: %w", len(ids), err)
+	}
+	return nil
+}
+
+// ErrMaterialNotFound - материала с переданным id нет
+var ErrMaterialNotFound = errors.New("материал не найден")
+
+// ErrPriceBelowCost - min_price продукта ниже себестоимости его материала
+var ErrPriceBelowCost = errors.New("цена ниже себестоимости материала")
+
+// SetProductMaterial меняет материал продукта. С checkCost цена продукта сверяется с
+// себестоимостью нового материала в той же транзакции: строка продукта заблокирована,
+// поэтому цену между проверкой и сменой материала никто не изменит. Продукт без цены
+// (0 или NULL) и материал без себестоимости не проверяются
+func SetProductMaterial(ctx context.Context, pool *pgxpool.Pool, productID, materialID int, checkCost bool) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var minPrice *float64
+	err = tx.QueryRow(ctx, `SELECT min_price FROM products WHERE id = $1 FOR UPDATE`, productID).Scan(&minPrice)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrProductNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("ошибка блокировки продукта: %w", err)
+	}
+
+	var materialName string
+	var cost *float64
+	err = tx.QueryRow(ctx, `SELECT material_name, cost FROM materials WHERE id = $1`, materialID).Scan(&materialName, &cost)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("%w: %d", ErrMaterialNotFound, materialID)
+	}
+	if err != nil {
+		return fmt.Errorf("ошибка получения материала %d: %w", materialID, err)
+	}
+
+	if checkCost && minPrice != nil && *minPrice > 0 && cost != nil && *minPrice < *cost {
+		return fmt.Errorf("%w: цена %.2f, себестоимость материала «%s» %.2f",
+			ErrPriceBelowCost, *minPrice, materialName, *cost)
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE products SET material_id = $2 WHERE id = $1`, productID, materialID); err != nil {
+		return fmt.Errorf("ошибка изменения материала продукта: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("ошибка подтверждения транзакции: %w", err)
+	}
+	return nil
+}
+
+// SetProductActive включает или скрывает продукт из каталога без удаления
+func SetProductActive(ctx context.Context, pool *pgxpool.Pool, productID int, active bool) error {
+	result, err := pool.Exec(ctx, `UPDATE products SET is_active = $2 WHERE id = $1`, productID, active)
+	if err != nil {
+		return fmt.Errorf("ошибка изменения активности продукта: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrProductNotFound
+	}
+	return nil
+}
+
+// SwapProductArticles меняет местами артикулы двух продуктов в одной транзакции.
+// idx_products_article не откладываемый, поэтому артикул первого сначала обнуляется
+// (NULL под индекс не попадает), второй получает его артикул, затем первый - бывший
+// артикул второго. Строки блокируются по возрастанию id, чтобы встречный обмен не дал deadlock
+func SwapProductArticles(ctx context.Context, pool *pgxpool.Pool, firstID, secondID int) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx,
+		`SELECT id, article FROM products WHERE id = ANY($1) ORDER BY id FOR UPDATE`,
+		[]int{firstID, secondID},
+	)
+	if err != nil {
+		return fmt.Errorf("ошибка блокировки продуктов: %w", err)
+	}
+	articles := make(map[int]*string, 2)
+	for rows.Next() {
+		var id int
+		var article *string
+		if err := rows.Scan(&id, &article); err != nil {
+			rows.Close()
+			return fmt.Errorf("ошибка чтения артикулов: %w", err)
+		}
+		articles[id] = article
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("ошибка чтения артикулов: %w", err)
+	}
+	for _, id := range []int{firstID, secondID} {
+		if _, ok := articles[id]; !ok {
+			return fmt.Errorf("%w: %d", ErrProductNotFound, id)
+		}
+	}
+
+	steps := []struct {
+		id      int
+		article *string
+	}{
+		{firstID, nil},
+		{secondID, articles[firstID]},
+		{firstID, articles[secondID]},
+	}
+	for _, step := range steps {
+		if _, err := tx.Exec(ctx, `UPDATE products SET article = $2 WHERE id = $1`, step.id, step.article); err != nil {
+			return fmt.Errorf("ошибка изменения артикула продукта %d: %w", step.id, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("ошибка подтверждения транзакции: %w", err)
+	}
+	return nil
+}
+
+// lockProduct блокирует строку продукта до конца транзакции.
+// Возвращает ErrProductNotFound, если продукта нет
+func lockProduct(ctx context.Context, tx pgx.Tx, productID int) error {
+	var id int
+	err := tx.QueryRow(ctx, `SELECT id FROM products WHERE id = $1 FOR UPDATE`, productID).Scan(&id)
+	if err == pgx.ErrNoRows {
+		return ErrProductNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("ошибка блокировки продукта: %w", err)
+	}
+	return nil
+}
+
+// ScaleProductionTimes умножает время всех цехов продукта на factor одним UPDATE
+// и возвращает новое суммарное время производства
+func ScaleProductionTimes(ctx context.Context, pool *pgxpool.Pool, productID int, factor float64, totals *totalRecomputer) (float64, error) {
+	if factor <= 0 {
+		return 0, fmt.Errorf("коэффициент должен быть положительным")
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err = lockProduct(ctx, tx, productID); err != nil {
+		return 0, err
+	}
+
+	query := `
+		UPDATE products_workshop
+		SET production_time = production_time * $2
+		WHERE product_id = $1
+	`
+	if _, err = tx.Exec(ctx, query, productID, factor); err != nil {
+		return 0, fmt.Errorf("ошибка масштабирования времени: %w", err)
+	}
+
+	total, err := totals.sync(ctx, tx, productID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("ошибка коммита транзакции: %w", err)
+	}
+	totals.schedule(productID)
+
+	return total, nil
+}
+
+// RecomputeProductionTimes пересчитывает кешированное время производства у всех продуктов
+// одним UPDATE...FROM и возвращает количество исправленных строк: совпадающие с суммой не переписываются
+func RecomputeProductionTimes(ctx context.Context, pool *pgxpool.Pool) (int64, error) {
+	query := `
+		UPDATE products p
+		SET total_production_time = t.total
+		FROM (
+			SELECT p2.id, COALESCE(SUM(pw.production_time), 0) AS total
+			FROM products p2
+			LEFT JOIN products_workshop pw ON pw.product_id = p2.id
+			GROUP BY p2.id
+		) t
+		WHERE t.id = p.id AND p.total_production_time IS DISTINCT FROM t.total
+	`
+	result, err := pool.Exec(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка пересчёта времени производства: %w", err)
+	}
+	return result.RowsAffected(), nil
+}
+
+// DeleteById удаляет продукт и его связи с цехами одной транзакцией и пишет удаление
+// в product_deletions от имени actor. Возвращает число удалённых связей; ErrProductNotFound, если продукта нет
+func DeleteById(ctx context.Context, pool *pgxpool.Pool, product_id int, actor string) (int64, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Блокировка не даёт параллельно добавить цех между двумя DELETE
+	if err = lockProduct(ctx, tx, product_id); err != nil {
+		return 0, err
+	}
+
+	// Связи удаляем явно, не полагаясь на ON DELETE CASCADE в схеме
+	links, err := tx.Exec(ctx, `DELETE FROM products_workshop WHERE product_id = $1`, product_id)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка удаления цехов продукта: %w", err)
+	}
+
+	if err = recordDeletions(ctx, tx, []int{product_id}, actor); err != nil {
+		return 0, err
+	}
+	if _, err = tx.Exec(ctx, `DELETE FROM products WHERE id = $1`, product_id); err != nil {
+		return 0, fmt.Errorf("ошибка удаления: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("ошибка коммита транзакции: %w", err)
+	}
+
+	return links.RowsAffected(), nil
+}
+
+// recordDeletions пишет удаляемые продукты в журнал product_deletions. Вызывается в той же
+// транзакции до DELETE: запись в журнале есть тогда и только тогда, когда удаление прошло.
+// Пустой actor - неизвестно кто (NULL)
+func recordDeletions(ctx context.Context, tx pgx.Tx, ids []int, actor string) error {
+	query := `
+		INSERT INTO product_deletions (product_id, product_name, article, deleted_by)
+		SELECT id, product_name, article, NULLIF($2, '')
+		FROM products
+		WHERE id = ANY($1)
+	`
+	if _, err := tx.Exec(ctx, query, ids, actor); err != nil {
+		return fmt.Errorf("ошибка записи в журнал удалений: %w", err)
+	}
+	return nil
+}
+
+// ProductDeletion - запись журнала удалений
+type ProductDeletion struct {
+	ProductID   int       `json:"product_id"`
+	ProductName string    `json:"product_name"`
+	Article     string    `json:"article"`
+	DeletedBy   *string   `json:"deleted_by"` // null - удаливший не представился (нет X-User)
+	DeletedAt   time.Time `json:"deleted_at"`
+}
+
+// GetRecentDeletions возвращает удаления, начиная с последних
+func GetRecentDeletions(ctx context.Context, pool *pgxpool.Pool, limit, offset int) ([]ProductDeletion, error) {
+	query := `
+		SELECT product_id, product_name, COALESCE(article, ''), deleted_by, deleted_at
+		FROM product_deletions
+		ORDER BY deleted_at DESC, id DESC
+		LIMIT $1 OFFSET $2
+	`
+
+	rows, err := pool.Query(ctx, query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deletions := []ProductDeletion{}
+	for rows.Next() {
+		var d ProductDeletion
+		if err := rows.Scan(&d.ProductID, &d.ProductName, &d.Article, &d.DeletedBy, &d.DeletedAt); err != nil {
+			return nil, err
+		}
+		deletions = append(deletions, d)
+	}
+
+	return deletions, rows.Err()
+}
+
+// PurgedProduct - неактивный продукт в архиве перед удалением: все поля строки и маршрут.
+// MaterialID и TypeID перекрывают скрытые поля ProductWithTime, чтобы попасть в JSON
+type PurgedProduct struct {
+	ProductWithTime
+	MaterialID int               `json:"material_id"`
+	TypeID     int               `json:"type_id"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+	Workshops  []ProductWorkshop `json:"workshops"`
+}
+
+// PurgeArchive - выгрузка удаляемых продуктов для хранения по требованиям комплаенса
+type PurgeArchive struct {
+	Cutoff   time.Time       `json:"cutoff"`
+	Products []PurgedProduct `json:"products"`
+	Links    int             `json:"links"` // всего связей с цехами
+}
+
+// PurgeInactiveProducts выбирает неактивные продукты, не менявшиеся с cutoff, вместе с цехами
+// и удаляет их одной транзакцией. Строки блокируются, поэтому продукт, который успели
+// активировать параллельно, либо не попадёт в выборку, либо дождётся конца удаления.
+// dryRun - только собрать архив, ничего не удаляя. Удаления пишутся в журнал от имени actor
+func PurgeInactiveProducts(ctx context.Context, pool *pgxpool.Pool, cutoff time.Time, dryRun bool, actor string) (*PurgeArchive, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		SELECT ` + productColumns + `,
+			p.created_at,
+			p.updated_at
+		` + productFrom + `
+		WHERE NOT p.is_active AND p.updated_at < $1
+		ORDER BY p.id
+		FOR UPDATE OF p
+	`
+
+	rows, err := tx.Query(ctx, query, cutoff)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка выборки продуктов: %w", err)
+	}
+
+	archive := &PurgeArchive{Cutoff: cutoff, Products: []PurgedProduct{}}
+	for rows.Next() {
+		var p PurgedProduct
+		err := rows.Scan(append(productScanDest(&p.ProductWithTime), &p.CreatedAt, &p.UpdatedAt)...)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		p.MaterialID, p.TypeID = p.ProductWithTime.MaterialID, p.ProductWithTime.TypeID
+		p.Workshops = []ProductWorkshop{}
+		archive.Products = append(archive.Products, p)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(archive.Products) == 0 {
+		return archive, nil
+	}
+
+	ids := make([]int, len(archive.Products))
+	byID := make(map[int]*PurgedProduct, len(archive.Products))
+	for i := range archive.Products {
+		ids[i] = archive.Products[i].ID
+		byID[ids[i]] = &archive.Products[i]
+	}
+
+	rows, err = tx.Query(ctx, `
+		SELECT pw.product_id, w.id, w.name, COALESCE(pw.production_time, 0), pw.step_order
+		FROM products_workshop pw
+		JOIN workshops w ON pw.workshop_id = w.id
+		WHERE pw.product_id = ANY($1)
+		ORDER BY pw.product_id, pw.step_order, w.name
+	`, ids)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка выборки цехов: %w", err)
+	}
+	for rows.Next() {
+		var productID int
+		var w ProductWorkshop
+		if err := rows.Scan(&productID, &w.WorkshopID, &w.WorkshopName, &w.ProductionTime, &w.StepOrder); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		byID[productID].Workshops = append(byID[productID].Workshops, w)
+		archive.Links++
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		return archive, nil
+	}
+
+	// Как и в DeleteById, связи удаляем явно
+	if _, err = tx.Exec(ctx, `DELETE FROM products_workshop WHERE product_id = ANY($1)`, ids); err != nil {
+		return nil, fmt.Errorf("ошибка удаления цехов продуктов: %w", err)
+	}
+	if err = recordDeletions(ctx, tx, ids, actor); err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec(ctx, `DELETE FROM products WHERE id = ANY($1)`, ids); err != nil {
+		return nil, fmt.Errorf("ошибка удаления продуктов: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("ошибка коммита транзакции: %w", err)
+	}
+
+	return archive, nil
+}
+
+// CalculateMaterialQuantity рассчитывает количество сырья для производства продукции
+// Параметры:
+//   - productTypeID: идентификатор типа продукции
+//   - materialTypeID: идентификатор типа материала
+//   - productQuantity: количество продукции (целое число)
+//   - param1, param2: параметры продукции (вещественные, положительные числа)
+//
+// Возвращает: количество сырья с учетом потерь (целое число)
+func CalculateMaterialQuantity(
+	ctx context.Context,
+	pool *pgxpool.Pool,
+	productTypeID int,
+	materialTypeID int,
+	productQuantity int,
+	param1, param2 float64,
+) (int, error) {
+	// Валидация входных параметров
+	if productQuantity <= 0 {
+		return 0, fmt.Errorf("количество продукции должно быть положительным")
+	}
+	if param1 <= 0 || param2 <= 0 {
+		return 0, fmt.Errorf("параметры продукции должны быть положительными")
+	}
+
+	// Получаем коэффициент типа продукции (type_ratio из products_types)
+	// Используем указатель для обработки NULL значений
+	var productTypeCoefficientPtr *float64
+	query1 := `SELECT type_ratio FROM products_types WHERE id = $1`
+	err := pool.QueryRow(ctx, query1, productTypeID).Scan(&productTypeCoefficientPtr)
+	if err == pgx.ErrNoRows {
+		return 0, fmt.Errorf("тип продукции с id %d не найден", productTypeID)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения коэффициента типа продукции: %w", err)
+	}
+
+	// Если type_ratio NULL, возвращаем ошибку (коэффициент обязателен для расчета)
+	if productTypeCoefficientPtr == nil {
+		return 0, fmt.Errorf("коэффициент типа продукции (type_ratio) не установлен для типа с id %d", productTypeID)
+	}
+	productTypeCoefficient := *productTypeCoefficientPtr
+
+	// Получаем процент потерь материала (wasting_percentage из materials)
+	// Используем указатель для обработки NULL значений
+	var lossPercentagePtr *float64
+	query2 := `SELECT wasting_percentage FROM materials WHERE id = $1`
+	err = pool.QueryRow(ctx, query2, materialTypeID).Scan(&lossPercentagePtr)
+	if err == pgx.ErrNoRows {
+		return 0, fmt.Errorf("материал с id %d не найден", materialTypeID)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения процента потерь материала: %w", err)
+	}
+
+	// Если wasting_percentage NULL, используем 0
+	var lossPercentage float64
+	if lossPercentagePtr != nil {
+		lossPercentage = *lossPercentagePtr
+	}
+
+	// Расчет количества сырья на одну единицу продукции
+	materialPerUnit := param1 * param2 * productTypeCoefficient
+
+	// Расчет количества сырья на все единицы продукции
+	totalMaterial := materialPerUnit * float64(productQuantity)
+
+	// Учет потерь: увеличиваем количество с учетом процента потерь
+	// Формула: количество_с_потерями = количество * (1 + процент_потерь / 100)
+	materialWithLosses := totalMaterial * (1.0 + lossPercentage/100.0)
+
+	// Округляем до целого числа вверх (ceil)
+	materialQuantity := int(materialWithLosses)
+	if float64(materialQuantity) < materialWithLosses {
+		materialQuantity++
+	}
+
+	return materialQuantity, nil
+}
+
+// ProductStats - сводная статистика по каталогу
+type ProductStats struct {
+	ProductCount        int     `json:"product_count"`
+	AvgMinPrice         float64 `json:"avg_min_price"`
+	TotalProductionTime float64 `json:"total_production_time"`
+	MaterialCount       int     `json:"material_count"`
+	TypeCount           int     `json:"type_count"`
+	WorkshopCount       int     `json:"workshop_count"`
+	WorkshopLinkCount   int     `json:"workshop_link_count"`
+}
+
+// withReadSnapshot выполняет fn в read-only транзакции REPEATABLE READ,
+// чтобы все агрегаты внутри видели один и тот же снимок данных
+func withReadSnapshot(ctx context.Context, pool *pgxpool.Pool, fn func(tx pgx.Tx) error) error {
+	tx, err := pool.BeginTx(ctx, pgx.TxOptions{
+		IsoLevel:   pgx.RepeatableRead,
+		AccessMode: pgx.ReadOnly,
+	})
+	if err != nil {
+		return fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// GetProductStats собирает статистику по каталогу в одном снимке БД
+func GetProductStats(ctx context.Context, pool *pgxpool.Pool) (*ProductStats, error) {
+	var stats ProductStats
+
+	err := withReadSnapshot(ctx, pool, func(tx pgx.Tx) error {
+		query1 := `
+			SELECT
+				COUNT(*),
+				COALESCE(AVG(min_price), 0),
+				COALESCE(SUM(total_production_time), 0)
+			FROM products
+		`
+		err := tx.QueryRow(ctx, query1).Scan(
+			&stats.ProductCount,
+			&stats.AvgMinPrice,
+			&stats.TotalProductionTime,
+		)
+		if err != nil {
+			return fmt.Errorf("ошибка агрегации продуктов: %w", err)
+		}
+
+		query2 := `
+			SELECT
+				(SELECT COUNT(*) FROM materials),
+				(SELECT COUNT(*) FROM products_types),
+				(SELECT COUNT(*) FROM workshops),
+				(SELECT COUNT(*) FROM products_workshop)
+		`
+		err = tx.QueryRow(ctx, query2).Scan(
+			&stats.MaterialCount,
+			&stats.TypeCount,
+			&stats.WorkshopCount,
+			&stats.WorkshopLinkCount,
+		)
+		if err != nil {
+			return fmt.Errorf("ошибка подсчёта справочников: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
+
+// TypeTimeStats - время производства по типу продукции
+type TypeTimeStats struct {
+	TypeID       int      `json:"type_id"`
+	TypeName     string   `json:"type_name"`
+	ProductCount int      `json:"product_count"`
+	TotalTime    float64  `json:"total_time"`
+	AvgTime      float64  `json:"avg_time"`  // среднее суммарное время на один продукт
+	AvgPrice     *float64 `json:"avg_price"` // без нулевых и пустых цен; nil - цен нет
+}
+
+// GetTimeByType считает суммарное и среднее (на продукт) время производства и среднюю
+// цену по типам, сортировка по суммарному времени по убыванию. Время цехов сначала
+// суммируется по продукту: при соединении с каждым цехом средняя цена считалась бы
+// с весом по числу цехов
+func GetTimeByType(ctx context.Context, pool *pgxpool.Pool) ([]TypeTimeStats, error) {
+	query := `
+		SELECT
+			pt.id,
+			pt.type_name,
+			COUNT(p.id) AS product_count,
+			COALESCE(SUM(pw.total), 0) AS total_time,
+			COALESCE(SUM(pw.total) / NULLIF(COUNT(p.id), 0), 0) AS avg_time,
+			AVG(NULLIF(p.min_price, 0)) AS avg_price
+		FROM products_types pt
+		LEFT JOIN products p ON p.type_id = pt.id
+		LEFT JOIN (
+			SELECT product_id, SUM(production_time) AS total
+			FROM products_workshop
+			GROUP BY product_id
+		) pw ON pw.product_id = p.id
+		GROUP BY pt.id, pt.type_name
+		ORDER BY total_time DESC, pt.id
+	`
+
+	rows, err := pool.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []TypeTimeStats{}
+	for rows.Next() {
+		var t TypeTimeStats
+		if err := rows.Scan(&t.TypeID, &t.TypeName, &t.ProductCount, &t.TotalTime, &t.AvgTime, &t.AvgPrice); err != nil {
+			return nil, err
+		}
+		stats = append(stats, t)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// CatalogTypeNode - тип продукции в дереве каталога с продуктами этого типа.
+// parent_id - для вложенных типов: дерево типов собирает клиент, продукты уже разложены
+type CatalogTypeNode struct {
+	ID           int               `json:"id"`
+	Name         string            `json:"name"`
+	ParentID     *int              `json:"parent_id"`
+	ProductCount int               `json:"product_count"`
+	Children     []ProductWithTime `json:"children"` // у типа без продуктов - пустой массив
+}
+
+// GetCatalogTree возвращает все типы по названию, в каждом - его продукты по названию.
+// Типы и продукты читаются в одном снимке, чтобы product_count сходился с children.
+// Продуктов больше maxRows (0 - без потолка) - ErrResponseTooLarge
+func GetCatalogTree(ctx context.Context, pool *pgxpool.Pool, maxRows int) ([]CatalogTypeNode, error) {
+	var nodes []CatalogTypeNode
+	err := withReadSnapshot(ctx, pool, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `SELECT id, type_name, parent_id FROM products_types ORDER BY type_name, id`)
+		if err != nil {
+			return fmt.Errorf("ошибка получения типов: %w", err)
+		}
+		nodes, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (CatalogTypeNode, error) {
+			node := CatalogTypeNode{Children: []ProductWithTime{}}
+			err := row.Scan(&node.ID, &node.Name, &node.ParentID)
+			return node, err
+		})
+		if err != nil {
+			return fmt.Errorf("ошибка получения типов: %w", err)
+		}
+
+		byType := make(map[int]*CatalogTypeNode, len(nodes))
+		for i := range nodes {
+			byType[nodes[i].ID] = &nodes[i]
+		}
+
+		// LIMIT NULL - без ограничения
+		var limit *int
+		if maxRows > 0 {
+			limit = new(int)
+			*limit = maxRows + 1
+		}
+		rows, err = tx.Query(ctx, productSelect+`
+			ORDER BY p.product_name, p.id
+			LIMIT $1
+		`, limit)
+		if err != nil {
+			return fmt.Errorf("ошибка получения продуктов: %w", err)
+		}
+		products, err := scanProducts(rows)
+		if err != nil {
+			return fmt.Errorf("ошибка получения продуктов: %w", err)
+		}
+		if maxRows > 0 && len(products) > maxRows {
+			return errTooManyRows(maxRows)
+		}
+		for _, p := range products {
+			// JOIN products_types в productSelect гарантирует, что тип есть среди узлов
+			node := byType[p.TypeID]
+			node.Children = append(node.Children, p)
+			node.ProductCount++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// MaterialStats - продукты одного материала
+type MaterialStats struct {
+	MaterialID   int      `json:"material_id"`
+	MaterialName string   `json:"material_name"`
+	ProductCount int      `json:"product_count"`
+	AvgPrice     *float64 `json:"avg_price"` // nil - ни у одного продукта нет цены
+	TotalTime    float64  `json:"total_time"`
+}
+
+// GetMaterialStats считает по материалам число продуктов, среднюю цену и суммарное время,
+// больше всего продуктов - первыми. Время берётся из кешированного total_production_time,
+// а не из products_workshop: соединение с цехами размножило бы строки продуктов в AVG.
+// Материалы без продуктов тоже попадают в отчёт (с нулями), если влезают в limit
+func GetMaterialStats(ctx context.Context, pool *pgxpool.Pool, limit int) ([]MaterialStats, error) {
+	query := `
+		SELECT
+			m.id,
+			m.material_name,
+			COUNT(p.id) AS product_count,
+			AVG(NULLIF(p.min_price, 0))::float8 AS avg_price,
+			COALESCE(SUM(p.total_production_time), 0)::float8 AS total_time
+		FROM materials m
+		LEFT JOIN products p ON p.material_id = m.id
+		GROUP BY m.id, m.material_name
+		ORDER BY product_count DESC, m.id
+		LIMIT $1
+	`
+
+	rows, err := pool.Query(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []MaterialStats{}
+	for rows.Next() {
+		var m MaterialStats
+		if err := rows.Scan(&m.MaterialID, &m.MaterialName, &m.ProductCount, &m.AvgPrice, &m.TotalTime); err != nil {
+			return nil, err
+		}
+		stats = append(stats, m)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// ProductCostEfficiency - продукт с ценой на единицу времени производства
+type ProductCostEfficiency struct {
+	ProductWithTime
+	PricePerHour float64 `json:"price_per_hour"` // min_price / total_production_time
+}
+
+// GetCostEfficiency ранжирует продукты по min_price на час производства, лучшие первыми.
+// Продукты без времени (total_production_time = 0) пропускаются: NULLIF даёт NULL вместо деления на ноль
+func GetCostEfficiency(ctx context.Context, pool *pgxpool.Pool) ([]ProductCostEfficiency, error) {
+	query := `
+		SELECT ` + productColumns + `,
+			COALESCE(p.min_price, 0) / NULLIF(p.total_production_time, 0) AS price_per_hour
+		` + productFrom + `
+		WHERE COALESCE(p.min_price, 0) / NULLIF(p.total_production_time, 0) IS NOT NULL
+		ORDER BY price_per_hour DESC, p.id
+	`
+
+	rows, err := pool.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ranking := []ProductCostEfficiency{}
+	for rows.Next() {
+		var p ProductCostEfficiency
+		if err := rows.Scan(append(productScanDest(&p.ProductWithTime), &p.PricePerHour)...); err != nil {
+			return nil, err
+		}
+		ranking = append(ranking, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ranking, nil
+}
+
+// WorkshopUtilization - загрузка цеха: сколько продуктов через него идёт и суммарное время
+type WorkshopUtilization struct {
+	ID           int     `json:"id"`
+	Name         string  `json:"name"`
+	ProductCount int     `json:"product_count"`
+	TotalTime    float64 `json:"total_time"`
+}
+
+// workshopReportSortColumns - whitelist сортировки отчёта по цехам
+var workshopReportSortColumns = map[string]string{
+	"name":          "w.name",
+	"product_count": "product_count",
+	"total_time":    "total_time",
+}
+
+// GetWorkshopUtilization строит отчёт по загрузке цехов.
+// sortField должен быть ключом workshopReportSortColumns, limit = 0 - без ограничения
+func GetWorkshopUtilization(ctx context.Context, pool *pgxpool.Pool, sortField string, desc bool, limit int) ([]WorkshopUtilization, error) {
+	column, ok := workshopReportSortColumns[sortField]
+	if !ok {
+		return nil, fmt.Errorf("нельзя сортировать по полю '%s'", sortField)
+	}
+	direction := "ASC"
+	if desc {
+		direction = "DESC"
+	}
+
+	query := `
+		SELECT
+			w.id,
+			w.name,
+			COUNT(pw.product_id) AS product_count,
+			COALESCE(SUM(pw.production_time), 0) AS total_time
+		FROM workshops w
+		LEFT JOIN products_workshop pw ON pw.workshop_id = w.id
+		GROUP BY w.id, w.name
+		ORDER BY ` + column + " " + direction + ", w.id"
+
+	var args []any
+	if limit > 0 {
+		args = append(args, limit)
+		query += " LIMIT $1"
+	}
+
+	rows, err := pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := []WorkshopUtilization{}
+	for rows.Next() {
+		var w WorkshopUtilization
+		if err := rows.Scan(&w.ID, &w.Name, &w.ProductCount, &w.TotalTime); err != nil {
+			return nil, err
+		}
+		report = append(report, w)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// MaterialDependency - продукт, из-за которого материал нельзя удалить
+type MaterialDependency struct {
+	ID          int    `json:"id"`
+	ProductName string `json:"product_name"`
+	Article     string `json:"article"`
+}
+
+// GetMaterialDependencies возвращает продукты, ссылающиеся на материал. fk_products_material
+// объявлен ON DELETE RESTRICT, поэтому пустой список и значит, что удаление пройдёт.
+// Нет материала - ErrMaterialNotFound
+func GetMaterialDependencies(ctx context.Context, pool *pgxpool.Pool, materialID int) ([]MaterialDependency, error) {
+	var exists bool
+	err := pool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM materials WHERE id = $1)`, materialID).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrMaterialNotFound
+	}
+
+	rows, err := pool.Query(ctx, `
+		SELECT id, product_name, COALESCE(article, '')
+		FROM products
+		WHERE material_id = $1
+		ORDER BY product_name, id
+	`, materialID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[MaterialDependency])
+}
+
+// WorkshopProduct - продукт, проходящий через цех, со временем именно в этом цехе
+type WorkshopProduct struct {
+	ID             int     `json:"id"`
+	ProductName    string  `json:"product_name"`
+	MaterialName   string  `json:"material_name"`
+	TypeName       string  `json:"type_name"`
+	MinPrice       float64 `json:"min_price"`
+	Article        string  `json:"article"`
+	ProductionTime float64 `json:"production_time"`
+	StepOrder      int     `json:"step_order"`
+}
+
+// GetWorkshopProducts получает все продукты, в маршруте которых есть цех.
+// Возвращает ErrWorkshopNotFound, если цеха нет
+func GetWorkshopProducts(ctx context.Context, pool *pgxpool.Pool, workshopID int) ([]WorkshopProduct, error) {
+	var exists bool
+	err := pool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM workshops WHERE id = $1)`, workshopID).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrWorkshopNotFound
+	}
+
+	query := `
+		SELECT
+			p.id,
+			p.product_name,
+			m.material_name,
+			pt.type_name,
+			COALESCE(p.min_price, 0) AS min_price,
+			COALESCE(p.article, '') AS article,
+			COALESCE(pw.production_time, 0),
+			pw.step_order
+		FROM products_workshop pw
+		JOIN products p ON pw.product_id = p.id
+		JOIN materials m ON p.material_id = m.id
+		JOIN products_types pt ON p.type_id = pt.id
+		WHERE pw.workshop_id = $1
+		ORDER BY p.product_name, p.id
+	`
+
+	rows, err := pool.Query(ctx, query, workshopID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	products := []WorkshopProduct{}
+	for rows.Next() {
+		var p WorkshopProduct
+		err := rows.Scan(
+			&p.ID,
+			&p.ProductName,
+			&p.MaterialName,
+			&p.TypeName,
+			&p.MinPrice,
+			&p.Article,
+			&p.ProductionTime,
+			&p.StepOrder,
+		)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return products, nil
+}
+
+// OrphanReport - продукты, ссылающиеся на несуществующие материал или тип
+type OrphanReport struct {
+	MissingMaterial []int `json:"missing_material"`
+	MissingType     []int `json:"missing_type"`
+}
+
+// FindOrphanProducts ищет продукты с битыми material_id/type_id (LEFT JOIN + NULL).
+// Нужен для проверки данных перед включением FK-ограничений
+func FindOrphanProducts(ctx context.Context, pool *pgxpool.Pool) (*OrphanReport, error) {
+	query := `
+		SELECT p.id, m.id IS NULL, pt.id IS NULL
+		FROM products p
+		LEFT JOIN materials m ON p.material_id = m.id
+		LEFT JOIN products_types pt ON p.type_id = pt.id
+		WHERE m.id IS NULL OR pt.id IS NULL
+		ORDER BY p.id
+	`
+
+	rows, err := pool.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := &OrphanReport{
+		MissingMaterial: []int{},
+		MissingType:     []int{},
+	}
+	for rows.Next() {
+		var id int
+		var noMaterial, noType bool
+		if err := rows.Scan(&id, &noMaterial, &noType); err != nil {
+			return nil, err
+		}
+		if noMaterial {
+			report.MissingMaterial = append(report.MissingMaterial, id)
+		}
+		if noType {
+			report.MissingType = append(report.MissingType, id)
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// OrphanLink - строка products_workshop, продукта которой нет. При ON DELETE CASCADE
+// из schema.sql таких не бывает, но в старых базах FK могли создать без каскада или не создать вовсе
+type OrphanLink struct {
+	ID             int      `json:"id"`
+	ProductID      int      `json:"product_id"`
+	WorkshopID     int      `json:"workshop_id"`
+	ProductionTime *float64 `json:"production_time"`
+}
+
+// orphanLinksWhere - условие "связь без продукта" для products_workshop pw
+const orphanLinksWhere = `NOT EXISTS (SELECT 1 FROM products p WHERE p.id = pw.product_id)`
+
+// CountOrphanLinks считает связи без продукта
+func CountOrphanLinks(ctx context.Context, pool *pgxpool.Pool) (int64, error) {
+	var count int64
+	err := pool.QueryRow(ctx, `SELECT COUNT(*) FROM products_workshop pw WHERE `+orphanLinksWhere).Scan(&count)
+	return count, err
+}
+
+// FindOrphanLinks возвращает не больше limit связей без продукта
+func FindOrphanLinks(ctx context.Context, pool *pgxpool.Pool, limit int) ([]OrphanLink, error) {
+	query := `
+		SELECT pw.id, pw.product_id, pw.workshop_id, pw.production_time
+		FROM products_workshop pw
+		WHERE ` + orphanLinksWhere + `
+		ORDER BY pw.product_id, pw.id
+		LIMIT $1
+	`
+
+	rows, err := pool.Query(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []OrphanLink{}
+	for rows.Next() {
+		var l OrphanLink
+		if err := rows.Scan(&l.ID, &l.ProductID, &l.WorkshopID, &l.ProductionTime); err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+
+	return links, rows.Err()
+}
+
+// DeleteOrphanLinks удаляет все связи без продукта в одной транзакции и возвращает удалённые строки
+func DeleteOrphanLinks(ctx context.Context, pool *pgxpool.Pool) ([]OrphanLink, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `
+		DELETE FROM products_workshop pw
+		WHERE `+orphanLinksWhere+`
+		RETURNING pw.id, pw.product_id, pw.workshop_id, pw.production_time
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка удаления связей без продукта: %w", err)
+	}
+	links, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (OrphanLink, error) {
+		var l OrphanLink
+		err := row.Scan(&l.ID, &l.ProductID, &l.WorkshopID, &l.ProductionTime)
+		return l, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка удаления связей без продукта: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("ошибка коммита транзакции: %w", err)
+	}
+
+	return links, nil
+}
+
+// orphanLinkWatchdog периодически считает связи без продукта и пишет в лог, если они появились.
+// Последний результат виден в /api/debug/db
+type orphanLinkWatchdog struct {
+	pool      *pgxpool.Pool
+	interval  time.Duration // 0 - проверка выключена
+	count     atomic.Int64  // -1 - ещё не проверяли или последняя проверка упала
+	checkedAt atomic.Int64  // unix-время последней успешной проверки
+}
+
+func newOrphanLinkWatchdog(pool *pgxpool.Pool, interval time.Duration) *orphanLinkWatchdog {
+	w := &orphanLinkWatchdog{pool: pool, interval: interval}
+	w.count.Store(-1)
+	return w
+}
+
+// run проверяет сразу после старта и затем раз в interval, пока не отменён ctx
+func (w *orphanLinkWatchdog) run(ctx context.Context) {
+	if w.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		w.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *orphanLinkWatchdog) check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	count, err := CountOrphanLinks(ctx, w.pool)
+	if err != nil {
+		log.Printf("Ошибка проверки связей без продукта: %v", err)
+		w.count.Store(-1)
+		return
+	}
+	if count > 0 {
+		log.Printf("WARN: в products_workshop %d связей без продукта, список - GET /api/admin/orphan-links", count)
+	}
+	w.count.Store(count)
+	w.checkedAt.Store(time.Now().Unix())
+}
+
+// snapshot - последний результат для /api/debug/db
+func (w *orphanLinkWatchdog) snapshot() gin.H {
+	result := gin.H{
+		"interval": w.interval.String(),
+		"count":    nil,
+	}
+	if count := w.count.Load(); count >= 0 {
+		result["count"] = count
+		result["checked_at"] = time.Unix(w.checkedAt.Load(), 0).UTC()
+	}
+	return result
+}
+
+// reportParam - параметр именованного отчёта. Значение приходит из query-строки
+// и передаётся в SQL только плейсхолдером ($1, $2... в порядке Params)
+type reportParam struct {
+	Name     string   `json:"name"`
+	Kind     string   `json:"kind"` // "int" или "float"
+	Required bool     `json:"required"`
+	Default  *float64 `json:"default,omitempty"`
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+}
+
+// reportDef - заранее заданный read-only запрос. SQL от клиента не принимается
+type reportDef struct {
+	Description string        `json:"description"`
+	Params      []reportParam `json:"params"`
+	query       string
+}
+
+func floatPtr(v float64) *float64 { return &v }
+
+// reports - реестр отчётов для /api/reports/:name. Новый отчёт добавляется сюда:
+// колонки результата становятся ключами JSON, поэтому им стоит давать понятные алиасы
+var reports = map[string]reportDef{
+	"price-range": {
+		Description: "Продукты с минимальной ценой в диапазоне [min_price, max_price]",
+		Params: []reportParam{
+			{Name: "min_price", Kind: "float", Required: true, Min: floatPtr(0)},
+			{Name: "max_price", Kind: "float", Required: true, Min: floatPtr(0)},
+		},
+		query: `
+			SELECT p.id, p.product_name, p.article, p.min_price::float8 AS min_price, pt.type_name
+			FROM products p
+			JOIN products_types pt ON p.type_id = pt.id
+			WHERE p.min_price BETWEEN $1 AND $2
+			ORDER BY p.min_price, p.id`,
+	},
+	"top-workshops-by-time": {
+		Description: "Цеха с наибольшим суммарным временем производства",
+		Params: []reportParam{
+			{Name: "limit", Kind: "int", Default: floatPtr(10), Min: floatPtr(1), Max: floatPtr(100)},
+		},
+		query: `
+			SELECT w.id, w.name,
+				COUNT(pw.id) AS products_count,
+				COALESCE(SUM(pw.production_time), 0)::float8 AS total_time
+			FROM workshops w
+			LEFT JOIN products_workshop pw ON pw.workshop_id = w.id
+			GROUP BY w.id, w.name
+			ORDER BY total_time DESC, w.id
+			LIMIT $1`,
+	},
+	"price-percentile": {
+		Description: "Продукты дороже заданной доли продуктов своего типа: min_percentile=0.9 - верхние 10% по цене внутри типа",
+		Params: []reportParam{
+			{Name: "min_percentile", Kind: "float", Default: floatPtr(0.9), Min: floatPtr(0), Max: floatPtr(1)},
+		},
+		// percent_rank() = (место - 1) / (продуктов в типе - 1): у самого дешёвого 0, у самого дорогого 1.
+		// Продукты без цены (NULL или 0, как и в остальной статистике) в ранжирование не входят
+		query: `
+			SELECT id, product_name, article, min_price, type_id, type_name, price_percentile
+			FROM (
+				SELECT p.id, p.product_name, p.article, p.min_price::float8 AS min_price,
+					p.type_id, pt.type_name,
+					percent_rank() OVER (PARTITION BY p.type_id ORDER BY p.min_price) AS price_percentile
+				FROM products p
+				JOIN products_types pt ON p.type_id = pt.id
+				WHERE p.min_price > 0
+			) ranked
+			WHERE price_percentile >= $1
+			ORDER BY type_name, price_percentile DESC, id`,
+	},
+}
+
+// parseReportParams проверяет параметры отчёта и возвращает их в порядке def.Params.
+// Неизвестные параметры - ошибка: опечатка не должна молча давать отчёт по умолчанию
+func parseReportParams(def reportDef, values map[string][]string) ([]any, error) {
+	known := make(map[string]bool, len(def.Params))
+	for _, p := range def.Params {
+		known[p.Name] = true
+	}
+	for name := range values {
+		if !known[name] {
+			return nil, fmt.Errorf("неизвестный параметр %s", name)
+		}
+	}
+
+	args := make([]any, 0, len(def.Params))
+	for _, p := range def.Params {
+		raw := ""
+		if v, ok := values[p.Name]; ok && len(v) > 0 {
+			raw = strings.TrimSpace(v[0])
+		}
+
+		var value float64
+		switch {
+		case raw != "":
+			var err error
+			value, err = strconv.ParseFloat(raw, 64)
+			if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+				return nil, fmt.Errorf("параметр %s должен быть числом", p.Name)
+			}
+			if p.Kind == "int" && value != math.Trunc(value) {
+				return nil, fmt.Errorf("параметр %s должен быть целым числом", p.Name)
+			}
+		case p.Default != nil:
+			value = *p.Default
+		case p.Required:
+			return nil, fmt.Errorf("параметр %s обязателен", p.Name)
+		}
+
+		if p.Min != nil && value < *p.Min {
+			return nil, fmt.Errorf("параметр %s не может быть меньше %g", p.Name, *p.Min)
+		}
+		if p.Max != nil && value > *p.Max {
+			return nil, fmt.Errorf("параметр %s не может быть больше %g", p.Name, *p.Max)
+		}
+
+		if p.Kind == "int" {
+			args = append(args, int64(value))
+		} else {
+			args = append(args, value)
+		}
+	}
+
+	return args, nil
+}
+
+// RunReport выполняет отчёт в read-only транзакции и возвращает строки как map колонка -> значение
+func RunReport(ctx context.Context, pool *pgxpool.Pool, def reportDef, args []any) ([]map[string]any, error) {
+	result := []map[string]any{}
+	err := withReadSnapshot(ctx, pool, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, def.query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		fields := rows.FieldDescriptions()
+		for rows.Next() {
+			values, err := rows.Values()
+			if err != nil {
+				return err
+			}
+			row := make(map[string]any, len(fields))
+			for i, f := range fields {
+				row[f.Name] = values[i]
+			}
+			result = append(result, row)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// maintenanceTables - основные таблицы, для которых /api/admin/maintenance обновляет статистику
+var maintenanceTables = []string{"products", "materials", "products_types", "workshops", "products_workshop"}
+
+// TableEstimate - оценка числа строк таблицы из pg_class после ANALYZE
+type TableEstimate struct {
+	Table        string `json:"table"`
+	EstimatedRow int64  `json:"estimated_rows"`
+}
+
+// AnalyzeTables выполняет ANALYZE основных таблиц и возвращает оценки числа строк.
+// ANALYZE только пересчитывает статистику планировщика, данные не меняет и таблицы не блокирует на запись
+func AnalyzeTables(ctx context.Context, pool *pgxpool.Pool) ([]TableEstimate, error) {
+	// Имена таблиц - константы из кода, не из запроса
+	if _, err := pool.Exec(ctx, "ANALYZE "+strings.Join(maintenanceTables, ", ")); err != nil {
+		return nil, fmt.Errorf("ошибка ANALYZE: %w", err)
+	}
+
+	rows, err := pool.Query(ctx, `
+		SELECT c.relname, c.reltuples::bigint
+		FROM pg_class c
+		WHERE c.relname = ANY($1) AND c.relkind = 'r' AND pg_table_is_visible(c.oid)
+		ORDER BY c.relname
+	`, maintenanceTables)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	estimates := []TableEstimate{}
+	for rows.Next() {
+		var e TableEstimate
+		if err := rows.Scan(&e.Table, &e.EstimatedRow); err != nil {
+			return nil, err
+		}
+		estimates = append(estimates, e)
+	}
+
+	return estimates, rows.Err()
+}
+
+// ============ СЛОЙ HTTP (handlers) ============
+
+// apiResponse - единый формат успешного ответа API: {"data": ..., "meta": ...}
+type apiResponse struct {
+	Data any `json:"data"`
+	Meta any `json:"meta,omitempty"`
+}
+
+// respond отвечает в формате apiResponse с произвольным статусом.
+// Продукты отдаются в формате JSON:API, если клиент просит его в Accept (см. jsonAPIDocument)
+func respond(c *gin.Context, status int, data any, meta any) {
+	var body any = apiResponse{Data: data, Meta: meta}
+	if doc, ok := jsonAPIDocument(data, meta); ok {
+		c.Header("Vary", "Accept")
+		if wantsJSONAPI(c.GetHeader("Accept")) {
+			c.Header("Content-Type", jsonAPIMediaType)
+			body = doc
+		}
+	}
+	respondJSON(c, status, body)
+}
+
+// respondJSON пишет body как JSON, в camelCase, если его выбрал JSONCaseMiddleware.
+// Через неё идут и тела ошибок с полями помимо "error": клиент с camelCase получает
+// одинаковые имена полей в успешных ответах и в ошибках
+func respondJSON(c *gin.Context, status int, body any) {
+	if c.GetBool(camelCaseKey) {
+		converted, err := camelCaseJSON(body)
+		if err == nil {
+			contentType := c.Writer.Header().Get("Content-Type")
+			if contentType == "" {
+				contentType = "application/json; charset=utf-8"
+			}
+			c.Data(status, contentType, converted)
+			return
+		}
+		log.Printf("Ошибка перевода ключей ответа в camelCase: %v", err)
+	}
+	c.JSON(status, body)
+}
+
+// ============ ИМЕНА ПОЛЕЙ (snake_case / camelCase) ============
+
+// camelCaseKey - ключ gin.Context: отдавать ключи JSON в camelCase (ставит JSONCaseMiddleware)
+const camelCaseKey = "camel_case"
+
+// JSON-профили в Accept, переключающие имена полей для одного запроса:
+// Accept: application/json; profile=camelCase
+const (
+	camelCaseProfile = "camelCase"
+	snakeCaseProfile = "snake_case"
+)
+
+// JSONCaseMiddleware выбирает стиль ключей ответа: по умолчанию из JSON_FIELD_CASE,
+// профиль в Accept его переопределяет
+func JSONCaseMiddleware(defaultCamel bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		camel := defaultCamel
+		for _, part := range strings.Split(c.GetHeader("Accept"), ",") {
+			_, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			switch params["profile"] {
+			case camelCaseProfile:
+				camel = true
+			case snakeCaseProfile:
+				camel = false
+			}
+		}
+		c.Set(camelCaseKey, camel)
+		c.Header("Vary", "Accept")
+		c.Next()
+	}
+}
+
+// camelCaseJSON сериализует v, переименовывая имена полей: total_production_time ->
+// totalProductionTime. Переименовываются поля структур (по json-тегам) и ключи gin.H /
+// map[string]any - из них собираются meta и тела ошибок. Ключи типизированных map
+// (map[string]ProductWithTime в /api/products/by-articles, счётчики по статусам) - это данные,
+// а не имена полей, и остаются как есть: артикул AB_12 не должен стать AB12.
+// Значения со своим MarshalJSON/MarshalText (time.Time) сериализуются сами
+func camelCaseJSON(v any) ([]byte, error) {
+	return json.Marshal(camelCaseValue(reflect.ValueOf(v)))
+}
+
+var (
+	jsonMarshalerType = reflect.TypeFor[json.Marshaler]()
+	textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+)
+
+// camelObject - объект с переименованными ключами в порядке полей структуры
+type camelObject []camelField
+
+type camelField struct {
+	key   string
+	value any
+}
+
+func (o camelObject) MarshalJSON() ([]byte, error) {
+	var out bytes.Buffer
+	out.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		key, err := json.Marshal(f.key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(key)
+		out.WriteByte(':')
+		out.Write(value)
+	}
+	out.WriteByte('}')
+	return out.Bytes(), nil
+}
+
+// camelCaseValue повторяет обход encoding/json и возвращает значение, которое json.Marshal
+// сериализует уже с camelCase-именами полей
+func camelCaseValue(v reflect.Value) any {
+	if !v.IsValid() {
+		return nil
+	}
+	t := v.Type()
+	if t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType) {
+		if t.Kind() == reflect.Pointer && v.IsNil() {
+			return nil
+		}
+		return v.Interface()
+	}
+	if v.CanAddr() && (reflect.PointerTo(t).Implements(jsonMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType)) {
+		return v.Addr().Interface()
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return camelCaseValue(v.Elem())
+	case reflect.Struct:
+		fields := camelObject{}
+		seen := map[string]bool{}
+		appendCamelFields(&fields, seen, v)
+		return fields
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		// Ключи переименовываются только у нетипизированных map - см. camelCaseJSON
+		renameKeys := t.Key().Kind() == reflect.String && t.Elem().Kind() == reflect.Interface
+		out := reflect.MakeMapWithSize(reflect.MapOf(t.Key(), reflect.TypeFor[any]()), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key := iter.Key()
+			if renameKeys {
+				key = reflect.ValueOf(camelCase(key.String())).Convert(t.Key())
+			}
+			value := reflect.ValueOf(camelCaseValue(iter.Value()))
+			if !value.IsValid() {
+				value = reflect.Zero(out.Type().Elem())
+			}
+			out.SetMapIndex(key, value)
+		}
+		return out.Interface()
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		if t.Elem().Kind() == reflect.Uint8 && v.Kind() == reflect.Slice {
+			return v.Interface() // []byte - base64, как у encoding/json
+		}
+		items := make([]any, v.Len())
+		for i := range items {
+			items[i] = camelCaseValue(v.Index(i))
+		}
+		return items
+	default:
+		return v.Interface()
+	}
+}
+
+// appendCamelFields добавляет поля структуры по правилам encoding/json: "-" пропускается,
+// omitempty/omitzero учитываются, поля встроенных структур поднимаются на уровень выше.
+// Поле внешней структуры закрывает одноимённое поле встроенной
+func appendCamelFields(fields *camelObject, seen map[string]bool, v reflect.Value) {
+	t := v.Type()
+	var embedded []reflect.Value
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		value := v.Field(i)
+
+		if field.Anonymous && name == "" {
+			ft := field.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				if value.Kind() == reflect.Pointer {
+					if value.IsNil() {
+						continue
+					}
+					value = value.Elem()
+				}
+				embedded = append(embedded, value)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if hasJSONOption(opts, "omitempty") && isEmptyJSONValue(value) {
+			continue
+		}
+		if hasJSONOption(opts, "omitzero") && isZeroJSONValue(value) {
+			continue
+		}
+		key := camelCase(name)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		*fields = append(*fields, camelField{key: key, value: camelCaseValue(value)})
+	}
+	for _, value := range embedded {
+		appendCamelFields(fields, seen, value)
+	}
+}
+
+func hasJSONOption(opts, option string) bool {
+	for _, o := range strings.Split(opts, ",") {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// isEmptyJSONValue - пустое значение для omitempty, как в encoding/json
+func isEmptyJSONValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	}
+	return false
+}
+
+// isZeroJSONValue - нулевое значение для omitzero: метод IsZero() bool, если он есть
+func isZeroJSONValue(v reflect.Value) bool {
+	if z, ok := v.Interface().(interface{ IsZero() bool }); ok {
+		if v.Kind() == reflect.Pointer && v.IsNil() {
+			return true
+		}
+		return z.IsZero()
+	}
+	return v.IsZero()
+}
+
+// camelCase переводит snake_case ключ в camelCase; ключи без "_" не меняются
+func camelCase(key string) string {
+	if !strings.Contains(key, "_") {
+		return key
+	}
+	var b strings.Builder
+	upper := false
+	for i, r := range key {
+		switch {
+		case r == '_' && i > 0:
+			upper = true
+		case upper:
+			b.WriteRune(unicode.ToUpper(r))
+			upper = false
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// ============ JSON:API ============
+
+const jsonAPIMediaType = "application/vnd.api+json"
+
+// wantsJSONAPI - есть ли в Accept application/vnd.api+json. По спецификации тип с
+// параметрами (кроме ext/profile) не подходит, а */* означает обычный JSON
+func wantsJSONAPI(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mediaType != jsonAPIMediaType {
+			continue
+		}
+		delete(params, "q")
+		delete(params, "ext")
+		delete(params, "profile")
+		if len(params) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonAPIIdentifier - ссылка на ресурс (resource identifier object)
+type jsonAPIIdentifier struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	Meta any    `json:"meta,omitempty"`
+}
+
+// jsonAPIRelationship - связь ресурса; Data - *jsonAPIIdentifier или []jsonAPIIdentifier
+type jsonAPIRelationship struct {
+	Data any `json:"data"`
+}
+
+// jsonAPIResource - ресурс (resource object)
+type jsonAPIResource struct {
+	Type          string                         `json:"type"`
+	ID            string                         `json:"id"`
+	Attributes    any                            `json:"attributes"`
+	Relationships map[string]jsonAPIRelationship `json:"relationships,omitempty"`
+}
+
+// jsonAPIDoc - документ верхнего уровня
+type jsonAPIDoc struct {
+	Data     any               `json:"data"`
+	Included []jsonAPIResource `json:"included,omitempty"`
+	Meta     any               `json:"meta,omitempty"`
+}
+
+// productAttributes - атрибуты продукта в JSON:API: всё, кроме id и связей
+type productAttributes struct {
+	ProductName         string  `json:"product_name"`
+	MaterialName        string  `json:"material_name"`
+	TypeName            string  `json:"type_name"`
+	MinPrice            float64 `json:"min_price"`
+	Article             string  `json:"article"`
+	TotalProductionTime float64 `json:"total_production_time"`
+	IsActive            bool    `json:"is_active"`
+	ImageURL            string  `json:"image_url"`
+}
+
+// routeStepMeta - время и порядок цеха в маршруте: это свойства связи, а не самого цеха
+type routeStepMeta struct {
+	ProductionTime float64 `json:"production_time"`
+	StepOrder      int     `json:"step_order"`
+}
+
+// jsonAPIDocument переводит продукт или список продуктов в документ JSON:API.
+// Для остальных данных ok=false - они всегда отдаются обычным apiResponse
+func jsonAPIDocument(data any, meta any) (doc jsonAPIDoc, ok bool) {
+	doc.Meta = meta
+	b := jsonAPIBuilder{seen: map[int]bool{}}
+
+	switch v := data.(type) {
+	case ProductWithTime:
+		doc.Data = b.product(v, nil, false)
+	case *ProductWithTime:
+		doc.Data = b.product(*v, nil, false)
+	case ProductWithWorkshops:
+		doc.Data = b.product(v.ProductWithTime, v.Workshops, true)
+	case *ProductWithWorkshops:
+		doc.Data = b.product(v.ProductWithTime, v.Workshops, true)
+	case ProductExpanded:
+		doc.Data = b.product(v.ProductWithTime, v.Workshops, v.Workshops != nil)
+	case []ProductWithTime:
+		list := make([]jsonAPIResource, len(v))
+		for i, p := range v {
+			list[i] = b.product(p, nil, false)
+		}
+		doc.Data = list
+	case []ProductWithWorkshops:
+		list := make([]jsonAPIResource, len(v))
+		for i, p := range v {
+			list[i] = b.product(p.ProductWithTime, p.Workshops, true)
+		}
+		doc.Data = list
+	case []ProductExpanded:
+		list := make([]jsonAPIResource, len(v))
+		for i, p := range v {
+			list[i] = b.product(p.ProductWithTime, p.Workshops, p.Workshops != nil)
+		}
+		doc.Data = list
+	default:
+		return doc, false
+	}
+
+	doc.Included = b.included
+	return doc, true
+}
+
+// jsonAPIBuilder собирает included: каждый цех попадает туда один раз на документ
+type jsonAPIBuilder struct {
+	included []jsonAPIResource
+	seen     map[int]bool
+}
+
+func (b *jsonAPIBuilder) product(p ProductWithTime, workshops []ProductWorkshop, withWorkshops bool) jsonAPIResource {
+	res := jsonAPIResource{
+		Type: "products",
+		ID:   strconv.Itoa(p.ID),
+		Attributes: productAttributes{
+			ProductName:         p.ProductName,
+			MaterialName:        p.MaterialName,
+			TypeName:            p.TypeName,
+			MinPrice:            p.MinPrice,
+			Article:             p.Article,
+			TotalProductionTime: p.TotalProductionTime,
+			IsActive:            p.IsActive,
+			ImageURL:            p.ImageURL,
+		},
+		Relationships: map[string]jsonAPIRelationship{},
+	}
+	if p.MaterialID > 0 {
+		res.Relationships["material"] = jsonAPIRelationship{
+			Data: &jsonAPIIdentifier{Type: "materials", ID: strconv.Itoa(p.MaterialID)},
+		}
+	}
+	if p.TypeID > 0 {
+		res.Relationships["type"] = jsonAPIRelationship{
+			Data: &jsonAPIIdentifier{Type: "product-types", ID: strconv.Itoa(p.TypeID)},
+		}
+	}
+
+	// Маршрут известен не везде (список без ?expand=workshops) - тогда связи нет совсем,
+	// чтобы не выдать "нет цехов" за "цеха не загружались"
+	if withWorkshops {
+		linkage := make([]jsonAPIIdentifier, len(workshops))
+		for i, w := range workshops {
+			linkage[i] = jsonAPIIdentifier{
+				Type: "workshops",
+				ID:   strconv.Itoa(w.WorkshopID),
+				Meta: routeStepMeta{ProductionTime: w.ProductionTime, StepOrder: w.StepOrder},
+			}
+			if !b.seen[w.WorkshopID] {
+				b.seen[w.WorkshopID] = true
+				b.included = append(b.included, jsonAPIResource{
+					Type:       "workshops",
+					ID:         strconv.Itoa(w.WorkshopID),
+					Attributes: gin.H{"name": w.WorkshopName},
+				})
+			}
+		}
+		res.Relationships["workshops"] = jsonAPIRelationship{Data: linkage}
+	}
+	return res
+}
+
+// respondOK отвечает 200 в формате apiResponse
+func respondOK(c *gin.Context, data any, meta any) {
+	respond(c, http.StatusOK, data, meta)
+}
+
+type Server struct {
+	pool              *pgxpool.Pool
+	refs              *referenceCache    // кеш материалов/типов/цехов
+	maxOffset         int                // максимальный offset для списка (защита от сканирования всей таблицы)
+	maxProductionTime float64            // верхняя граница production_time одного цеха (отсекает опечатки вроде 99999)
+	maxWorkshops      int                // максимум цехов в маршруте одного продукта
+	exports           *exportRegistry    // прогресс идущих выгрузок для /api/products/export/progress
+	breaker           *dbBreaker         // быстрый отказ 503, пока БД недоступна
+	tracer            *poolTracer        // счётчики ожидания соединений из пула
+	defaultPageSize   int                // limit по умолчанию, если передан только offset
+	maxPageSize       int                // максимальный limit
+	metrics           *requestMetrics    // счётчики для /api/debug/stats
+	webhooks          *webhookDispatcher // уведомления внешней системы; nil - выключены
+	articlePattern    *regexp.Regexp     // формат артикула из ARTICLE_PATTERN; nil - не проверяется
+	stats             *statsCache        // кеш /api/stats
+	orphanLinks       *orphanLinkWatchdog
+	heavyOps          *heavyOpLimiter   // слоты для импорта/пересчётов/очистки
+	nameCharset       *nameCharset      // допустимые символы названия продукта; nil - любые
+	priceGuard        *priceChangeGuard // проверка цен при импорте; nil - выключена
+	adminKey          string            // ADMIN_API_KEY для проверок внутри ручек (?explain=true)
+	fuzzyThreshold    float64           // порог сходства нечёткого поиска по умолчанию
+	maxResponseRows   int               // потолок строк одного ответа списка продуктов и дерева каталога; 0 - без потолка
+	priceAboveCost    bool              // только при смене материала: цена не ниже его себестоимости (PRICE_ABOVE_COST)
+	totals            *totalRecomputer  // отложенная запись total_production_time; nil - в транзакции правки
+}
+
+// ============ ДОПУСТИМЫЕ СИМВОЛЫ НАЗВАНИЙ ============
+
+// Принтеры этикеток не печатают эмодзи и управляющие символы, поэтому название
+// продукта проверяется по набору письменностей/категорий Unicode и списку отдельных символов
+const (
+	defaultNameScripts    = "Latin,Cyrillic,Nd"
+	defaultNameExtraChars = ` .,-–—_()[]"'«»/\№%+&:;!?#*`
+)
+
+// nameCharset - допустимые символы: из таблиц Unicode или из extra
+type nameCharset struct {
+	tables []*unicode.RangeTable
+	extra  string
+}
+
+// newNameCharset разбирает список вида "Latin,Cyrillic,Nd": имена письменностей
+// (unicode.Scripts) или категорий (unicode.Categories). "any" - проверка выключена (nil)
+func newNameCharset(scripts, extra string) (*nameCharset, error) {
+	if strings.TrimSpace(scripts) == "any" {
+		return nil, nil
+	}
+	cs := &nameCharset{extra: extra}
+	for _, name := range strings.Split(scripts, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		table, ok := unicode.Scripts[name]
+		if !ok {
+			table, ok = unicode.Categories[name]
+		}
+		if !ok {
+			return nil, fmt.Errorf("неизвестная письменность или категория Unicode %q", name)
+		}
+		cs.tables = append(cs.tables, table)
+	}
+	return cs, nil
+}
+
+// DisallowedCharsError - в названии есть символы вне набора. Chars - каждый символ один раз,
+// в порядке появления, с кодом: невидимые символы иначе не разглядеть
+type DisallowedCharsError struct {
+	Chars []string
+}
+
+func (e *DisallowedCharsError) Error() string {
+	return "название содержит недопустимые символы: " + strings.Join(e.Chars, ", ")
+}
+
+func (cs *nameCharset) check(name string) error {
+	var bad []string
+	seen := map[rune]bool{}
+	for _, r := range name {
+		if r == ' ' || strings.ContainsRune(cs.extra, r) || unicode.In(r, cs.tables...) || seen[r] {
+			continue
+		}
+		seen[r] = true
+		bad = append(bad, fmt.Sprintf("%q (U+%04X)", r, r))
+	}
+	if len(bad) > 0 {
+		return &DisallowedCharsError{Chars: bad}
+	}
+	return nil
+}
+
+// respondProductNameError отвечает 422 со списком недопустимых символов
+func respondProductNameError(c *gin.Context, err error) {
+	var charsErr *DisallowedCharsError
+	if errors.As(err, &charsErr) {
+		respondJSON(c, http.StatusUnprocessableEntity, gin.H{
+			"error":            charsErr.Error(),
+			"disallowed_chars": charsErr.Chars,
+		})
+		return
+	}
+	c.JSON(http.StatusUnprocessableEntity, gin.H{
+		"error": err.Error(),
+	})
+}
+
+// checkWorkshopCount ограничивает число цехов в маршруте. Вызывается до начала транзакции
+func (s *Server) checkWorkshopCount(workshops []WorkshopInput) error {
+	if len(workshops) > s.maxWorkshops {
+		return fmt.Errorf("слишком много цехов: %d, максимум %d на продукт", len(workshops), s.maxWorkshops)
+	}
+	return nil
+}
+
+// checkArticle проверяет артикул по ARTICLE_PATTERN (после нормализации: регистр не важен).
+// Пустой артикул не проверяется - его сгенерирует generateArticle
+func (s *Server) checkArticle(article string) error {
+	article = normalizeArticle(article)
+	if s.articlePattern == nil || article == "" {
+		return nil
+	}
+	if !s.articlePattern.MatchString(article) {
+		return fmt.Errorf("артикул %s не соответствует формату %s", article, s.articlePattern)
+	}
+	return nil
+}
+
+// checkProductName проверяет символы названия по PRODUCT_NAME_SCRIPTS/PRODUCT_NAME_EXTRA_CHARS
+func (s *Server) checkProductName(name string) error {
+	if s.nameCharset == nil {
+		return nil
+	}
+	return s.nameCharset.check(name)
+}
+
+// checkProductionTimes проверяет, что время ни одного цеха не превышает maxProductionTime.
+// Проверка > 0 делается отдельно (binding/форма), здесь только верхняя граница
+func (s *Server) checkProductionTimes(workshops []WorkshopInput) error {
+	for _, w := range workshops {
+		if w.ProductionTime > s.maxProductionTime {
+			return fmt.Errorf("время производства в цехе %d (%.2f) больше допустимого максимума %.2f",
+				w.WorkshopID, w.ProductionTime, s.maxProductionTime)
+		}
+	}
+	return nil
+}
+
+// parsePagination читает limit/offset из query.
+// paginated = false, если клиент не просил пагинацию (отдаём весь список)
+func (s *Server) parsePagination(c *gin.Context) (limit, offset int, paginated bool, err error) {
+	rawLimit, hasLimit := c.GetQuery("limit")
+	rawOffset, hasOffset := c.GetQuery("offset")
+	if !hasLimit && !hasOffset {
+		return 0, 0, false, nil
+	}
+
+	limit = s.defaultPageSize
+	if hasLimit {
+		limit, err = strconv.Atoi(rawLimit)
+		if err != nil || limit <= 0 || limit > s.maxPageSize {
+			return 0, 0, false, fmt.Errorf("limit должен быть числом от 1 до %d", s.maxPageSize)
+		}
+	}
+
+	if hasOffset {
+		offset, err = strconv.Atoi(rawOffset)
+		if err != nil || offset < 0 {
+			return 0, 0, false, fmt.Errorf("offset должен быть неотрицательным числом")
+		}
+	}
+	if offset > s.maxOffset {
+		return 0, 0, false, fmt.Errorf(
+			"offset %d больше допустимого (%d): большие offset заставляют БД пролистывать все строки, сузьте выборку фильтрами или сортировкой",
+			offset, s.maxOffset)
+	}
+
+	return limit, offset, true, nil
+}
+
+// parseProductListOptions читает сортировку и фильтры списка продуктов (без пагинации).
+// Общий для списка и экспорта, чтобы выгрузка совпадала с тем, что видно в API
+func parseProductListOptions(c *gin.Context) (ProductListOptions, error) {
+	var opts ProductListOptions
+
+	sortKeys, err := ParseProductSort(c.Query("sort"))
+	if err != nil {
+		return opts, err
+	}
+	opts.Sort = sortKeys
+
+	if raw := c.Query("active_only"); raw != "" {
+		opts.ActiveOnly, err = strconv.ParseBool(raw)
+		if err != nil {
+			return opts, errors.New("active_only должен быть true или false")
+		}
+	}
+
+	if raw := c.Query("no_price"); raw != "" {
+		opts.NoPrice, err = strconv.ParseBool(raw)
+		if err != nil {
+			return opts, errors.New("no_price должен быть true или false")
+		}
+	}
+
+	if raw := c.Query("zero_time_links"); raw != "" {
+		opts.ZeroTimeLinks, err = strconv.ParseBool(raw)
+		if err != nil {
+			return opts, errors.New("zero_time_links должен быть true или false")
+		}
+	}
+
+	if raw := c.Query("exclude_ids"); raw != "" {
+		opts.ExcludeIDs, err = ParseIDList(raw)
+		if err != nil {
+			return opts, fmt.Errorf("exclude_ids: %w", err)
+		}
+	}
+
+	if raw := c.Query("type_id"); raw != "" {
+		opts.TypeID, err = parseID(raw)
+		if err != nil {
+			return opts, fmt.Errorf("type_id: %w", err)
+		}
+	}
+
+	if raw := c.Query("material_id"); raw != "" {
+		opts.MaterialID, err = parseID(raw)
+		if err != nil {
+			return opts, fmt.Errorf("material_id: %w", err)
+		}
+	}
+
+	if raw := c.Query("type_ids"); raw != "" {
+		opts.TypeIDs, err = ParseIDList(raw)
+		if err != nil {
+			return opts, fmt.Errorf("type_ids: %w", err)
+		}
+	}
+
+	if raw := c.Query("material_ids"); raw != "" {
+		opts.MaterialIDs, err = ParseIDList(raw)
+		if err != nil {
+			return opts, fmt.Errorf("material_ids: %w", err)
+		}
+	}
+
+	opts.Search = strings.TrimSpace(c.Query("q"))
+
+	opts.TimeMode, err = parseTimeMode(c)
+	if err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+// parseTimeMode читает ?time_mode=sum|max (см. timeModeSum), по умолчанию sum
+func parseTimeMode(c *gin.Context) (string, error) {
+	mode := c.DefaultQuery("time_mode", timeModeSum)
+	if mode != timeModeSum && mode != timeModeMax {
+		return "", fmt.Errorf("time_mode должен быть sum или max")
+	}
+	return mode, nil
+}
+
+// GET /api/products?sort=type,name desc&limit=20&offset=40
+//
+// Со страницей meta содержит total (COUNT по фильтрам), limit и offset. С include_count=false
+// COUNT не выполняется: вместо total в meta приходит has_more - есть ли что-то после страницы
+// (для бесконечной прокрутки, где общее число не показывают). Если offset за концом данных,
+// meta.page_out_of_range = true и заголовок X-Page-Out-Of-Range: true - клиент сбрасывает на первую страницу.
+// Без страницы, expand и JSON:API список пишется потоком (streamProductList).
+// time_mode=sum (по умолчанию) отдаёт время как сумму шагов маршрута, time_mode=max - как
+// самый долгий шаг, для маршрутов с параллельными цехами; режим повторяется в meta.time_mode.
+// explain=true|plan (с X-Admin-Key) вместо продуктов отдаёт SQL запроса, см. explainProductList
+func (s *Server) GetProductsHandler(c *gin.Context) {
+	opts, err := parseProductListOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	limit, offset, paginated, err := s.parsePagination(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	opts.Limit, opts.Offset = limit, offset
+
+	includeCount := true
+	if raw := c.Query("include_count"); raw != "" {
+		includeCount, err = strconv.ParseBool(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "include_count должен быть true или false",
+			})
+			return
+		}
+	}
+
+	expand, err := parseExpand(c.Query("expand"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	timeUnit, timeFactor, err := parseTimeUnit(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if raw := c.Query("explain"); raw != "" && raw != "false" {
+		if paginated && !includeCount {
+			opts.Limit = limit + 1 // как в запросе has_more ниже
+		}
+		s.explainProductList(c, opts, raw, paginated && includeCount)
+		return
+	}
+
+	opts.MaxRows = s.maxResponseRows
+
+	var products []ProductWithTime
+	meta := gin.H{}
+	switch {
+	case paginated && includeCount:
+		var total int
+		products, total, err = GetProductsPaginated(c.Request.Context(), s.pool, opts)
+		meta["total"] = total
+		meta["limit"] = limit
+		meta["offset"] = offset
+		// Пустая страница за концом данных - не то же, что пустой каталог: клиент может вернуться на первую
+		meta["page_out_of_range"] = offset > 0 && offset >= total
+	case paginated:
+		if err = checkResponseRows(opts); err != nil {
+			break
+		}
+		// Лишняя строка сверх limit отвечает на "есть ли ещё" без COUNT
+		opts.Limit = limit + 1
+		products, err = GetAllProducts(c.Request.Context(), s.pool, opts)
+		hasMore := len(products) > limit
+		if hasMore {
+			products = products[:limit]
+		}
+		meta["has_more"] = hasMore
+		meta["limit"] = limit
+		meta["offset"] = offset
+		// Без COUNT пустая страница при offset > 0 и означает offset >= total
+		meta["page_out_of_range"] = offset > 0 && len(products) == 0
+	case streamsProductList(c.Request.URL.Query(), c.GetHeader("Accept")):
+		s.streamProductList(c, opts, timeUnit, timeFactor)
+		return
+	default:
+		products, err = GetProductsCapped(c.Request.Context(), s.pool, opts)
+	}
+	if err != nil {
+		respondError(c, err, "Не удалось получить список продуктов")
+		return
+	}
+	if meta["page_out_of_range"] == true {
+		c.Header("X-Page-Out-Of-Range", "true")
+	}
+	meta["count"] = len(products)
+	meta["time_unit"] = timeUnit
+	meta["time_mode"] = opts.TimeMode
+	for i := range products {
+		products[i].TotalProductionTime *= timeFactor
+	}
+
+	if len(expand) == 0 && !opts.ZeroTimeLinks {
+		respondOK(c, products, meta)
+		return
+	}
+
+	expanded := make([]ProductExpanded, len(products))
+	for i, p := range products {
+		expanded[i] = ProductExpanded{ProductWithTime: p}
+		if expand["refs"] {
+			expanded[i].Material = &ProductRef{ID: p.MaterialID, Name: p.MaterialName}
+			expanded[i].Type = &ProductRef{ID: p.TypeID, Name: p.TypeName}
+		}
+	}
+
+	if expand["workshops"] {
+		if err := s.attachWorkshops(c.Request.Context(), expanded); err != nil {
+			respondError(c, err, "Не удалось получить цеха продуктов")
+			return
+		}
+		for i := range expanded {
+			convertWorkshopTimes(expanded[i].Workshops, timeFactor)
+		}
+	}
+
+	if opts.ZeroTimeLinks {
+		if err := s.attachLinkCounts(c.Request.Context(), expanded); err != nil {
+			respondError(c, err, "Не удалось посчитать цеха продуктов")
+			return
+		}
+	}
+
+	respondOK(c, expanded, meta)
+}
+
+// streamsProductList - пойдёт ли GET /api/products потоком: без страницы и explain, без expand,
+// zero_time_links и JSON:API (им нужен весь список до ответа). Общая для обработчика и
+// isStreamingRequest, чтобы REQUEST_TIMEOUT снимался ровно с потоковых ответов
+func streamsProductList(query url.Values, accept string) bool {
+	if query.Has("limit") || query.Has("offset") {
+		return false
+	}
+	if raw := query.Get("explain"); raw != "" && raw != "false" {
+		return false
+	}
+	if expand, err := parseExpand(query.Get("expand")); err != nil || len(expand) > 0 {
+		return false
+	}
+	if zero, _ := strconv.ParseBool(query.Get("zero_time_links")); zero {
+		return false
+	}
+	return !wantsJSONAPI(accept)
+}
+
+// ExplainedQuery - SQL и аргументы запроса; Plan - EXPLAIN (FORMAT JSON) от postgres, если просили
+type ExplainedQuery struct {
+	SQL  string `json:"sql"`
+	Args []any  `json:"args"`
+	Plan any    `json:"plan,omitempty"`
+}
+
+// explainProductList отвечает на ?explain=true|plan вместо выполнения списка: SQL и аргументы,
+// которые собрал бы buildProductsQuery (и COUNT, если он выполнялся бы), а с explain=plan ещё
+// и план без ANALYZE - сам запрос не выполняется. Только с X-Admin-Key: SQL раскрывает схему
+func (s *Server) explainProductList(c *gin.Context, opts ProductListOptions, mode string, withCount bool) {
+	if mode != "true" && mode != "plan" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "explain должен быть true или plan",
+		})
+		return
+	}
+	if !adminKeyValid(c, s.adminKey) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "explain доступен только с ключом администратора",
+		})
+		return
+	}
+
+	explain := func(query string, args []any) (ExplainedQuery, error) {
+		q := ExplainedQuery{SQL: query, Args: args}
+		if q.Args == nil {
+			q.Args = []any{}
+		}
+		if mode == "plan" {
+			if err := s.pool.QueryRow(c.Request.Context(), "EXPLAIN (FORMAT JSON) "+query, args...).Scan(&q.Plan); err != nil {
+				return q, err
+			}
+		}
+		return q, nil
+	}
+
+	result := gin.H{}
+	list, err := explain(buildProductsQuery(opts))
+	if err != nil {
+		respondError(c, err, "Не удалось получить план запроса")
+		return
+	}
+	result["query"] = list
+	if withCount {
+		count, err := explain(buildProductsCountQuery(opts))
+		if err != nil {
+			respondError(c, err, "Не удалось получить план запроса")
+			return
+		}
+		result["count_query"] = count
+	}
+
+	respondOK(c, result, nil)
+}
+
+// productListFlushEvery - через сколько продуктов потоковый список сбрасывает буфер клиенту
+const productListFlushEvery = 500
+
+// streamProductList отдаёт список без пагинации тем же {"data": [...], "meta": {...}}, но пишет
+// массив по мере чтения строк, не собирая весь каталог в памяти. Ответ начинается с первой
+// строки: ошибка до неё - обычный 500, после - статус уже отправлен, остаётся записать в лог
+// и оборвать ответ, клиент увидит незакрытый JSON. meta идёт после data, поэтому count известен
+func (s *Server) streamProductList(c *gin.Context, opts ProductListOptions, timeUnit string, timeFactor float64) {
+	camel := c.GetBool(camelCaseKey)
+	encode := func(v any) ([]byte, error) {
+		if camel {
+			return camelCaseJSON(v)
+		}
+		return json.Marshal(v)
+	}
+
+	// Поток нельзя оборвать посередине понятной ошибкой, поэтому потолок проверяется заранее
+	// COUNT по тем же фильтрам
+	if opts.MaxRows > 0 {
+		total, err := CountProducts(c.Request.Context(), s.pool, opts)
+		if err != nil {
+			respondError(c, err, "Не удалось получить список продуктов")
+			return
+		}
+		if total > opts.MaxRows {
+			respondError(c, errTooManyRows(opts.MaxRows), "Не удалось получить список продуктов")
+			return
+		}
+	}
+
+	count := 0
+	err := StreamProducts(c.Request.Context(), s.pool, opts, func(p ProductWithTime) error {
+		p.TotalProductionTime *= timeFactor
+		item, err := encode(p)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			c.Header("Content-Type", "application/json; charset=utf-8")
+			c.Status(http.StatusOK)
+			c.Writer.WriteString(`{"data":[`)
+		} else {
+			c.Writer.WriteString(",")
+		}
+		if _, err := c.Writer.Write(item); err != nil {
+			return err
+		}
+		count++
+		if count%productListFlushEvery == 0 {
+			c.Writer.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		if count == 0 {
+			respondError(c, err, "Не удалось получить список продуктов")
+			return
+		}
+		log.Printf("Ошибка потоковой отдачи продуктов после %d строк, ответ оборван: %v", count, err)
+		return
+	}
+
+	meta, err := encode(gin.H{"count": count, "time_unit": timeUnit, "time_mode": opts.TimeMode})
+	if err != nil {
+		log.Printf("Ошибка сериализации meta списка продуктов: %v", err)
+		return
+	}
+	if count == 0 {
+		c.Header("Content-Type", "application/json; charset=utf-8")
+		c.Status(http.StatusOK)
+		c.Writer.WriteString(`{"data":[`)
+	}
+	c.Writer.WriteString(`],"meta":`)
+	c.Writer.Write(meta)
+	c.Writer.WriteString("}")
+}
+
+// storedTimeUnit - в чём хранится production_time (и total_production_time) в БД.
+// Форма и список продуктов подписывают время в часах
+const storedTimeUnit = "hours"
+
+// timeUnitFactors - во сколько раз умножить хранимое время для ?time_unit=
+var timeUnitFactors = map[string]float64{
+	"hours":   1,
+	"minutes": 60,
+}
+
+// parseTimeUnit читает ?time_unit=minutes|hours. Без параметра время отдаётся как хранится
+func parseTimeUnit(c *gin.Context) (unit string, factor float64, err error) {
+	unit = c.DefaultQuery("time_unit", storedTimeUnit)
+	factor, ok := timeUnitFactors[unit]
+	if !ok {
+		return "", 0, fmt.Errorf("time_unit должен быть hours или minutes")
+	}
+	return unit, factor, nil
+}
+
+// convertWorkshopTimes переводит время шагов маршрута в нужную единицу
+func convertWorkshopTimes(workshops []ProductWorkshop, factor float64) {
+	for i := range workshops {
+		workshops[i].ProductionTime *= factor
+	}
+}
+
+// expandOptions - допустимые значения ?expand= для списка продуктов
+var expandOptions = map[string]bool{
+	"workshops": true, // маршрут продукта
+	"refs":      true, // material и type объектами с id
+}
+
+// parseExpand разбирает ?expand=a,b в набор включённых вложений
+func parseExpand(raw string) (map[string]bool, error) {
+	expand := map[string]bool{}
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !expandOptions[part] {
+			return nil, fmt.Errorf("неизвестное значение expand: %s", part)
+		}
+		expand[part] = true
+	}
+	return expand, nil
+}
+
+// attachWorkshops добавляет к продуктам их маршруты одним запросом на всю страницу
+func (s *Server) attachWorkshops(ctx context.Context, products []ProductExpanded) error {
+	ids := make([]int, len(products))
+	for i, p := range products {
+		ids[i] = p.ID
+	}
+
+	workshops, err := GetWorkshopsByProductIDs(ctx, s.pool, ids)
+	if err != nil {
+		return err
+	}
+
+	for i := range products {
+		pw := workshops[products[i].ID]
+		if pw == nil {
+			pw = []ProductWorkshop{}
+		}
+		products[i].Workshops = pw
+	}
+	return nil
+}
+
+// attachLinkCounts добавляет к продуктам число цехов одним запросом на всю страницу
+func (s *Server) attachLinkCounts(ctx context.Context, products []ProductExpanded) error {
+	ids := make([]int, len(products))
+	for i, p := range products {
+		ids[i] = p.ID
+	}
+
+	counts, err := GetLinkCountsByProductIDs(ctx, s.pool, ids)
+	if err != nil {
+		return err
+	}
+
+	for i := range products {
+		count := counts[products[i].ID]
+		products[i].LinkCount = &count
+	}
+	return nil
+}
+
+// respondWorkshopInputError отвечает 422 на ошибки в списке цехов из запроса (несуществующий
+// или повторённый цех: JSON корректен, но ссылается на то, чего нет).
+// Возвращает false, если ошибка не про цеха и её обрабатывает вызывающий
+func respondWorkshopInputError(c *gin.Context, err error) bool {
+	var missing *MissingWorkshopsError
+	switch {
+	case errors.As(err, &missing):
+		respondJSON(c, http.StatusUnprocessableEntity, gin.H{
+			"error":                missing.Error(),
+			"invalid_workshop_ids": missing.IDs,
+		})
+	case errors.Is(err, ErrWorkshopNotFound), errors.Is(err, ErrWorkshopAlreadyLinked):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": err.Error(),
+		})
+	default:
+		return false
+	}
+	return true
+}
+
+// GET /api/products/changes?since=2024-05-01T10:00:00Z
+// Лента изменений для синхронизации локальной копии каталога. В meta.next_since -
+// updated_at последнего изменения: его передают как since в следующий раз.
+// Удаления в ленту не попадают: продукты удаляются физически, мягкого удаления нет
+func (s *Server) GetProductChangesHandler(c *gin.Context) {
+	since, err := time.Parse(time.RFC3339, c.Query("since"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "since должен быть временем в формате RFC3339, например 2024-05-01T10:00:00Z",
+		})
+		return
+	}
+
+	changes, err := GetProductChanges(c.Request.Context(), s.pool, since)
+	if err != nil {
+		respondError(c, err, "Не удалось получить изменения продуктов")
+		return
+	}
+
+	// Без изменений клиент продолжает с того же since
+	nextSince := since
+	if len(changes) > 0 {
+		nextSince = changes[len(changes)-1].UpdatedAt
+	}
+
+	respondOK(c, changes, gin.H{
+		"count":      len(changes),
+		"next_since": nextSince.Format(time.RFC3339Nano),
+	})
+}
+
+// maxProductIDs - сколько id отдаёт /api/products/ids за раз (около 0.5 МБ JSON)
+const maxProductIDs = 50000
+
+// GET /api/products/ids?type_id=3&q=стол - id всех продуктов под теми же фильтрами и сортировкой,
+// что в списке, для "выбрать все N найденных" без перелистывания страниц. Больше maxProductIDs
+// не отдаётся: тогда meta.truncated=true, и интерфейс должен попросить сузить фильтр
+func (s *Server) GetProductIDsHandler(c *gin.Context) {
+	opts, err := parseProductListOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Лишний id сверх лимита показывает, что выборка обрезана, без отдельного COUNT
+	ids, err := GetProductIDs(c.Request.Context(), s.pool, opts, maxProductIDs+1)
+	if err != nil {
+		respondError(c, err, "Не удалось получить id продуктов")
+		return
+	}
+	truncated := len(ids) > maxProductIDs
+	if truncated {
+		ids = ids[:maxProductIDs]
+	}
+
+	respondOK(c, ids, gin.H{
+		"count":     len(ids),
+		"truncated": truncated,
+	})
+}
+
+// GET /api/products/recent?limit=10 - последние изменённые продукты для ленты активности.
+// В отличие от списка без фильтров и сортировки: один параметр, один и тот же запрос
+func (s *Server) GetRecentProductsHandler(c *gin.Context) {
+	limit := s.defaultPageSize
+	if raw := c.Query("limit"); raw != "" {
+		var err error
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit <= 0 || limit > s.maxPageSize {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("limit должен быть числом от 1 до %d", s.maxPageSize),
+			})
+			return
+		}
+	}
+
+	products, err := GetRecentProducts(c.Request.Context(), s.pool, limit)
+	if err != nil {
+		respondError(c, err, "Не удалось получить последние изменённые продукты")
+		return
+	}
+
+	respondOK(c, products, gin.H{
+		"count": len(products),
+		"limit": limit,
+	})
+}
+
+// GET /api/products/by-article/:article - поиск по артикулу (для сканера штрихкодов)
+func (s *Server) GetProductByArticleHandler(c *gin.Context) {
+	article := normalizeArticle(c.Param("article"))
+	if article == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Артикул не указан",
+		})
+		return
+	}
+
+	products, err := GetProductByArticle(c.Request.Context(), s.pool, article)
+	if err != nil {
+		respondError(c, err, "Не удалось получить продукт")
+		return
+	}
+
+	switch len(products) {
+	case 0:
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Продукт не найден",
+		})
+	case 1:
+		respondOK(c, products[0], nil)
+	default:
+		respondJSON(c, http.StatusConflict, gin.H{
+			"error":    "Артикул " + article + " используется несколькими продуктами",
+			"products": products,
+		})
+	}
+}
+
+// POST /api/products/with-new-type - создать тип продукции и первый продукт этого типа
+func (s *Server) CreateProductWithNewTypeHandler(c *gin.Context) {
+	var input CreateProductWithNewTypeInput
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if strings.TrimSpace(input.Type.TypeName) == "" {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": "Неверные данные: название типа не может быть пустым",
+		})
+		return
+	}
+	if err := s.checkArticle(input.Article); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err := s.checkProductName(input.ProductName); err != nil {
+		respondProductNameError(c, err)
+		return
+	}
+
+	result, err := CreateProductWithNewType(c.Request.Context(), s.pool, input, s.articlePattern)
+	switch {
+	case errors.Is(err, ErrInvalidPricing):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": err.Error(),
+		})
+		return
+	case errors.Is(err, ErrProductTypeExists), errors.Is(err, ErrArticleTaken), errors.Is(err, ErrDuplicateProduct):
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+		return
+	case err != nil:
+		respondError(c, err, "Не удалось создать тип и продукт")
+		return
+	}
+
+	// Свой кеш сбрасываем сразу, не дожидаясь NOTIFY
+	s.refs.invalidate("types")
+	s.webhooks.send(c.Request.Context(), webhookProductCreated, result.ProductID)
+
+	respond(c, http.StatusCreated, gin.H{
+		"type_id":    result.TypeID,
+		"product_id": result.ProductID,
+	}, gin.H{
+		"warnings": result.Warnings,
+	})
+}
+
+// GET /api/products/search?q=стол&limit=20&offset=0
+// Одна строка поиска по названию, артикулу и материалу; matched_fields - для подсветки.
+// fuzzy=true - поиск с опечатками по сходству триграмм (порог threshold, по умолчанию
+// SEARCH_FUZZY_THRESHOLD), у каждого результата similarity
+func (s *Server) SearchProductsHandler(c *gin.Context) {
+	search := strings.TrimSpace(c.Query("q"))
+	if search == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Параметр q обязателен",
+		})
+		return
+	}
+
+	limit, offset, paginated, err := s.parsePagination(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if !paginated {
+		limit = s.defaultPageSize
+	}
+
+	if c.Query("fuzzy") == "true" {
+		threshold := s.fuzzyThreshold
+		if raw := c.Query("threshold"); raw != "" {
+			threshold, err = strconv.ParseFloat(raw, 64)
+			// ParseFloat принимает "NaN", а NaN не меньше и не больше границ - проверяем явно
+			if err != nil || math.IsNaN(threshold) || threshold <= 0 || threshold > 1 {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": "threshold должен быть числом больше 0 и не больше 1",
+				})
+				return
+			}
+		}
+
+		results, err := SearchProductsFuzzy(c.Request.Context(), s.pool, search, threshold, limit, offset)
+		if err != nil {
+			respondError(c, err, "Не удалось выполнить поиск")
+			return
+		}
+
+		respondOK(c, results, gin.H{
+			"count":     len(results),
+			"limit":     limit,
+			"offset":    offset,
+			"threshold": threshold,
+		})
+		return
+	}
+
+	results, err := SearchProducts(c.Request.Context(), s.pool, search, limit, offset)
+	if err != nil {
+		respondError(c, err, "Не удалось выполнить поиск")
+		return
+	}
+
+	respondOK(c, results, gin.H{
+		"count":  len(results),
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+// ProductFilterRequest - тело POST /api/products/search
+type ProductFilterRequest struct {
+	Filter *FilterExpr `json:"filter" binding:"required"`
+	Sort   string      `json:"sort"`   // как ?sort= у списка продуктов
+	Limit  int         `json:"limit"`  // 0 - DEFAULT_PAGE_SIZE
+	Offset int         `json:"offset"` // не больше MAX_OFFSET
+}
+
+// POST /api/products/search - расширенный поиск: дерево and/or из условий по полям продукта
+// (см. FilterExpr). Ответ - страница с total, как у GET /api/products
+func (s *Server) FilterProductsHandler(c *gin.Context) {
+	var req ProductFilterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	var conditions int
+	if err := req.Filter.validate(1, &conditions); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Неверный фильтр: " + err.Error(),
+		})
+		return
+	}
+
+	sortKeys, err := ParseProductSort(req.Sort)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	limit := req.Limit
+	if limit == 0 {
+		limit = s.defaultPageSize
+	}
+	if limit < 0 || limit > s.maxPageSize {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("limit должен быть числом от 1 до %d", s.maxPageSize),
+		})
+		return
+	}
+	if req.Offset < 0 || req.Offset > s.maxOffset {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("offset должен быть от 0 до %d", s.maxOffset),
+		})
+		return
+	}
+
+	opts := ProductListOptions{
+		Sort:    sortKeys,
+		Limit:   limit,
+		Offset:  req.Offset,
+		Filter:  req.Filter,
+		MaxRows: s.maxResponseRows,
+	}
+	products, total, err := GetProductsPaginated(c.Request.Context(), s.pool, opts)
+	if err != nil {
+		respondError(c, err, "Не удалось выполнить поиск")
+		return
+	}
+
+	respondOK(c, products, gin.H{
+		"total":  total,
+		"count":  len(products),
+		"limit":  limit,
+		"offset": req.Offset,
+	})
+}
+
+// GET /api/products/price-bounds?type_id=2&q=дуб - границы цены для слайдера.
+// Фильтры те же, что у списка продуктов
+func (s *Server) PriceBoundsHandler(c *gin.Context) {
+	opts, err := parseProductListOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	bounds, err := GetPriceBounds(c.Request.Context(), s.pool, opts)
+	if err != nil {
+		respondError(c, err, "Не удалось получить диапазон цен")
+		return
+	}
+
+	respondOK(c, bounds, nil)
+}
+
+// GET /api/matrix?product_ids=1,2,3 - время продукта в каждом цехе для тепловой карты
+func (s *Server) GetWorkshopMatrixHandler(c *gin.Context) {
+	var productIDs []int
+	if raw := c.Query("product_ids"); raw != "" {
+		var err error
+		productIDs, err = ParseIDList(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "product_ids: " + err.Error(),
+			})
+			return
+		}
+	}
+
+	matrix, err := GetWorkshopMatrix(c.Request.Context(), s.pool, productIDs)
+	if err != nil {
+		respondError(c, err, "Не удалось построить матрицу цехов")
+		return
+	}
+
+	respondOK(c, matrix, gin.H{
+		"products":  len(matrix.ProductIDs),
+		"workshops": len(matrix.WorkshopIDs),
+		"cells":     len(matrix.Cells),
+	})
+}
+
+// GET /api/products/:id?time_mode=max - time_mode как в списке продуктов
+func (s *Server) GetProductByIDHandler(c *gin.Context) {
+	productID, err := parseProductID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Неверный ID продукта",
+		})
+		return
+	}
+
+	timeUnit, timeFactor, err := parseTimeUnit(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	timeMode, err := parseTimeMode(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	product, err := GetProductByIDWithTimeMode(c.Request.Context(), s.pool, productID, timeMode)
+	switch {
+	case err != nil:
+		respondError(c, err, "Не удалось получить продукт")
+		return
+	}
+
+	product.TotalProductionTime *= timeFactor
+	respondOK(c, product, gin.H{
+		"time_unit": timeUnit,
+		"time_mode": timeMode,
+	})
+}
+
+// GET /api/products/:id/full?unit=hours - продукт, его материал и тип целиком и маршрут
+// одним запросом вместо четырёх. Части читаются параллельно; без продукта - 404, а если
+// не загрузился материал, тип или маршрут, продукт всё равно отдаётся, пропавшие части -
+// null и перечислены в meta.failed. Истории изменений в ответе нет: её не ведёт ни одна таблица
+func (s *Server) GetProductFullHandler(c *gin.Context) {
+	productID, err := parseProductID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Неверный ID продукта",
+		})
+		return
+	}
+
+	timeUnit, timeFactor, err := parseTimeUnit(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	ctx := c.Request.Context()
+	var full ProductFull
+	var product *ProductWithTime
+	var productErr, materialErr, typeErr, workshopsErr error
+
+	// errgroup без WithContext: ошибка одной части не должна отменять остальные
+	var g errgroup.Group
+	g.Go(func() error {
+		product, productErr = GetProductByID(ctx, s.pool, productID)
+		return productErr
+	})
+	g.Go(func() error {
+		full.Material, materialErr = GetProductMaterial(ctx, s.pool, productID)
+		return materialErr
+	})
+	g.Go(func() error {
+		full.Type, typeErr = GetProductTypeOf(ctx, s.pool, productID)
+		return typeErr
+	})
+	g.Go(func() error {
+		full.Workshops, workshopsErr = GetProductWorkshops(ctx, s.pool, productID, 0, 0)
+		return workshopsErr
+	})
+	g.Wait()
+
+	if productErr != nil {
+		respondError(c, productErr, "Не удалось получить продукт")
+		return
+	}
+	full.ProductWithTime = *product
+	full.TotalProductionTime *= timeFactor
+
+	failed := []string{}
+	for _, part := range []struct {
+		name string
+		err  error
+	}{
+		{"material", materialErr},
+		{"type", typeErr},
+		{"workshops", workshopsErr},
+	} {
+		// ErrProductNotFound здесь - продукт удалили между запросами частей, это не сбой
+		if part.err != nil && !errors.Is(part.err, ErrProductNotFound) {
+			log.Printf("Ошибка загрузки %s продукта %d: %v", part.name, productID, part.err)
+			failed = append(failed, part.name)
+		}
+	}
+	convertWorkshopTimes(full.Workshops, timeFactor)
+
+	respondOK(c, full, gin.H{
+		"time_unit": timeUnit,
+		"failed":    failed,
+	})
+}
+
+// GET /api/products/:id/workshops?limit=50&offset=100 - маршрут продукта по шагам.
+// total_production_time всегда по всему маршруту, независимо от страницы
+func (s *Server) GetProductWorkshopsHandler(c *gin.Context) {
+	productID, err := parseID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Неверный ID продукта",
+		})
+		return
+	}
+
+	limit, offset, paginated, err := s.parsePagination(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	timeUnit, timeFactor, err := parseTimeUnit(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	product, err := GetProductByID(c.Request.Context(), s.pool, productID)
+	switch {
+	case err != nil:
+		respondError(c, err, "Не удалось получить продукт")
+		return
+	}
+
+	workshops, err := GetProductWorkshops(c.Request.Context(), s.pool, productID, limit, offset)
+	if err != nil {
+		respondError(c, err, "Не удалось получить цеха продукта")
+		return
+	}
+
+	convertWorkshopTimes(workshops, timeFactor)
+	meta := gin.H{
+		"product_id":            productID,
+		"total_production_time": product.TotalProductionTime * timeFactor,
+		"time_unit":             timeUnit,
+	}
+	if paginated {
+		totalSteps, err := CountProductWorkshops(c.Request.Context(), s.pool, productID)
+		if err != nil {
+			respondError(c, err, "Не удалось получить цеха продукта")
+			return
+		}
+		meta["count"] = len(workshops)
+		meta["total"] = totalSteps
+		meta["limit"] = limit
+		meta["offset"] = offset
+	}
+
+	respondOK(c, workshops, meta)
+}
+
+// POST /api/products/:id/workshops - добавить цех в маршрут продукта
+func (s *Server) AddProductWorkshopHandler(c *gin.Context) {
+	productID, err := parseID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Неверный ID продукта",
+		})
+		return
+	}
+
+	var input WorkshopInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if err := s.checkProductionTimes([]WorkshopInput{input}); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	total, err := AddProductWorkshop(c.Request.Context(), s.pool, productID, input, s.maxWorkshops, s.totals)
+	if err != nil {
+		respondError(c, err, "Не удалось добавить цех")
+		return
+	}
+
+	respond(c, http.StatusCreated, gin.H{
+		"product_id":            productID,
+		"workshop_id":           input.WorkshopID,
+		"production_time":       input.ProductionTime,
+		"total_production_time": total,
+	}, nil)
+}
+
+// UpdateWorkshopTimeRequest - новое время одного цеха в маршруте
+type UpdateWorkshopTimeRequest struct {
+	ProductionTime float64 `json:"production_time" binding:"required,gt=0"`
+}
+
+// PATCH /api/products/:id/workshops/:workshop_id - поправить время одного цеха, не трогая маршрут
+func (s *Server) UpdateWorkshopTimeHandler(c *gin.Context) {
+	productID, err := parseID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Неверный ID продукта",
+		})
+		return
+	}
+	workshopID, err := parseID(c.Param("workshop_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Неверный ID цеха",
+		})
+		return
+	}
+
+	var req UpdateWorkshopTimeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	input := WorkshopInput{WorkshopID: workshopID, ProductionTime: req.ProductionTime}
+	if err := s.checkProductionTimes([]WorkshopInput{input}); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	total, err := UpdateWorkshopTime(c.Request.Context(), s.pool, productID, workshopID, req.ProductionTime, s.totals)
+	switch {
+	case errors.Is(err, ErrWorkshopNotLinked):
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": fmt.Sprintf("Цеха %d нет в маршруте продукта", workshopID),
+		})
+		return
+	case err != nil:
+		respondError(c, err, "Не удалось изменить время цеха")
+		return
+	}
+
+	respondOK(c, gin.H{
+		"product_id":            productID,
+		"workshop_id":           workshopID,
+		"production_time":       req.ProductionTime,
+		"total_production_time": total,
+	}, nil)
+}
+
+// ReplaceWorkshopsRequest - новый маршрут продукта целиком
+type ReplaceWorkshopsRequest struct {
+	Workshops []json.RawMessage `json:"workshops"` // []WorkshopInput, разбираются через decodeBatch
+}
+
+// PUT /api/products/:id/workshops - заменить маршрут продукта целиком
+func (s *Server) ReplaceProductWorkshopsHandler(c *gin.Context) {
+	productID, err := parseID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Неверный ID продукта",
+		})
+		return
+	}
+
+	var req ReplaceWorkshopsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	route, elementErrors := decodeBatch[WorkshopInput](req.Workshops)
+	if len(elementErrors) > 0 {
+		respondBatchErrors(c, elementErrors)
+		return
+	}
+	if err := s.checkWorkshopCount(route); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err := s.checkProductionTimes(route); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	total, err := ReplaceProductWorkshops(c.Request.Context(), s.pool, productID, route, s.totals)
+	switch {
+	case respondWorkshopInputError(c, err):
+		return
+	case err != nil:
+		respondError(c, err, "Не удалось обновить цеха продукта")
+		return
+	}
+
+	workshops, err := GetProductWorkshops(c.Request.Context(), s.pool, productID, 0, 0)
+	if err != nil {
+		respondError(c, err, "Цеха обновлены, но не удалось их получить")
+		return
+	}
+
+	respondOK(c, workshops, gin.H{
+		"product_id":            productID,
+		"total_production_time": total,
+	})
+}
+
+// PATCH /api/products/:id/workshops - добавить или обновить часть цехов, не присылая маршрут целиком.
+// Тело как у PUT; цеха, которых нет в запросе, остаются как были
+func (s *Server) MergeProductWorkshopsHandler(c *gin.Context) {
+	productID, err := parseID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Неверный ID продукта",
+		})
+		return
+	}
+
+	var req ReplaceWorkshopsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	changes, elementErrors := decodeBatch[WorkshopInput](req.Workshops)
+	if len(elementErrors) > 0 {
+		respondBatchErrors(c, elementErrors)
+		return
+	}
+	if len(changes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Передайте хотя бы один цех",
+		})
+		return
+	}
+	if err := s.checkWorkshopCount(changes); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err := s.checkProductionTimes(changes); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	total, err := MergeProductWorkshops(c.Request.Context(), s.pool, productID, changes, s.maxWorkshops, s.totals)
+	switch {
+	case errors.Is(err, ErrTooManyWorkshops):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": err.Error(),
+		})
+		return
+	case respondWorkshopInputError(c, err):
+		return
+	case err != nil:
+		respondError(c, err, "Не удалось обновить цеха продукта")
+		return
+	}
+
+	workshops, err := GetProductWorkshops(c.Request.Context(), s.pool, productID, 0, 0)
+	if err != nil {
+		respondError(c, err, "Цеха обновлены, но не удалось их получить")
+		return
+	}
+
+	respondOK(c, workshops, gin.H{
+		"product_id":            productID,
+		"total_production_time": total,
+	})
+}
+
+// WorkshopOrderRequest - новый порядок цехов в маршруте
+type WorkshopOrderRequest struct {
+	WorkshopIDs []int `json:"workshop_ids" binding:"required"`
+}
+
+// PUT /api/products/:id/workshop-order - переупорядочить шаги маршрута
+func (s *Server) ReorderWorkshopsHandler(c *gin.Context) {
+	productID, err := parseID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Неверный ID продукта",
+		})
+		return
+	}
+
+	var req WorkshopOrderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	err = ReorderProductWorkshops(c.Request.Context(), s.pool, productID, req.WorkshopIDs)
+	if errors.Is(err, ErrWorkshopOrderMismatch) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		respondError(c, err, "Не удалось изменить порядок цехов")
+		return
+	}
+
+	workshops, err := GetProductWorkshops(c.Request.Context(), s.pool, productID, 0, 0)
+	if err != nil {
+		respondError(c, err, "Порядок изменён, но не удалось получить цеха")
+		return
+	}
+
+	respondOK(c, workshops, gin.H{
+		"product_id": productID,
+	})
+}
+
+// GET /api/products/:id/similar - похожие продукты (тот же тип и материал, близкая цена)
+func (s *Server) GetSimilarProductsHandler(c *gin.Context) {
+	productID, err := parseID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Неверный ID продукта",
+		})
+		return
+	}
+
+	products, err := GetSimilarProducts(c.Request.Context(), s.pool, productID)
+	if err != nil {
+		respondError(c, err, "Не удалось найти похожие продукты")
+		return
+	}
+
+	respondOK(c, products, gin.H{
+		"count": len(products),
+	})
+}
+
+// GET /api/product-types/:id/suggested-material - материал для предвыбора в форме нового продукта.
+// 204, если у типа ещё нет продуктов и подсказывать не из чего
+func (s *Server) SuggestedMaterialHandler(c *gin.Context) {
+	typeID, err := parseID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Неверный ID типа продукции",
+		})
+		return
+	}
+
+	suggestion, err := SuggestMaterialForType(c.Request.Context(), s.pool, typeID)
+	if errors.Is(err, ErrProductTypeNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Тип продукции не найден",
+		})
+		return
+	}
+	if err != nil {
+		respondError(c, err, "Не удалось подобрать материал")
+		return
+	}
+	if suggestion == nil {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	respondOK(c, suggestion, nil)
+}
+
+// SetTypeParentRequest - новый родитель типа; null - перенести на верхний уровень
+type SetTypeParentRequest struct {
+	ParentID *int `json:"parent_id" binding:"omitempty,gt=0"`
+}
+
+// PUT /api/product-types/:id/parent - перенести тип в иерархии подкатегорий.
+// 422 с cycle, если тип оказался бы собственным предком (в том числе родителем самого себя)
+func (s *Server) SetProductTypeParentHandler(c *gin.Context) {
+	typeID, err := parseID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Неверный ID типа продукции",
+		})
+		return
+	}
+
+	var input SetTypeParentRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	updated, err := SetProductTypeParent(c.Request.Context(), s.pool, typeID, input.ParentID)
+	var cycleErr *TypeCycleError
+	switch {
+	case errors.As(err, &cycleErr):
+		respondJSON(c, http.StatusUnprocessableEntity, gin.H{
+			"error": "Тип не может стать собственным предком",
+			"cycle": cycleErr.Path,
+		})
+		return
+	case errors.Is(err, ErrParentTypeNotFound):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": fmt.Sprintf("Родительский тип %d не найден", *input.ParentID),
+		})
+		return
+	case errors.Is(err, ErrProductTypeNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Тип продукции не найден",
+		})
+		return
+	case err != nil:
+		respondError(c, err, "Не удалось изменить родителя типа")
+		return
+	}
+
+	s.refs.invalidate("types")
+	respondOK(c, updated, nil)
+}
+
+// ValidateArticleRequest - артикул для проверки формата
+type ValidateArticleRequest struct {
+	Article string `json:"article"`
+}
+
+// POST /api/articles/validate - проверить артикул по ARTICLE_PATTERN, не создавая продукт.
+// Занятость артикула не проверяется - только формат
+func (s *Server) ValidateArticleHandler(c *gin.Context) {
+	var req ValidateArticleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	article := normalizeArticle(req.Article)
+	pattern := ""
+	if s.articlePattern != nil {
+		pattern = s.articlePattern.String()
+	}
+	result := gin.H{
+		"article": article,
+		"valid":   true,
+		"pattern": pattern,
+	}
+	if article == "" {
+		result["valid"] = false
+		result["reason"] = "артикул пустой"
+	} else if err := s.checkArticle(article); err != nil {
+		result["valid"] = false
+		result["reason"] = err.Error()
+	}
+
+	respondOK(c, result, nil)
+}
+
+// maxBatchGetIDs - сколько продуктов можно запросить одним /api/products/batch-get
+const maxBatchGetIDs = 100
+
+// BatchGetRequest - id продуктов, которые нужно получить
+type BatchGetRequest struct {
+	IDs []int `json:"ids" binding:"required"`
+}
+
+// POST /api/products/batch-get - несколько продуктов одним запросом, в порядке ids.
+// Отсутствующие id не ошибка: они перечислены в meta.missing
+func (s *Server) BatchGetProductsHandler(c *gin.Context) {
+	var req BatchGetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if len(req.IDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "ids не может быть пустым",
+		})
+		return
+	}
+	if len(req.IDs) > maxBatchGetIDs {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("Слишком много id: %d, максимум %d", len(req.IDs), maxBatchGetIDs),
+		})
+		return
+	}
+	seen := make(map[int]bool, len(req.IDs))
+	for _, id := range req.IDs {
+		if id <= 0 || id > maxDBID {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("Неверный id %d", id),
+			})
+			return
+		}
+		if seen[id] {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("id %d указан дважды", id),
+			})
+			return
+		}
+		seen[id] = true
+	}
+
+	products, err := GetProductsByIDs(c.Request.Context(), s.pool, req.IDs)
+	if err != nil {
+		respondError(c, err, "Не удалось получить продукты")
+		return
+	}
+
+	// Запрос отдаёт строки по id, клиенту нужен его порядок
+	byID := make(map[int]ProductWithTime, len(products))
+	for _, p := range products {
+		byID[p.ID] = p
+	}
+	found := make([]ProductWithTime, 0, len(products))
+	missing := []int{}
+	for _, id := range req.IDs {
+		if p, ok := byID[id]; ok {
+			found = append(found, p)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+
+	respondOK(c, found, gin.H{
+		"count":   len(found),
+		"missing": missing,
+	})
+}
+
+// maxByArticles - сколько артикулов можно сверить одним /api/products/by-articles
+const maxByArticles = 1000
+
+// ByArticlesRequest - артикулы для сверки с каталогом
+type ByArticlesRequest struct {
+	Articles []string `json:"articles" binding:"required"`
+}
+
+// POST /api/products/by-articles - сверка отсканированных на складе артикулов с каталогом.
+// data - найденные продукты по артикулу, meta.missing - артикулы, которых в каталоге нет.
+// Артикулы нормализуются как при сохранении (без пробелов по краям, в верхнем регистре),
+// ключи data и missing - в нормализованном виде; повторы схлопываются
+func (s *Server) GetProductsByArticlesHandler(c *gin.Context) {
+	var req ByArticlesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if len(req.Articles) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "articles не может быть пустым",
+		})
+		return
+	}
+	if len(req.Articles) > maxByArticles {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("Слишком много артикулов: %d, максимум %d", len(req.Articles), maxByArticles),
+		})
+		return
+	}
+
+	articles := make([]string, 0, len(req.Articles))
+	seen := make(map[string]bool, len(req.Articles))
+	for i, raw := range req.Articles {
+		article := normalizeArticle(raw)
+		if article == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("Пустой артикул в позиции %d", i),
+			})
+			return
+		}
+		if !seen[article] {
+			seen[article] = true
+			articles = append(articles, article)
+		}
+	}
+
+	products, err := GetProductsByArticles(c.Request.Context(), s.pool, articles)
+	if err != nil {
+		respondError(c, err, "Не удалось получить продукты")
+		return
+	}
+
+	found := make(map[string]ProductWithTime, len(products))
+	for _, p := range products {
+		found[normalizeArticle(p.Article)] = p
+	}
+	missing := []string{}
+	for _, article := range articles {
+		if _, ok := found[article]; !ok {
+			missing = append(missing, article)
+		}
+	}
+
+	respondOK(c, found, gin.H{
+		"count":   len(found),
+		"missing": missing,
+	})
+}
+
+// maxCompareProducts - сколько продуктов можно сравнить за один запрос
+const maxCompareProducts = 10
+
+// GET /api/products/compare?ids=1,2,3
+func (s *Server) CompareProductsHandler(c *gin.Context) {
+	ids, err := ParseIDList(c.Query("ids"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if len(ids) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Укажите id продуктов в параметре ids",
+		})
+		return
+	}
+	if len(ids) > maxCompareProducts {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("Можно сравнить не больше %d продуктов", maxCompareProducts),
+		})
+		return
+	}
+
+	products, err := GetProductsByIDs(c.Request.Context(), s.pool, ids)
+	if err != nil {
+		respondError(c, err, "Не удалось получить продукты")
+		return
+	}
+
+	workshops, err := GetWorkshopsByProductIDs(c.Request.Context(), s.pool, ids)
+	if err != nil {
+		respondError(c, err, "Не удалось получить цеха продуктов")
+		return
+	}
+
+	// Собираем ответ в порядке запрошенных id
+	byID := make(map[int]ProductWithTime, len(products))
+	for _, p := range products {
+		byID[p.ID] = p
+	}
+
+	compared := []ProductWithWorkshops{}
+	notFound := []int{}
+	for _, id := range ids {
+		p, ok := byID[id]
+		if !ok {
+			notFound = append(notFound, id)
+			continue
+		}
+		pw := workshops[id]
+		if pw == nil {
+			pw = []ProductWorkshop{}
+		}
+		compared = append(compared, ProductWithWorkshops{ProductWithTime: p, Workshops: pw})
+	}
+
+	respondOK(c, compared, gin.H{
+		"not_found": notFound,
+	})
+}
+
+// POST /api/products[?unique_by=article]
+// С unique_by=article (или заголовком If-None-Match: *) продукт создаётся, только если артикула
+// ещё нет; иначе 409 с уже существующим продуктом. В отличие от upsert существующие строки не меняются
+func (s *Server) CreateProductHandler(c *gin.Context) {
+	var input CreateProductInput
+
+	uniqueByArticle := c.GetHeader("If-None-Match") == "*"
+	switch c.Query("unique_by") {
+	case "":
+	case "article":
+		uniqueByArticle = true
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "unique_by поддерживает только article",
+		})
+		return
+	}
+
+	// Валидация JSON
+	if err := c.ShouldBindJSON(&input); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	// Сгенерированный артикул всегда новый - проверять было бы нечего
+	if uniqueByArticle && normalizeArticle(input.Article) == "" {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": "При unique_by=article нужно передать article",
+		})
+		return
+	}
+	if err := s.checkArticle(input.Article); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err := s.checkProductName(input.ProductName); err != nil {
+		respondProductNameError(c, err)
+		return
+	}
+
+	// Создание продукта
+	result, err := CreateProduct(c.Request.Context(), s.pool, input, s.articlePattern)
+	if errors.Is(err, ErrInvalidPricing) || errors.Is(err, ErrUnknownReference) || errors.Is(err, ErrInvalidReference) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if errors.Is(err, ErrArticleTaken) && uniqueByArticle {
+		s.respondArticleConflict(c, input.Article, err)
+		return
+	}
+	var dupErr *DuplicateProductError
+	if errors.As(err, &dupErr) {
+		s.respondDuplicateProduct(c, dupErr)
+		return
+	}
+	if errors.Is(err, ErrArticleTaken) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		respondError(c, err, "Не удалось создать продукт")
+		return
+	}
+
+	// Получаем созданный продукт
+	product, err := GetProductByID(c.Request.Context(), s.pool, result.ProductID)
+	if err != nil {
+		respondError(c, err, "Продукт создан, но не удалось получить его данные")
+		return
+	}
+
+	s.webhooks.send(c.Request.Context(), webhookProductCreated, result.ProductID)
+	respond(c, http.StatusCreated, product, gin.H{
+		"warnings": result.Warnings,
+	})
+}
+
+// batchElementError - ошибка в одном элементе пакетного запроса
+type batchElementError struct {
+	Index     int    `json:"index"`           // с нуля, как в JSON-массиве
+	Field     string `json:"field,omitempty"` // имя поля из JSON
+	Error     string `json:"error"`
+	malformed bool   // элемент не разобрался как JSON (400), иначе не прошёл проверки (422)
+}
+
+// decodeBatch разбирает и проверяет (binding-теги) каждый элемент массива отдельно.
+// В отличие от binding:"dive" не останавливается на первой ошибке и не пропускает null
+func decodeBatch[T any](raw []json.RawMessage) ([]T, []batchElementError) {
+	items := make([]T, len(raw))
+	var errs []batchElementError
+	for i, element := range raw {
+		if string(bytes.TrimSpace(element)) == "null" {
+			errs = append(errs, batchElementError{Index: i, Error: "элемент не может быть null", malformed: true})
+			continue
+		}
+		if err := json.Unmarshal(element, &items[i]); err != nil {
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) {
+				errs = append(errs, batchElementError{Index: i, Field: typeErr.Field, Error: "ожидается " + typeErr.Type.String(), malformed: true})
+			} else {
+				errs = append(errs, batchElementError{Index: i, Error: "неверный JSON: " + err.Error(), malformed: true})
+			}
+			continue
+		}
+
+		err := binding.Validator.ValidateStruct(&items[i])
+		var fieldErrors validator.ValidationErrors
+		if errors.As(err, &fieldErrors) {
+			for _, fe := range fieldErrors {
+				errs = append(errs, batchElementError{Index: i, Field: fe.Field(), Error: describeValidation(fe)})
+			}
+		} else if err != nil {
+			errs = append(errs, batchElementError{Index: i, Error: err.Error()})
+		}
+	}
+	return items, errs
+}
+
+// describeValidation переводит проверку из binding-тега в сообщение для пользователя
+func describeValidation(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "обязательное поле"
+	case "gt":
+		return "должно быть больше " + fe.Param()
+	case "gte":
+		return "должно быть не меньше " + fe.Param()
+	case "http_url":
+		return "должно быть ссылкой http(s)"
+	case "required_without":
+		return "обязательное поле, если не указано " + snakeCase(fe.Param())
+	case "excluded_with":
+		return "нельзя указывать вместе с " + snakeCase(fe.Param())
+	default:
+		return "не проходит проверку " + fe.Tag()
+	}
+}
+
+// snakeCase переводит имя поля Go из параметра тега (MaterialName) в имя JSON (material_name)
+func snakeCase(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// APIError - тело ответа с ошибкой, как во всём API: {"error": "..."}
+type APIError struct {
+	Message string `json:"error"`
+}
+
+// errorStatuses - ошибки репозитория и их HTTP-статусы, проверяются по errors.Is по порядку.
+// Пустое message - отдать текст самой ошибки: в нём подробности (лимит, номер строки пакета).
+// Новая ошибка репозитория добавляется сюда одной строкой
+var errorStatuses = []struct {
+	target  error
+	status  int
+	message string
+}{
+	{ErrProductNotFound, http.StatusNotFound, "Продукт не найден"},
+	{ErrProductTypeNotFound, http.StatusNotFound, "Тип продукции не найден"},
+	{ErrWorkshopNotLinked, http.StatusNotFound, ""},
+	{ErrInvalidProductID, http.StatusBadRequest, "Неверный ID продукта"},
+	{ErrWorkshopOrderMismatch, http.StatusBadRequest, ""},
+	{ErrResponseTooLarge, http.StatusBadRequest, ""},
+	{ErrArticleTaken, http.StatusConflict, ""},
+	{ErrDuplicateProduct, http.StatusConflict, ""},
+	{ErrProductTypeExists, http.StatusConflict, ""},
+	{ErrWorkshopAlreadyLinked, http.StatusConflict, ""},
+	{ErrWorkshopNotFound, http.StatusUnprocessableEntity, ""},
+	{ErrTooManyWorkshops, http.StatusUnprocessableEntity, ""},
+	{ErrUnknownReference, http.StatusUnprocessableEntity, ""},
+	{ErrInvalidReference, http.StatusUnprocessableEntity, ""},
+	{ErrInvalidPricing, http.StatusUnprocessableEntity, ""},
+	{ErrParentTypeNotFound, http.StatusUnprocessableEntity, ""},
+	{ErrMaterialNotFound, http.StatusUnprocessableEntity, ""},
+	{ErrPriceBelowCost, http.StatusUnprocessableEntity, ""},
+	{ErrGeneratedArticleMismatch, http.StatusUnprocessableEntity, ""},
+}
+
+// pgErrorStatuses - ошибки postgres по SQLSTATE, которые не превратились в ошибку репозитория
+var pgErrorStatuses = map[string]struct {
+	status  int
+	message string
+}{
+	"23505": {http.StatusConflict, "Запись с такими данными уже существует"},                             // unique_violation
+	"23503": {http.StatusUnprocessableEntity, "Ссылка на несуществующую запись"},                         // foreign_key_violation
+	"40001": {http.StatusConflict, "Данные одновременно изменил другой запрос, повторите попытку"},       // serialization_failure
+	"40P01": {http.StatusConflict, "Данные одновременно изменил другой запрос, повторите попытку"},       // deadlock_detected
+	"57014": {http.StatusServiceUnavailable, "Запрос к БД выполнялся слишком долго (STATEMENT_TIMEOUT)"}, // query_canceled
+}
+
+// statusForError - единая таблица "ошибка -> HTTP-статус и тело". Неизвестная ошибка - 500
+// с пустым Message: текст для пользователя знает только ручка (см. respondError)
+func statusForError(err error) (int, APIError) {
+	for _, e := range errorStatuses {
+		if errors.Is(err, e.target) {
+			if e.message == "" {
+				return e.status, APIError{Message: err.Error()}
+			}
+			return e.status, APIError{Message: e.message}
+		}
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		if e, ok := pgErrorStatuses[pgErr.Code]; ok {
+			return e.status, APIError{Message: e.message}
+		}
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || pgconn.Timeout(err) {
+		return http.StatusServiceUnavailable, APIError{Message: "Превышено время ожидания ответа БД"}
+	}
+
+	return http.StatusInternalServerError, APIError{}
+}
+
+// respondError отвечает на ошибку репозитория по statusForError. message - что сказать
+// пользователю, если ошибка не из таблицы ("Не удалось получить продукт"). 5xx пишутся в лог
+// вместе с методом и путём запроса (в пути - id)
+func respondError(c *gin.Context, err error, message string) {
+	status, body := statusForError(err)
+	if body.Message == "" {
+		body.Message = message
+	}
+	if status >= http.StatusInternalServerError {
+		log.Printf("%s %s: %s: %v", c.Request.Method, c.Request.URL.Path, message, err)
+	}
+	respondJSON(c, status, body)
+}
+
+// fieldError - поле тела запроса, не прошедшее проверку
+type fieldError struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+// respondBindError отвечает на ошибку ShouldBindJSON. Тело, которое не разбирается как JSON
+// (синтаксис, не тот тип поля) - 400. Корректный JSON, не прошедший binding-теги, - 422
+// со списком полей: клиент различает "сломанный запрос" и "неверные значения"
+func respondBindError(c *gin.Context, err error) {
+	var fieldErrors validator.ValidationErrors
+	if !errors.As(err, &fieldErrors) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	fields := make([]fieldError, len(fieldErrors))
+	for i, fe := range fieldErrors {
+		// Namespace без имени корневой структуры: workshops[0].workshop_id
+		field := fe.Namespace()
+		if _, rest, ok := strings.Cut(field, "."); ok {
+			field = rest
+		}
+		fields[i] = fieldError{Field: field, Error: describeValidation(fe)}
+	}
+	respondJSON(c, http.StatusUnprocessableEntity, gin.H{
+		"error":  "Неверные данные: " + err.Error(),
+		"fields": fields,
+	})
+}
+
+// respondBatchErrors отвечает списком ошибок по элементам: 400, если хоть один элемент
+// не разобрался как JSON, иначе 422
+func respondBatchErrors(c *gin.Context, errs []batchElementError) {
+	status := http.StatusUnprocessableEntity
+	for _, e := range errs {
+		if e.malformed {
+			status = http.StatusBadRequest
+			break
+		}
+	}
+	respondJSON(c, status, gin.H{
+		"error":  fmt.Sprintf("Неверные данные в %d элементах", countErrorIndexes(errs)),
+		"errors": errs,
+	})
+}
+
+func countErrorIndexes(errs []batchElementError) int {
+	seen := map[int]bool{}
+	for _, e := range errs {
+		seen[e.Index] = true
+	}
+	return len(seen)
+}
+
+// jsonFieldName - имя поля для ошибок валидации: из json-тега, а не имя Go-поля
+func jsonFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// maxUpsertBatch - максимум строк в одном запросе upsert
+const maxUpsertBatch = 1000
+
+// UpsertProductsRequest - пакет продуктов для upsert по артикулу
+// Элементы разбираются по одному (decodeBatch), чтобы сообщить обо всех ошибках с индексами
+type UpsertProductsRequest struct {
+	Products []json.RawMessage `json:"products" binding:"required"` // []CreateProductInput
+}
+
+// POST /api/products/upsert?confirm=true - идемпотентный импорт: существующие артикулы обновляются.
+// Если импорт сильно меняет большую часть обновляемых цен (PRICE_GUARD_MAX_SHARE/PRICE_GUARD_MAX_CHANGE),
+// он откатывается с 422 и примерами изменений; confirm=true применяет его без этой проверки
+func (s *Server) UpsertProductsHandler(c *gin.Context) {
+	confirmed := false
+	if raw := c.Query("confirm"); raw != "" {
+		var err error
+		confirmed, err = strconv.ParseBool(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "confirm должен быть true или false",
+			})
+			return
+		}
+	}
+
+	var req UpsertProductsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if len(req.Products) > maxUpsertBatch {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("Слишком много строк: %d, максимум %d", len(req.Products), maxUpsertBatch),
+		})
+		return
+	}
+
+	products, elementErrors := decodeBatch[CreateProductInput](req.Products)
+	for i, p := range products {
+		if err := s.checkArticle(p.Article); err != nil {
+			elementErrors = append(elementErrors, batchElementError{Index: i, Field: "article", Error: err.Error()})
+		}
+		if err := s.checkProductName(p.ProductName); err != nil {
+			elementErrors = append(elementErrors, batchElementError{Index: i, Field: "product_name", Error: err.Error()})
+		}
+	}
+	sort.SliceStable(elementErrors, func(a, b int) bool { return elementErrors[a].Index < elementErrors[b].Index })
+	if len(elementErrors) > 0 {
+		respondBatchErrors(c, elementErrors)
+		return
+	}
+
+	guard := s.priceGuard
+	if confirmed {
+		guard = nil
+	}
+	result, err := UpsertProducts(c.Request.Context(), s.pool, products, guard, s.articlePattern)
+	var guardErr *PriceGuardError
+	if errors.As(err, &guardErr) {
+		respondJSON(c, http.StatusUnprocessableEntity, gin.H{
+			"error":        "Импорт отменён: " + guardErr.Error() + ". Если так и задумано, повторите с confirm=true",
+			"price_change": guardErr,
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Ошибка upsert продуктов: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Импорт отменён: " + err.Error(),
+		})
+		return
+	}
+
+	respondOK(c, result, nil)
+}
+
+// respondArticleConflict отвечает 409 вместе с продуктом, который уже занял артикул.
+// Проверки "есть ли артикул" до вставки нет: её решает уникальный индекс, так что и при гонке
+// двух одинаковых запросов создастся ровно один продукт
+func (s *Server) respondArticleConflict(c *gin.Context, article string, conflictErr error) {
+	existing, err := GetProductByArticle(c.Request.Context(), s.pool, article)
+	if err != nil || len(existing) == 0 {
+		if err != nil {
+			log.Printf("Ошибка получения продукта по артикулу %s: %v", article, err)
+		}
+		c.JSON(http.StatusConflict, gin.H{
+			"error": conflictErr.Error(),
+		})
+		return
+	}
+
+	respondJSON(c, http.StatusConflict, gin.H{
+		"error": conflictErr.Error(),
+		"data":  existing[0],
+	})
+}
+
+// respondDuplicateProduct отвечает 409 на повтор составного ключа, называя существующий продукт
+// и отдавая его в data, как respondArticleConflict
+func (s *Server) respondDuplicateProduct(c *gin.Context, dupErr *DuplicateProductError) {
+	existing, err := FindProductByNameAndRefs(c.Request.Context(), s.pool, dupErr.ProductName, dupErr.MaterialID, dupErr.TypeID)
+	if err != nil || existing == nil {
+		if err != nil {
+			log.Printf("Ошибка поиска продукта-дубликата %q: %v", dupErr.ProductName, err)
+		}
+		c.JSON(http.StatusConflict, gin.H{
+			"error": dupErr.Error(),
+		})
+		return
+	}
+
+	respondJSON(c, http.StatusConflict, gin.H{
+		"error": fmt.Sprintf("Продукт «%s» (id %d, артикул %s) с таким материалом и типом уже существует",
+			existing.ProductName, existing.ID, existing.Article),
+		"data": existing,
+	})
+}
+
+// POST /api/products/with-workshops
+func (s *Server) CreateProductWithWorkshopsHandler(c *gin.Context) {
+	var input CreateProductWithWorkshopsInput
+
+	// Валидация JSON
+	if err := c.ShouldBindJSON(&input); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if err := validateProductRefs(input.MaterialID, input.TypeID, input.Workshops); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+	if err := s.checkWorkshopCount(input.Workshops); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err := s.checkArticle(input.Article); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err := s.checkProductName(input.ProductName); err != nil {
+		respondProductNameError(c, err)
+		return
+	}
+	if err := s.checkProductionTimes(input.Workshops); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Создание продукта с цехами в транзакции
+	result, err := CreateProductWithWorkshops(c.Request.Context(), s.pool, input, s.articlePattern)
+	if respondWorkshopInputError(c, err) {
+		return
+	}
+	if errors.Is(err, ErrInvalidPricing) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if errors.Is(err, ErrArticleTaken) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		respondError(c, err, "Не удалось создать продукт: "+err.Error())
+		return
+	}
+
+	// Продукт с маршрутом собран в транзакции создания - повторно из БД не читаем.
+	// workshops_created - квитанция для импорта: цеха не пропускаются молча (дубль - 409,
+	// несуществующий - 422, продукт тогда не создаётся), поэтому число всегда равно длине маршрута
+	s.webhooks.send(c.Request.Context(), webhookProductCreated, result.ProductID)
+	respond(c, http.StatusCreated, ProductWithWorkshops{ProductWithTime: result.Product, Workshops: result.Workshops}, gin.H{
+		"warnings":          result.Warnings,
+		"workshops_created": len(result.Workshops),
+	})
+}
+
+// удаление DELEte /api/products:id
+func (s *Server) DeleteById(c *gin.Context) {
+	product_id, err := parseProductID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "неверный id"})
+		return
+	}
+	// ?idempotent=true - для клиентов с повторами (очереди): итог "продукта нет" достигнут
+	// в любом случае, поэтому 204 и для уже удалённого продукта
+	idempotent := false
+	if raw := c.Query("idempotent"); raw != "" {
+		idempotent, err = strconv.ParseBool(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "idempotent должен быть true или false"})
+			return
+		}
+	}
+	linksRemoved, err := DeleteById(c.Request.Context(), s.pool, product_id, requestActor(c))
+	if errors.Is(err, ErrProductNotFound) {
+		if idempotent {
+			c.Status(http.StatusNoContent)
+			return
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": "Продукт не найден"})
+		return
+	}
+	if err != nil {
+		log.Printf("Ошибка удаления продукта %d: %v", product_id, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "чет в бдшке сломалось при удалении"})
+		return
+	}
+	s.webhooks.send(c.Request.Context(), webhookProductDeleted, product_id)
+	if idempotent {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	respondJSON(c, http.StatusOK, gin.H{"message": "удалено успешно", "workshop_links_removed": linksRemoved})
+
+}
+
+// maxActorLength - как deleted_by VARCHAR(255) в product_deletions
+const maxActorLength = 255
+
+// requestActor - кто выполняет запрос, для журнала удалений. Полноценной авторизации нет,
+// поэтому это заголовок X-User (его ставит прокси или клиент); без заголовка - пусто
+func requestActor(c *gin.Context) string {
+	actor := []rune(strings.TrimSpace(c.GetHeader("X-User")))
+	if len(actor) > maxActorLength {
+		actor = actor[:maxActorLength]
+	}
+	return string(actor)
+}
+
+// GET /api/admin/deletions?limit=50&offset=0 - журнал удалений продуктов, последние первыми
+func (s *Server) GetDeletionsHandler(c *gin.Context) {
+	limit, offset, paginated, err := s.parsePagination(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if !paginated {
+		limit = s.defaultPageSize
+	}
+
+	deletions, err := GetRecentDeletions(c.Request.Context(), s.pool, limit, offset)
+	if err != nil {
+		respondError(c, err, "Не удалось получить журнал удалений")
+		return
+	}
+
+	respondOK(c, deletions, gin.H{
+		"count":  len(deletions),
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+// SetActiveRequest - включить/выключить продукт
+type SetActiveRequest struct {
+	IsActive *bool `json:"is_active" binding:"required"`
+}
+
+// PATCH /api/products/:id/active - временно скрыть продукт или вернуть его в каталог
+func (s *Server) SetProductActiveHandler(c *gin.Context) {
+	productID, err := parseID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Неверный ID продукта",
+		})
+		return
+	}
+
+	var req SetActiveRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	err = SetProductActive(c.Request.Context(), s.pool, productID, *req.IsActive)
+	if err != nil {
+		respondError(c, err, "Не удалось изменить активность продукта")
+		return
+	}
+
+	product, err := GetProductByID(c.Request.Context(), s.pool, productID)
+	if err != nil {
+		respondError(c, err, "Активность изменена, но не удалось получить продукт")
+		return
+	}
+
+	respondOK(c, product, nil)
+}
+
+// SwapArticlesRequest - два продукта, артикулы которых перепутаны при вводе
+type SwapArticlesRequest struct {
+	FirstID  int `json:"first_id" binding:"required,gt=0"`
+	SecondID int `json:"second_id" binding:"required,gt=0"`
+}
+
+// POST /api/products/swap-articles - поменять артикулы двух продуктов местами.
+// По одному их не исправить: промежуточный шаг упирается в уникальность артикула
+func (s *Server) SwapArticlesHandler(c *gin.Context) {
+	var req SwapArticlesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if req.FirstID > maxDBID || req.SecondID > maxDBID {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Неверный ID продукта",
+		})
+		return
+	}
+	if req.FirstID == req.SecondID {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "first_id и second_id должны быть разными продуктами",
+		})
+		return
+	}
+
+	err := SwapProductArticles(c.Request.Context(), s.pool, req.FirstID, req.SecondID)
+	if errors.Is(err, ErrProductNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		respondError(c, err, "Не удалось поменять артикулы")
+		return
+	}
+
+	products, err := GetProductsByIDs(c.Request.Context(), s.pool, []int{req.FirstID, req.SecondID})
+	if err != nil {
+		respondError(c, err, "Артикулы изменены, но не удалось получить продукты")
+		return
+	}
+
+	respondOK(c, products, nil)
+}
+
+// SetMaterialRequest - новый материал продукта
+type SetMaterialRequest struct {
+	MaterialID int `json:"material_id" binding:"required,gt=0"`
+}
+
+// PATCH /api/products/:id/material - сменить материал продукта. При PRICE_ABOVE_COST=true
+// цена должна оставаться не ниже себестоимости нового материала, иначе 422 и материал не меняется
+// Флаг проверяет только этот путь: цены, записанные созданием, upsert или импортом, не сверяются с себестоимостью
+func (s *Server) SetProductMaterialHandler(c *gin.Context) {
+	productID, err := parseID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Неверный ID продукта",
+		})
+		return
+	}
+
+	var req SetMaterialRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if req.MaterialID > maxDBID {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Неверный material_id",
+		})
+		return
+	}
+
+	err = SetProductMaterial(c.Request.Context(), s.pool, productID, req.MaterialID, s.priceAboveCost)
+	if err != nil {
+		respondError(c, err, "Не удалось изменить материал продукта")
+		return
+	}
+
+	product, err := GetProductByID(c.Request.Context(), s.pool, productID)
+	if err != nil {
+		respondError(c, err, "Материал изменён, но не удалось получить продукт")
+		return
+	}
+
+	respondOK(c, product, nil)
+}
+
+// ScaleTimesRequest - запрос на масштабирование времени цехов продукта
+type ScaleTimesRequest struct {
+	Factor float64 `json:"factor" binding:"required,gt=0"`
+}
+
+// POST /api/products/:id/scale-times - умножить время всех цехов продукта на factor
+func (s *Server) ScaleTimesHandler(c *gin.Context) {
+	productID, err := parseID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Неверный ID продукта",
+		})
+		return
+	}
+
+	var req ScaleTimesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	total, err := ScaleProductionTimes(c.Request.Context(), s.pool, productID, req.Factor, s.totals)
+	if err != nil {
+		respondError(c, err, "Не удалось изменить время производства")
+		return
+	}
+
+	respondOK(c, gin.H{
+		"product_id":            productID,
+		"factor":                req.Factor,
+		"total_production_time": total,
+	}, nil)
+}
+
+// POST /api/admin/recompute-times - пересчёт кешированного времени производства
+func (s *Server) RecomputeTimesHandler(c *gin.Context) {
+	updated, err := RecomputeProductionTimes(c.Request.Context(), s.pool)
+	if err != nil {
+		respondError(c, err, "Не удалось пересчитать время производства")
+		return
+	}
+
+	respondOK(c, gin.H{
+		"updated": updated,
+	}, nil)
+}
+
+// GET /api/workshops?sort=total_time&dir=desc&limit=5 - отчёт по загрузке цехов
+func (s *Server) GetWorkshopsReportHandler(c *gin.Context) {
+	sortField := c.DefaultQuery("sort", "name")
+	if _, ok := workshopReportSortColumns[sortField]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "sort должен быть одним из: name, product_count, total_time",
+		})
+		return
+	}
+
+	var desc bool
+	switch c.DefaultQuery("dir", "asc") {
+	case "asc":
+	case "desc":
+		desc = true
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "dir должен быть asc или desc",
+		})
+		return
+	}
+
+	limit := 0
+	if raw := c.Query("limit"); raw != "" {
+		var err error
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "limit должен быть положительным числом",
+			})
+			return
+		}
+	}
+
+	report, err := GetWorkshopUtilization(c.Request.Context(), s.pool, sortField, desc, limit)
+	if err != nil {
+		respondError(c, err, "Не удалось построить отчёт по цехам")
+		return
+	}
+
+	respondOK(c, report, gin.H{
+		"count": len(report),
+	})
+}
+
+// maxAssignProducts - сколько продуктов можно передать одним /api/workshops/:id/assign
+const maxAssignProducts = 1000
+
+// AssignWorkshopRequest - продукты, в маршрут которых добавляется цех
+type AssignWorkshopRequest struct {
+	ProductIDs     []int   `json:"product_ids" binding:"required"`
+	ProductionTime float64 `json:"production_time" binding:"required,gt=0"`
+	UpdateExisting bool    `json:"update_existing"` // где цех уже есть - обновить время, а не пропустить
+}
+
+// POST /api/workshops/:id/assign - добавить цех (например, новую отделку) в маршрут
+// сразу многим продуктам. Повторы id в product_ids игнорируются
+func (s *Server) AssignWorkshopHandler(c *gin.Context) {
+	workshopID, err := parseID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Неверный ID цеха",
+		})
+		return
+	}
+
+	var req AssignWorkshopRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if len(req.ProductIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "product_ids не может быть пустым",
+		})
+		return
+	}
+	if len(req.ProductIDs) > maxAssignProducts {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("Слишком много продуктов: %d, максимум %d", len(req.ProductIDs), maxAssignProducts),
+		})
+		return
+	}
+	productIDs := make([]int, 0, len(req.ProductIDs))
+	seen := make(map[int]bool, len(req.ProductIDs))
+	for _, id := range req.ProductIDs {
+		if id <= 0 || id > maxDBID {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("Неверный id продукта %d", id),
+			})
+			return
+		}
+		if !seen[id] {
+			seen[id] = true
+			productIDs = append(productIDs, id)
+		}
+	}
+	if err := s.checkProductionTimes([]WorkshopInput{{WorkshopID: workshopID, ProductionTime: req.ProductionTime}}); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	result, err := AssignWorkshop(c.Request.Context(), s.pool, workshopID, productIDs, req.ProductionTime, req.UpdateExisting, s.maxWorkshops)
+	switch {
+	case errors.Is(err, ErrWorkshopNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Цех не найден",
+		})
+		return
+	case errors.Is(err, ErrProductNotFound):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": err.Error(),
+		})
+		return
+	case err != nil:
+		respondError(c, err, "Не удалось добавить цех продуктам")
+		return
+	}
+
+	respondOK(c, result, gin.H{
+		"workshop_id": workshopID,
+	})
+}
+
+// GET /api/workshops/:id/products - продукты, проходящие через цех
+func (s *Server) GetWorkshopProductsHandler(c *gin.Context) {
+	workshopID, err := parseID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Неверный ID цеха",
+		})
+		return
+	}
+
+	products, err := GetWorkshopProducts(c.Request.Context(), s.pool, workshopID)
+	if errors.Is(err, ErrWorkshopNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Цех не найден",
+		})
+		return
+	}
+	if err != nil {
+		respondError(c, err, "Не удалось получить продукты цеха")
+		return
+	}
+
+	respondOK(c, products, gin.H{
+		"workshop_id": workshopID,
+		"count":       len(products),
+	})
+}
+
+// GET /api/materials/:id/dependencies - продукты, которые не дадут удалить материал.
+// Для диалога подтверждения: пустой список и can_delete = true - удалять безопасно
+func (s *Server) GetMaterialDependenciesHandler(c *gin.Context) {
+	materialID, err := parseID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Неверный ID материала",
+		})
+		return
+	}
+
+	products, err := GetMaterialDependencies(c.Request.Context(), s.pool, materialID)
+	if errors.Is(err, ErrMaterialNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Материал не найден",
+		})
+		return
+	}
+	if err != nil {
+		respondError(c, err, "Не удалось получить продукты материала")
+		return
+	}
+
+	respondOK(c, products, gin.H{
+		"material_id": materialID,
+		"count":       len(products),
+		"can_delete":  len(products) == 0,
+	})
+}
+
+// GET /api/stats/time-by-type - время производства по типам продукции
+func (s *Server) GetTimeByTypeHandler(c *gin.Context) {
+	stats, err := GetTimeByType(c.Request.Context(), s.pool)
+	if err != nil {
+		respondError(c, err, "Не удалось посчитать время по типам")
+		return
+	}
+
+	respondOK(c, stats, nil)
+}
+
+// GET /api/admin/orphans - продукты с несуществующими материалом или типом
+func (s *Server) GetOrphansHandler(c *gin.Context) {
+	report, err := FindOrphanProducts(c.Request.Context(), s.pool)
+	if err != nil {
+		respondError(c, err, "Не удалось проверить ссылки продуктов")
+		return
+	}
+
+	respondOK(c, report, nil)
+}
+
+// GET /api/admin/article-gaps - свободные номера в автоматических артикулах по префиксам
+func (s *Server) GetArticleGapsHandler(c *gin.Context) {
+	report, err := FindArticleGaps(c.Request.Context(), s.pool)
+	if err != nil {
+		respondError(c, err, "Не удалось проверить артикулы")
+		return
+	}
+
+	respondOK(c, report, nil)
+}
+
+// maxOrphanLinks - сколько связей без продукта показывать в одном ответе
+const maxOrphanLinks = 1000
+
+// GET /api/admin/orphan-links - связи products_workshop без продукта
+func (s *Server) GetOrphanLinksHandler(c *gin.Context) {
+	count, err := CountOrphanLinks(c.Request.Context(), s.pool)
+	if err != nil {
+		respondError(c, err, "Не удалось проверить связи с цехами")
+		return
+	}
+
+	links, err := FindOrphanLinks(c.Request.Context(), s.pool, maxOrphanLinks)
+	if err != nil {
+		respondError(c, err, "Не удалось проверить связи с цехами")
+		return
+	}
+
+	respondOK(c, links, gin.H{
+		"total":     count,
+		"count":     len(links),
+		"truncated": count > int64(len(links)),
+	})
+}
+
+// DELETE /api/admin/orphan-links - удалить связи без продукта, в ответе удалённые строки
+func (s *Server) DeleteOrphanLinksHandler(c *gin.Context) {
+	links, err := DeleteOrphanLinks(c.Request.Context(), s.pool)
+	if err != nil {
+		respondError(c, err, "Не удалось удалить связи без продукта")
+		return
+	}
+
+	log.Printf("Удалено %d связей products_workshop без продукта", len(links))
+	respondOK(c, links, gin.H{
+		"deleted": len(links),
+	})
+}
+
+// ReferenceSet - все справочники для формы продукта
+type ReferenceSet struct {
+	Materials []Material    `json:"materials"`
+	Types     []ProductType `json:"types"`
+	Workshops []Workshop    `json:"workshops"`
+}
+
+// loadReferences загружает справочники параллельно. Ошибка одного справочника
+// не отменяет остальные: в failed попадают имена тех, что не загрузились
+func (s *Server) loadReferences(ctx context.Context) (ReferenceSet, []string) {
+	var refs ReferenceSet
+	var materialsErr, typesErr, workshopsErr error
+
+	var g errgroup.Group
+	g.Go(func() error {
+		refs.Materials, materialsErr = s.refs.Materials(ctx)
+		return materialsErr
+	})
+	g.Go(func() error {
+		refs.Types, typesErr = s.refs.Types(ctx)
+		return typesErr
+	})
+	g.Go(func() error {
+		refs.Workshops, workshopsErr = s.refs.Workshops(ctx)
+		return workshopsErr
+	})
+	if g.Wait() == nil {
+		return refs, nil
+	}
+
+	var failed []string
+	for _, r := range []struct {
+		name string
+		err  error
+	}{
+		{"materials", materialsErr},
+		{"types", typesErr},
+		{"workshops", workshopsErr},
+	} {
+		if r.err != nil {
+			log.Printf("Ошибка загрузки справочника %s: %v", r.name, r.err)
+			failed = append(failed, r.name)
+		}
+	}
+	return refs, failed
+}
+
+// GET /api/reference - материалы, типы и цеха одним запросом (для генератора форм)
+func (s *Server) GetReferenceHandler(c *gin.Context) {
+	refs, failed := s.loadReferences(c.Request.Context())
+	if len(failed) > 0 {
+		// Загруженные справочники всё равно отдаём: форма может показать то, что есть
+		respondJSON(c, http.StatusInternalServerError, gin.H{
+			"error":  "Не удалось загрузить справочники: " + strings.Join(failed, ", "),
+			"failed": failed,
+			"data":   refs,
+		})
+		return
+	}
+
+	respondOK(c, refs, nil)
+}
+
+// GET /api/reports - список доступных отчётов и их параметров
+func (s *Server) ListReportsHandler(c *gin.Context) {
+	respondOK(c, reports, gin.H{
+		"count": len(reports),
+	})
+}
+
+// GET /api/reports/:name?param=value
+func (s *Server) RunReportHandler(c *gin.Context) {
+	name := c.Param("name")
+	def, ok := reports[name]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Отчёт не найден",
+		})
+		return
+	}
+
+	args, err := parseReportParams(def, c.Request.URL.Query())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	rows, err := RunReport(c.Request.Context(), s.pool, def, args)
+	if err != nil {
+		respondError(c, err, "Не удалось выполнить отчёт")
+		return
+	}
+
+	respondOK(c, rows, gin.H{
+		"report": name,
+		"count":  len(rows),
+	})
+}
+
+// GET /api/catalog-tree - типы продукции с продуктами внутри для дерева каталога одним запросом
+func (s *Server) GetCatalogTreeHandler(c *gin.Context) {
+	tree, err := GetCatalogTree(c.Request.Context(), s.pool, s.maxResponseRows)
+	if err != nil {
+		respondError(c, err, "Не удалось построить дерево каталога")
+		return
+	}
+
+	products := 0
+	for _, node := range tree {
+		products += node.ProductCount
+	}
+	respondOK(c, tree, gin.H{
+		"type_count":    len(tree),
+		"product_count": products,
+	})
+}
+
+// GET /api/materials/stats?limit=20 - продукты, средняя цена (без нулевых и пустых цен)
+// и суммарное время по материалам, самые используемые первыми
+func (s *Server) GetMaterialStatsHandler(c *gin.Context) {
+	limit := s.defaultPageSize
+	if raw := c.Query("limit"); raw != "" {
+		var err error
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit <= 0 || limit > s.maxPageSize {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("limit должен быть числом от 1 до %d", s.maxPageSize),
+			})
+			return
+		}
+	}
+
+	stats, err := GetMaterialStats(c.Request.Context(), s.pool, limit)
+	if err != nil {
+		respondError(c, err, "Не удалось посчитать статистику по материалам")
+		return
+	}
+
+	respondOK(c, stats, gin.H{
+		"count": len(stats),
+		"limit": limit,
+	})
+}
+
+// GET /api/stats/cost-efficiency - продукты по цене за час производства, лучшие первыми
+func (s *Server) GetCostEfficiencyHandler(c *gin.Context) {
+	ranking, err := GetCostEfficiency(c.Request.Context(), s.pool)
+	if err != nil {
+		respondError(c, err, "Не удалось рассчитать рейтинг продуктов")
+		return
+	}
+
+	respondOK(c, ranking, gin.H{
+		"count": len(ranking),
+	})
+}
+
+// GET /api/stats - сводная статистика по каталогу (кешируется на STATS_CACHE_TTL, см. statsCache)
+func (s *Server) GetStatsHandler(c *gin.Context) {
+	stats, hit, err := s.stats.get(func() (*ProductStats, error) {
+		return GetProductStats(c.Request.Context(), s.pool)
+	})
+	if hit {
+		c.Header("X-Cache", "HIT")
+	} else {
+		c.Header("X-Cache", "MISS")
+	}
+	if err != nil {
+		respondError(c, err, "Не удалось получить статистику")
+		return
+	}
+
+	respondOK(c, stats, nil)
+}
+
+// CalculateMaterialRequest - запрос на расчет количества сырья
+type CalculateMaterialRequest struct {
+	ProductTypeID  int     `json:"product_type_id" binding:"required"`
+	MaterialTypeID int     `json:"material_type_id" binding:"required"`
+	ProductQuantity int    `json:"product_quantity" binding:"required,gt=0"`
+	Param1          float64 `json:"param1" binding:"required,gt=0"`
+	Param2          float64 `json:"param2" binding:"required,gt=0"`
+}
+
+// POST /api/calculate-material - расчет количества сырья
+func (s *Server) CalculateMaterialHandler(c *gin.Context) {
+	var req CalculateMaterialRequest
+
+	// Валидация JSON
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	// Выполняем расчет
+	materialQuantity, err := CalculateMaterialQuantity(
+		c.Request.Context(),
+		s.pool,
+		req.ProductTypeID,
+		req.MaterialTypeID,
+		req.ProductQuantity,
+		req.Param1,
+		req.Param2,
+	)
+
+	if err != nil {
+		log.Printf("Ошибка расчета количества сырья: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	respondOK(c, gin.H{
+		"material_quantity": materialQuantity,
+		"product_type_id":   req.ProductTypeID,
+		"material_type_id":  req.MaterialTypeID,
+		"product_quantity":  req.ProductQuantity,
+		"param1":            req.Param1,
+		"param2":            req.Param2,
+	}, nil)
+}
+
+// exportFlushEvery - как часто сбрасывать буфер выгрузки клиенту (в строках)
+const exportFlushEvery = 500
+
+// GET /api/products/export?format=csv|ndjson&export_id=abc&sort=...&active_only=...
+// Отдаёт весь каталог потоком. Если передан export_id, прогресс можно смотреть
+// через /api/products/export/progress?export_id=abc
+//
+// delimiter=%3B (или delimiter=semicolon) - CSV для русского Excel: разделитель ";",
+// BOM в начале (иначе Excel читает UTF-8 как cp1251) и дробные числа через запятую.
+// Неэкранированную ";" в строке запроса Go отбрасывает как разделитель параметров
+func (s *Server) ExportProductsHandler(c *gin.Context) {
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "ndjson" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "format должен быть csv или ndjson",
+		})
+		return
+	}
+
+	excelRU, err := parseCSVDelimiter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if excelRU && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "delimiter применим только к format=csv",
+		})
+		return
+	}
+
+	opts, exportID, job, ok := s.startExport(c)
+	if !ok {
+		return
+	}
+	defer s.exports.finish(exportID, job)
+
+	// Заголовки ответа пишутся только после COUNT: пока строки не пошли, ошибку ещё можно отдать статусом
+	var writeRow func(ProductWithTime) error
+	var flush func()
+	begin := func(total int) error {
+		job.setTotal(total)
+		c.Header("Content-Disposition", `attachment; filename="products.`+format+`"`)
+		if format != "csv" {
+			c.Header("Content-Type", "application/x-ndjson")
+			enc := json.NewEncoder(c.Writer)
+			writeRow = func(p ProductWithTime) error {
+				return enc.Encode(p)
+			}
+			flush = c.Writer.Flush
+			c.Status(http.StatusOK)
+			return nil
+		}
+
+		w, formatNumber := newCSVWriter(c, excelRU)
+		w.Write([]string{"id", "product_name", "material_name", "type_name", "min_price", "article", "total_production_time", "is_active", "image_url"})
+		writeRow = func(p ProductWithTime) error {
+			return w.Write([]string{
+				strconv.Itoa(p.ID),
+				p.ProductName,
+				p.MaterialName,
+				p.TypeName,
+				formatNumber(p.MinPrice),
+				p.Article,
+				formatNumber(p.TotalProductionTime),
+				strconv.FormatBool(p.IsActive),
+				p.ImageURL,
+			})
+		}
+		flush = func() {
+			w.Flush()
+			c.Writer.Flush()
+		}
+		c.Status(http.StatusOK)
+		return nil
+	}
+
+	err = StreamProductsSnapshot(c.Request.Context(), s.pool, opts, begin, func(p ProductWithTime) error {
+		if err := writeRow(p); err != nil {
+			return err
+		}
+		if job.processed.Add(1)%exportFlushEvery == 0 {
+			flush()
+		}
+		return nil
+	})
+	if flush == nil {
+		// COUNT не выполнился - ответ ещё не начат
+		job.failed.Store(true)
+		respondError(c, err, "Не удалось выгрузить продукты")
+		return
+	}
+	flush()
+	if err != nil {
+		// Заголовки уже отправлены, статус не поменять - только обрываем выгрузку
+		job.failed.Store(true)
+		log.Printf("Ошибка выгрузки продуктов (export_id=%s): %v", exportID, err)
+	}
+}
+
+// parseCSVDelimiter читает delimiter: "," (по умолчанию) или ";"/"semicolon" - CSV для
+// русского Excel (excelRU)
+func parseCSVDelimiter(c *gin.Context) (excelRU bool, err error) {
+	switch c.DefaultQuery("delimiter", ",") {
+	case ",":
+		return false, nil
+	case ";", "semicolon":
+		return true, nil
+	default:
+		return false, errors.New("delimiter должен быть , или ;")
+	}
+}
+
+// newCSVWriter ставит Content-Type и создаёт писатель CSV в ответ. Для excelRU - разделитель ";",
+// BOM и дробная часть через запятую в formatNumber (два знака после запятой)
+func newCSVWriter(c *gin.Context, excelRU bool) (w *csv.Writer, formatNumber func(float64) string) {
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	w = csv.NewWriter(c.Writer)
+	formatNumber = func(v float64) string { return strconv.FormatFloat(v, 'f', 2, 64) }
+	if excelRU {
+		w.Comma = ';'
+		c.Writer.WriteString("\ufeff")
+		formatNumber = func(v float64) string {
+			return strings.Replace(strconv.FormatFloat(v, 'f', 2, 64), ".", ",", 1)
+		}
+	}
+	return w, formatNumber
+}
+
+// GET /api/reports/by-type.csv?delimiter=%3B - управленческий отчёт по типам продукции:
+// число продуктов, средняя цена и суммарное время. Те же данные, что /api/stats/time-by-type;
+// delimiter - как у /api/products/export. Тип без цен получает пустую среднюю цену
+func (s *Server) ByTypeReportCSVHandler(c *gin.Context) {
+	excelRU, err := parseCSVDelimiter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	stats, err := GetTimeByType(c.Request.Context(), s.pool)
+	if err != nil {
+		respondError(c, err, "Не удалось построить отчёт по типам")
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="by-type.csv"`)
+	w, formatNumber := newCSVWriter(c, excelRU)
+	c.Status(http.StatusOK)
+	w.Write([]string{"type_id", "type_name", "product_count", "avg_price", "total_production_time", "avg_production_time"})
+	for _, t := range stats {
+		avgPrice := ""
+		if t.AvgPrice != nil {
+			avgPrice = formatNumber(*t.AvgPrice)
+		}
+		w.Write([]string{
+			strconv.Itoa(t.TypeID),
+			t.TypeName,
+			strconv.Itoa(t.ProductCount),
+			avgPrice,
+			formatNumber(t.TotalTime),
+			formatNumber(t.AvgTime),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Printf("Ошибка записи отчёта по типам: %v", err)
+	}
+}
+
+// startExport разбирает фильтры выгрузки и регистрирует её в s.exports.
+// Число строк выгрузка задаёт сама (job.setTotal) - оно считается в снимке StreamProductsSnapshot.
+// При ok = false ответ с ошибкой уже отправлен. Вызывающий обязан вызвать s.exports.finish
+func (s *Server) startExport(c *gin.Context) (opts ProductListOptions, exportID string, job *exportJob, ok bool) {
+	opts, err := parseProductListOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return opts, "", nil, false
+	}
+
+	exportID = sanitizeRequestID(c.Query("export_id"))
+	if exportID == "" {
+		exportID = newRequestID()
+	}
+	job, err = s.exports.start(exportID)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+		return opts, "", nil, false
+	}
+
+	c.Header("X-Export-ID", exportID)
+	return opts, exportID, job, true
+}
+
+// xlsxContentType - MIME-тип файла Excel (.xlsx)
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// GET /api/products/export.xlsx?sort=...&active_only=...&export_id=abc
+// Те же фильтры и прогресс, что у CSV-выгрузки. Строки пишутся через StreamWriter
+// excelize (он сбрасывает их во временный файл), сам .xlsx отдаётся в конце:
+// формат - zip-архив, и по частям его не отдать
+func (s *Server) ExportProductsXLSXHandler(c *gin.Context) {
+	opts, exportID, job, ok := s.startExport(c)
+	if !ok {
+		return
+	}
+	defer s.exports.finish(exportID, job)
+
+	file := excelize.NewFile()
+	defer file.Close()
+
+	const sheet = "Sheet1"
+	sw, err := file.NewStreamWriter(sheet)
+	if err != nil {
+		failXLSXExport(c, job, exportID, err)
+		return
+	}
+
+	headerStyle, err := file.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	if err != nil {
+		failXLSXExport(c, job, exportID, err)
+		return
+	}
+	// 4 - встроенный формат "#,##0.00"
+	priceStyle, err := file.NewStyle(&excelize.Style{NumFmt: 4})
+	if err != nil {
+		failXLSXExport(c, job, exportID, err)
+		return
+	}
+	timeFormat := "0.0"
+	timeStyle, err := file.NewStyle(&excelize.Style{CustomNumFmt: &timeFormat})
+	if err != nil {
+		failXLSXExport(c, job, exportID, err)
+		return
+	}
+
+	sw.SetColWidth(2, 2, 40)
+	sw.SetColWidth(3, 4, 25)
+	header := []any{}
+	for _, title := range []string{"ID", "Название", "Материал", "Тип", "Мин. цена", "Артикул", "Время производства, ч", "Активен", "Изображение"} {
+		header = append(header, excelize.Cell{StyleID: headerStyle, Value: title})
+	}
+	if err := sw.SetRow("A1", header); err != nil {
+		failXLSXExport(c, job, exportID, err)
+		return
+	}
+
+	rowNum := 1
+	err = StreamProductsSnapshot(c.Request.Context(), s.pool, opts, func(total int) error {
+		job.setTotal(total)
+		return nil
+	}, func(p ProductWithTime) error {
+		rowNum++
+		cell, _ := excelize.CoordinatesToCellName(1, rowNum)
+		active := "да"
+		if !p.IsActive {
+			active = "нет"
+		}
+		err := sw.SetRow(cell, []any{
+			p.ID,
+			p.ProductName,
+			p.MaterialName,
+			p.TypeName,
+			excelize.Cell{StyleID: priceStyle, Value: p.MinPrice},
+			p.Article,
+			excelize.Cell{StyleID: timeStyle, Value: p.TotalProductionTime},
+			active,
+			p.ImageURL,
+		})
+		job.processed.Add(1)
+		return err
+	})
+	if err == nil {
+		err = sw.Flush()
+	}
+	if err != nil {
+		failXLSXExport(c, job, exportID, err)
+		return
+	}
+
+	c.Header("Content-Type", xlsxContentType)
+	c.Header("Content-Disposition", `attachment; filename="products.xlsx"`)
+	c.Status(http.StatusOK)
+	if err := file.Write(c.Writer); err != nil {
+		// Заголовки уже отправлены - только логируем
+		job.failed.Store(true)
+		log.Printf("Ошибка отправки XLSX (export_id=%s): %v", exportID, err)
+	}
+}
+
+// failXLSXExport отвечает 500, пока файл ещё не начали отправлять
+func failXLSXExport(c *gin.Context, job *exportJob, exportID string, err error) {
+	job.failed.Store(true)
+	log.Printf("Ошибка выгрузки продуктов в XLSX (export_id=%s): %v", exportID, err)
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error": "Не удалось выгрузить продукты",
+	})
+}
+
+// exportProgressInterval - период отправки событий прогресса
+const exportProgressInterval = 500 * time.Millisecond
+
+// exportWaitForStart - сколько ждать появления выгрузки: страница обычно открывает
+// progress одновременно со скачиванием, и он может прийти раньше самой выгрузки
+const exportWaitForStart = 5 * time.Second
+
+// GET /api/products/export/progress?export_id=abc
+// Server-Sent Events: "progress" {processed, total} каждые exportProgressInterval,
+// в конце "done" (или "error") с итоговыми числами
+func (s *Server) ExportProgressHandler(c *gin.Context) {
+	exportID := sanitizeRequestID(c.Query("export_id"))
+	if exportID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "export_id обязателен",
+		})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // иначе nginx копит события в буфере
+	c.Status(http.StatusOK)
+
+	ctx := c.Request.Context()
+	ticker := time.NewTicker(exportProgressInterval)
+	defer ticker.Stop()
+	waitUntil := time.Now().Add(exportWaitForStart)
+
+	var job *exportJob
+	for {
+		if job == nil {
+			job = s.exports.get(exportID)
+		}
+		if job == nil && time.Now().After(waitUntil) {
+			c.SSEvent("error", gin.H{"error": "выгрузка не найдена"})
+			c.Writer.Flush()
+			return
+		}
+
+		if job != nil {
+			total := job.total.Load()
+			progress := gin.H{
+				"processed": job.processed.Load(),
+				"total":     max(total, 0),
+			}
+			select {
+			case <-job.done:
+				if job.failed.Load() {
+					c.SSEvent("error", progress)
+				} else {
+					c.SSEvent("done", progress)
+				}
+				c.Writer.Flush()
+				return
+			default:
+				// Пока строки не посчитаны, показывать нечего
+				if total >= 0 {
+					c.SSEvent("progress", progress)
+					c.Writer.Flush()
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// POST /api/admin/maintenance - обновить статистику планировщика (для тех, у кого нет psql)
+func (s *Server) MaintenanceHandler(c *gin.Context) {
+	estimates, err := AnalyzeTables(c.Request.Context(), s.pool)
+	if err != nil {
+		respondError(c, err, "Не удалось обновить статистику таблиц")
+		return
+	}
+
+	respondOK(c, estimates, gin.H{
+		"analyzed": maintenanceTables,
+	})
+}
+
+// PurgeRequest - параметры очистки старых неактивных продуктов
+type PurgeRequest struct {
+	Before string `json:"before" binding:"required"` // дата (2006-01-02) или RFC 3339
+	DryRun bool   `json:"dry_run"`                   // только показать, что будет удалено
+}
+
+// POST /api/admin/purge - выгрузить в JSON и удалить неактивные продукты, не менявшиеся до даты.
+// Ответ и есть архив: его нужно сохранить, удалённые продукты больше нигде не останутся
+func (s *Server) PurgeHandler(c *gin.Context) {
+	var req PurgeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	cutoff, err := time.Parse(time.DateOnly, req.Before)
+	if err != nil {
+		cutoff, err = time.Parse(time.RFC3339, req.Before)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "before должен быть датой в формате 2006-01-02 или RFC 3339",
+		})
+		return
+	}
+	if cutoff.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "before не может быть в будущем",
+		})
+		return
+	}
+
+	archive, err := PurgeInactiveProducts(c.Request.Context(), s.pool, cutoff, req.DryRun, requestActor(c))
+	if err != nil {
+		respondError(c, err, "Не удалось удалить старые продукты")
+		return
+	}
+
+	if !req.DryRun {
+		log.Printf("Очистка: удалено %d неактивных продуктов (изменены до %s), связей с цехами: %d",
+			len(archive.Products), cutoff.Format(time.RFC3339), archive.Links)
+		for _, p := range archive.Products {
+			s.webhooks.send(c.Request.Context(), webhookProductDeleted, p.ID)
+		}
+	}
+
+	respondOK(c, archive, gin.H{
+		"count":   len(archive.Products),
+		"dry_run": req.DryRun,
+	})
+}
+
+// GET /api/debug/stats?reset=true - счётчики запросов с момента старта (или прошлого сброса)
+func (s *Server) DebugStatsHandler(c *gin.Context) {
+	reset := false
+	if raw := c.Query("reset"); raw != "" {
+		var err error
+		reset, err = strconv.ParseBool(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "reset должен быть true или false",
+			})
+			return
+		}
+	}
+
+	respondOK(c, s.metrics.snapshot(reset), nil)
+}
+
+// GET /api/debug/db - состояние breaker и пула соединений
+func (s *Server) DebugDBHandler(c *gin.Context) {
+	stat := s.pool.Stat()
+	respondOK(c, gin.H{
+		"breaker":      s.breaker.snapshot(),
+		"orphan_links": s.orphanLinks.snapshot(),
+		"heavy_ops":    s.heavyOps.snapshot(),
+		"pool": gin.H{
+			"total_conns":    stat.TotalConns(),
+			"idle_conns":     stat.IdleConns(),
+			"acquired_conns": stat.AcquiredConns(),
+			"max_conns":      stat.MaxConns(),
+			// ожидание свободного соединения: сколько раз ждали, сколько суммарно и сколько не дождались
+			"empty_acquire_count":    stat.EmptyAcquireCount(),
+			"empty_acquire_wait_ms":  stat.EmptyAcquireWaitTime().Milliseconds(),
+			"canceled_acquire_count": stat.CanceledAcquireCount(),
+			"acquire_timeout_count":  s.tracer.acquireTimeouts.Load(),
+			"acquire_timeout":        s.tracer.acquireTimeout.String(),
+		},
+	}, nil)
+}
+
+// Данные сборки, подставляются через ldflags:
+// go build -ldflags "-X main.Version=1.2.0 -X main.Commit=$(git rev-parse --short HEAD) -X main.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var Version, Commit, BuildTime string
+
+// orDev возвращает "dev" для не заданных при сборке значений
+func orDev(value string) string {
+	if value == "" {
+		return "dev"
+	}
+	return value
+}
+
+// GET /version - версия запущенной сборки
+func VersionHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"version":    orDev(Version),
+		"commit":     orDev(Commit),
+		"build_time": orDev(BuildTime),
+	})
+}
+
+// expectedSchemaVersion - версия схемы БД, под которую собрано приложение.
+// Увеличивается вместе с новой записью в schema_migrations (см. schema.sql)
+const expectedSchemaVersion = 5
+
+// GetSchemaVersion возвращает последнюю применённую версию схемы.
+// Нет таблицы schema_migrations - база создана до учёта версий, версия 0
+func GetSchemaVersion(ctx context.Context, pool *pgxpool.Pool) (int, error) {
+	var version int
+	err := pool.QueryRow(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "42P01" { // undefined_table
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения версии схемы: %w", err)
+	}
+	return version, nil
+}
+
+// GET /ready - готовность принимать трафик: БД доступна и схема не отстаёт от приложения.
+// 503, пока миграции не применены - чтобы во время выкладки не работать с недомигрированной базой
+func (s *Server) ReadyHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	if err := s.pool.Ping(ctx); err != nil {
+		log.Printf("Проверка готовности: БД недоступна: %v", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status": "not_ready",
+			"error":  "База данных недоступна",
+		})
+		return
+	}
+
+	current, err := GetSchemaVersion(ctx, s.pool)
+	if err != nil {
+		log.Printf("Проверка готовности: %v", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status": "not_ready",
+			"error":  "Не удалось проверить версию схемы БД",
+		})
+		return
+	}
+
+	schema := gin.H{
+		"current":  current,
+		"expected": expectedSchemaVersion,
+	}
+	if current < expectedSchemaVersion {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status": "not_ready",
+			"error":  fmt.Sprintf("Схема БД отстаёт: применена версия %d, нужна %d", current, expectedSchemaVersion),
+			"schema": schema,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ready",
+		"schema": schema,
+	})
+}
+
+// newPriceFormatter возвращает функцию шаблона для цен в русском формате:
+// пробелы между разрядами, запятая перед копейками и символ валюты - "1 234 567,50 ₽"
+func newPriceFormatter(currency string) func(float64) string {
+	return func(value float64) string {
+		formatted := strconv.FormatFloat(math.Abs(value), 'f', 2, 64)
+		intPart, fracPart, _ := strings.Cut(formatted, ".")
+
+		var b strings.Builder
+		if value < 0 {
+			b.WriteString("-")
+		}
+		for i, digit := range intPart {
+			if i > 0 && (len(intPart)-i)%3 == 0 {
+				b.WriteString("\u00a0") // неразрывный пробел, чтобы сумма не переносилась
+			}
+			b.WriteRune(digit)
+		}
+		b.WriteString(",")
+		b.WriteString(fracPart)
+		b.WriteString("\u00a0")
+		b.WriteString(currency)
+		return b.String()
+	}
+}
+
+// ============ MIDDLEWARE ============
+
+// requestIDKey - ключ request id в context.Context запроса
+type requestIDKey struct{}
+
+const requestIDHeader = "X-Request-ID"
+
+// requestIDFromContext достаёт request id, положенный RequestIDMiddleware
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// sanitizeRequestID оставляет только безопасные символы и ограничивает длину:
+// id приходит от клиента и попадает в application_name (он же в логи postgres)
+func sanitizeRequestID(raw string) string {
+	var b strings.Builder
+	for _, r := range raw {
+		if b.Len() >= 64 {
+			break
+		}
+		if r == '-' || r == '_' || r == '.' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// newRequestID генерирует случайный id запроса
+func newRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// RequestIDMiddleware берёт X-Request-ID из запроса (или генерирует новый),
+// возвращает его в ответе и кладёт в context запроса, откуда его читает пул БД
+func RequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := sanitizeRequestID(c.GetHeader(requestIDHeader))
+		if id == "" {
+			id = newRequestID()
+		}
+
+		c.Set("request_id", id)
+		c.Header(requestIDHeader, id)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestIDKey{}, id))
+		c.Next()
+	}
+}
+
+// adminKeyHeader - заголовок с ключом администратора
+const adminKeyHeader = "X-Admin-Key"
+
+// AdminKeyMiddleware пускает только с верным X-Admin-Key. Пустой key - ручка выключена
+// целиком (404), чтобы операции обслуживания не были открыты по умолчанию
+func AdminKeyMiddleware(key string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if key == "" {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+				"error": "Не найдено",
+			})
+			return
+		}
+		if !adminKeyValid(c, key) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "Неверный ключ администратора",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// adminKeyValid - совпадает ли X-Admin-Key с key. Пустой key - доступа нет ни у кого
+func adminKeyValid(c *gin.Context, key string) bool {
+	return key != "" && subtle.ConstantTimeCompare([]byte(c.GetHeader(adminKeyHeader)), []byte(key)) == 1
+}
+
+// MethodNotAllowedHandler - ответ 405 для API в общем JSON-формате ошибок.
+// Для HTML-страниц остаётся стандартный текстовый ответ gin
+func MethodNotAllowedHandler(c *gin.Context) {
+	if !strings.HasPrefix(c.Request.URL.Path, "/api/") {
+		return
+	}
+	c.JSON(http.StatusMethodNotAllowed, gin.H{
+		"error":   "Метод " + c.Request.Method + " не поддерживается для этого адреса",
+		"allowed": strings.Split(c.Writer.Header().Get("Allow"), ", "),
+	})
+}
+
+// isJSONContentType проверяет Content-Type: application/json или любой */*+json
+func isJSONContentType(header string) bool {
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// RequireJSONMiddleware отвечает 415, если запрос с телом пришёл не с JSON Content-Type.
+// Без этого gin пытается разобрать тело и выдаёт невнятную ошибку биндинга.
+// Запросы без тела (например POST /api/admin/recompute-times) не проверяются
+func RequireJSONMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+		default:
+			c.Next()
+			return
+		}
+
+		hasBody := c.Request.ContentLength > 0 || c.Request.ContentLength == -1
+		if hasBody && !isJSONContentType(c.GetHeader("Content-Type")) {
+			c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{
+				"error": "Ожидается Content-Type: application/json, получено '" + c.GetHeader("Content-Type") + "'",
+			})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// withRequestTimeout ограничивает время обработки запроса целиком (limit <= 0 - без ограничения).
+// http.TimeoutHandler запускает обработчик в отдельной горутине и пишет его ответ в буфер:
+// по истечении limit клиент получает 503, context запроса отменяется, а запоздалые
+// записи обработчика отбрасываются (ошибка http.ErrHandlerTimeout), так что в уже
+// отданный ответ ничего не допишется. gin.Context живёт целиком внутри этой горутины
+//
+// Запросы, для которых exempt возвращает true (выгрузки, SSE), идут мимо лимита:
+// TimeoutHandler буферизует ответ и не поддерживает Flush, стриминг через него невозможен
+func withRequestTimeout(h http.Handler, limit time.Duration, exempt func(*http.Request) bool) http.Handler {
+	if limit <= 0 {
+		return h
+	}
+	limited := http.TimeoutHandler(h, limit, `{"error":"Превышено время обработки запроса"}`)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if exempt != nil && exempt(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		limited.ServeHTTP(timeoutJSONWriter{w}, r)
+	})
+}
+
+// timeoutJSONWriter помечает 503 от TimeoutHandler как JSON: сам он пишет тело без
+// Content-Type, и клиент видел бы text/plain. Ответ обработчика TimeoutHandler отдаёт
+// вместе с его заголовками, поэтому Content-Type ставится, только если его нет
+type timeoutJSONWriter struct {
+	http.ResponseWriter
+}
+
+func (w timeoutJSONWriter) WriteHeader(status int) {
+	if status == http.StatusServiceUnavailable && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// withAPITrailingSlashRedirect - единое правило для API: путь со слэшем в конце
+// (/api/products/) отвечает 308 на путь без него с тем же query. 308 сохраняет метод и тело,
+// поэтому POST/PUT/DELETE повторяются клиентом как есть, а не превращаются в GET, как бывает
+// с 301/302. Стоит перед роутером и лимитом времени: роутер видит только канонические пути
+func withAPITrailingSlashRedirect(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if strings.HasPrefix(path, "/api/") && len(path) > len("/api/") && strings.HasSuffix(path, "/") {
+			target := strings.TrimRight(path, "/")
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusPermanentRedirect)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isStreamingRequest - длинные потоковые ответы, которым не нужен REQUEST_TIMEOUT.
+// Профили pprof тоже: /debug/pprof/profile по умолчанию снимается 30 секунд.
+// Список продуктов пишется потоком (streamProductList) только при условиях streamsProductList,
+// а буфер TimeoutHandler не поддерживает Flush. Остальные списки собираются целиком и лимит получают
+func isStreamingRequest(r *http.Request) bool {
+	if r.Method == http.MethodGet && r.URL.Path == "/api/products" && streamsProductList(r.URL.Query(), r.Header.Get("Accept")) {
+		return true
+	}
+	return strings.HasPrefix(r.URL.Path, "/api/products/export") || strings.HasPrefix(r.URL.Path, "/debug/pprof")
+}
+
+// newHTTPServer создаёт http.Server с таймаутами соединения из HTTP_*_TIMEOUT.
+// Таймауты против медленных клиентов (slowloris): без ReadHeaderTimeout
+// клиент, присылающий заголовки по байту, держит соединение и горутину сколько угодно.
+// WriteTimeout по умолчанию выключен: выгрузки и список без страницы отдаются потоком
+// дольше любого разумного лимита, а обычные ответы и так ограничивает REQUEST_TIMEOUT
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: getEnvDuration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       getEnvDuration("HTTP_READ_TIMEOUT", time.Minute),
+		WriteTimeout:      getEnvDuration("HTTP_WRITE_TIMEOUT", 0),
+		IdleTimeout:       getEnvDuration("HTTP_IDLE_TIMEOUT", 2*time.Minute),
+	}
+}
+
+// registerPprof подключает стандартные ручки net/http/pprof под /debug/pprof.
+// Профили раскрывают внутренности процесса, поэтому включаются только явно (ENABLE_PPROF=true)
+func registerPprof(r *gin.Engine) {
+	g := r.Group("/debug/pprof")
+	g.GET("/", gin.WrapF(pprof.Index))
+	g.GET("/cmdline", gin.WrapF(pprof.Cmdline))
+	g.GET("/profile", gin.WrapF(pprof.Profile))
+	g.GET("/symbol", gin.WrapF(pprof.Symbol))
+	g.POST("/symbol", gin.WrapF(pprof.Symbol))
+	g.GET("/trace", gin.WrapF(pprof.Trace))
+	// heap, goroutine, allocs, block, mutex, threadcreate: Index отдаёт профиль по имени из пути
+	g.GET("/:name", gin.WrapF(pprof.Index))
+}
+
+// requestMetrics - простые счётчики запросов в памяти процесса (без Prometheus)
+type requestMetrics struct {
+	mu           sync.Mutex
+	since        time.Time
+	total        int64
+	byStatus     map[int]int64
+	totalLatency time.Duration
+	maxLatency   time.Duration
+}
+
+func newRequestMetrics() *requestMetrics {
+	return &requestMetrics{since: time.Now(), byStatus: make(map[int]int64)}
+}
+
+func (m *requestMetrics) observe(status int, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.total++
+	m.byStatus[status]++
+	m.totalLatency += latency
+	if latency > m.maxLatency {
+		m.maxLatency = latency
+	}
+}
+
+// RequestMetricsSnapshot - содержимое /api/debug/stats
+type RequestMetricsSnapshot struct {
+	Since        time.Time        `json:"since"`
+	Total        int64            `json:"total_requests"`
+	ByStatus     map[string]int64 `json:"by_status"`
+	AvgLatencyMs float64          `json:"avg_latency_ms"`
+	MaxLatencyMs float64          `json:"max_latency_ms"`
+}
+
+// snapshot возвращает текущие значения; reset обнуляет счётчики в той же блокировке,
+// чтобы ни один запрос не потерялся между чтением и сбросом
+func (m *requestMetrics) snapshot(reset bool) RequestMetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snap := RequestMetricsSnapshot{
+		Since:        m.since,
+		Total:        m.total,
+		ByStatus:     make(map[string]int64, len(m.byStatus)),
+		MaxLatencyMs: float64(m.maxLatency) / float64(time.Millisecond),
+	}
+	for status, count := range m.byStatus {
+		snap.ByStatus[strconv.Itoa(status)] = count
+	}
+	if m.total > 0 {
+		snap.AvgLatencyMs = float64(m.totalLatency) / float64(m.total) / float64(time.Millisecond)
+	}
+
+	if reset {
+		m.since = time.Now()
+		m.total = 0
+		m.byStatus = make(map[int]int64)
+		m.totalLatency = 0
+		m.maxLatency = 0
+	}
+	return snap
+}
+
+// MetricsMiddleware считает запросы по статусам и их среднюю длительность
+func MetricsMiddleware(m *requestMetrics) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		m.observe(c.Writer.Status(), time.Since(start))
+	}
+}
+
+// queryTiming копит время запросов к БД за один HTTP-запрос.
+// Запросы могут идти из нескольких горутин обработчика, поэтому счётчики атомарные
+type queryTiming struct {
+	dbNanos atomic.Int64
+	queries atomic.Int64
+}
+
+type queryTimingKey struct{}
+
+type queryStartKey struct{}
+
+// queryStart - начало запроса для TraceQueryEnd: время, а для лога медленных ещё SQL и аргументы.
+// span - дочерний span запроса к БД, если запрос HTTP трассируется (иначе nil)
+type queryStart struct {
+	at   time.Time
+	sql  string
+	args []any
+	span trace.Span
+}
+
+// queryTimingTracer - pgx.QueryTracer, который прибавляет длительность каждого
+// Query/QueryRow/Exec к queryTiming из context запроса (если он там есть)
+// и пишет в лог запросы дольше slowThreshold (0 - не писать)
+type queryTimingTracer struct {
+	slowThreshold time.Duration
+}
+
+// maxLoggedArgsLen - длина аргументов в логе медленного запроса (массивы id бывают длинными)
+const maxLoggedArgsLen = 500
+
+func (t queryTimingTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	var span trace.Span
+	if trace.SpanFromContext(ctx).IsRecording() {
+		ctx, span = otel.Tracer(tracerName).Start(ctx, dbSpanName(data.SQL),
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("db.system.name", "postgresql"),
+				attribute.String("db.query.text", strings.Join(strings.Fields(data.SQL), " ")),
+			))
+	}
+	if _, ok := ctx.Value(queryTimingKey{}).(*queryTiming); !ok && t.slowThreshold <= 0 && span == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, queryStartKey{}, queryStart{at: time.Now(), sql: data.SQL, args: data.Args, span: span})
+}
+
+func (t queryTimingTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	start, ok := ctx.Value(queryStartKey{}).(queryStart)
+	if !ok {
+		return
+	}
+	elapsed := time.Since(start.at)
+
+	if start.span != nil {
+		if data.Err != nil {
+			start.span.RecordError(data.Err)
+			start.span.SetStatus(codes.Error, data.Err.Error())
+		}
+		start.span.End()
+	}
+
+	if timing, ok := ctx.Value(queryTimingKey{}).(*queryTiming); ok {
+		timing.dbNanos.Add(int64(elapsed))
+		timing.queries.Add(1)
+	}
+
+	if t.slowThreshold > 0 && elapsed >= t.slowThreshold {
+		args := fmt.Sprintf("%v", start.args)
+		if len(args) > maxLoggedArgsLen {
+			args = args[:maxLoggedArgsLen] + "..."
+		}
+		log.Printf("WARN: медленный запрос %s (порог %s, request_id=%s): %s; args=%s",
+			elapsed.Round(time.Millisecond), t.slowThreshold, requestIDFromContext(ctx),
+			strings.Join(strings.Fields(start.sql), " "), args)
+	}
+}
+
+// serverTimingWriter дописывает Server-Timing перед отправкой заголовков:
+// после c.Next() заголовки обычно уже ушли клиенту вместе с телом
+type serverTimingWriter struct {
+	gin.ResponseWriter
+	timing *queryTiming
+	start  time.Time
+	sent   bool
+}
+
+func (w *serverTimingWriter) setHeader() {
+	if w.sent || w.ResponseWriter.Written() {
+		return
+	}
+	w.sent = true
+	ms := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 1, 64)
+	}
+	w.Header().Set("Server-Timing", fmt.Sprintf(`db;dur=%s;desc="%d queries", total;dur=%s`,
+		ms(time.Duration(w.timing.dbNanos.Load())), w.timing.queries.Load(), ms(time.Since(w.start))))
+}
+
+func (w *serverTimingWriter) WriteHeaderNow() {
+	w.setHeader()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *serverTimingWriter) Write(data []byte) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *serverTimingWriter) WriteString(str string) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.WriteString(str)
+}
+
+func (w *serverTimingWriter) Flush() {
+	w.setHeader()
+	w.ResponseWriter.Flush()
+}
+
+// ServerTimingMiddleware отдаёт заголовок Server-Timing: время в БД отдельно от общего.
+// total считается до момента отправки заголовков, т.е. без записи тела ответа
+func ServerTimingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		timing := &queryTiming{}
+		w := &serverTimingWriter{ResponseWriter: c.Writer, timing: timing, start: time.Now()}
+		c.Writer = w
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), queryTimingKey{}, timing))
+
+		c.Next()
+		// ответ без тела (204, редирект): заголовки gin отправит уже после middleware
+		w.setHeader()
+	}
+}
+
+// configureRequestTagging настраивает пул так, чтобы request id был виден
+// в pg_stat_activity.application_name, пока соединение занято запросом.
+// Соединения переиспользуются, поэтому при возврате в пул имя сбрасывается обратно
+func configureRequestTagging(config *pgxpool.Config) {
+	baseName := config.ConnConfig.RuntimeParams["application_name"]
+	if baseName == "" {
+		baseName = "praktica"
+		config.ConnConfig.RuntimeParams["application_name"] = baseName
+	}
+
+	config.PrepareConn = func(ctx context.Context, conn *pgx.Conn) (bool, error) {
+		id := requestIDFromContext(ctx)
+		if id == "" {
+			return true, nil
+		}
+		_, err := conn.Exec(ctx, `SELECT set_config('application_name', $1, false)`, baseName+" req="+id)
+		if err != nil {
+			// соединение в непонятном состоянии - пусть пул его пересоздаст
+			return false, nil
+		}
+		return true, nil
+	}
+
+	config.AfterRelease = func(conn *pgx.Conn) bool {
+		// application_name - GUC_REPORT, сервер сам сообщает его текущее значение
+		if conn.PgConn().ParameterStatus("application_name") == baseName {
+			return true
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := conn.Exec(ctx, `SELECT set_config('application_name', $1, false)`, baseName)
+		return err == nil
+	}
+}
+
+// configureStatementTimeout задаёт statement_timeout для всех соединений пула:
+// Postgres сам прервёт зависший запрос (SQLSTATE 57014), даже если context
+// где-то не передан. timeout <= 0 - оставить как есть (DSN или настройки сервера)
+func configureStatementTimeout(config *pgxpool.Config, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	config.ConnConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(timeout.Milliseconds(), 10)
+}
+
+// ============ MAIN ============
+
+// StartupDiagnostics - к какой базе подключилось приложение, для лога при старте
+type StartupDiagnostics struct {
+	ServerVersion string
+	Database      string
+	SchemaVersion int
+	Counts        map[string]int64 // nil - подсчёт выключен (SKIP_STARTUP_COUNTS=true)
+}
+
+// GetStartupDiagnostics собирает версию postgres, имя базы, версию схемы и, если withCounts,
+// число строк основных таблиц. COUNT(*) на больших таблицах - полный проход, поэтому отключаем
+func GetStartupDiagnostics(ctx context.Context, pool *pgxpool.Pool, withCounts bool) (*StartupDiagnostics, error) {
+	var d StartupDiagnostics
+	if err := pool.QueryRow(ctx, `SELECT version(), current_database()`).Scan(&d.ServerVersion, &d.Database); err != nil {
+		return nil, fmt.Errorf("ошибка получения версии БД: %w", err)
+	}
+
+	var err error
+	if d.SchemaVersion, err = GetSchemaVersion(ctx, pool); err != nil {
+		return nil, err
+	}
+
+	if !withCounts {
+		return &d, nil
+	}
+	var products, materials, types, workshops int64
+	query := `
+		SELECT
+			(SELECT COUNT(*) FROM products),
+			(SELECT COUNT(*) FROM materials),
+			(SELECT COUNT(*) FROM products_types),
+			(SELECT COUNT(*) FROM workshops)
+	`
+	if err := pool.QueryRow(ctx, query).Scan(&products, &materials, &types, &workshops); err != nil {
+		return nil, fmt.Errorf("ошибка подсчёта строк: %w", err)
+	}
+	d.Counts = map[string]int64{
+		"products":  products,
+		"materials": materials,
+		"types":     types,
+		"workshops": workshops,
+	}
+	return &d, nil
+}
+
+// logStartupDiagnostics пишет в лог одну строку о базе. Ошибка не мешает старту: это только справка
+func logStartupDiagnostics(ctx context.Context, pool *pgxpool.Pool, withCounts bool) {
+	d, err := GetStartupDiagnostics(ctx, pool, withCounts)
+	if err != nil {
+		log.Printf("Диагностика при старте не удалась: %v", err)
+		return
+	}
+
+	line := fmt.Sprintf("БД: database=%s schema_version=%d (нужна %d) server=%q",
+		d.Database, d.SchemaVersion, expectedSchemaVersion, d.ServerVersion)
+	if d.Counts != nil {
+		line += fmt.Sprintf(" products=%d materials=%d types=%d workshops=%d",
+			d.Counts["products"], d.Counts["materials"], d.Counts["types"], d.Counts["workshops"])
+	}
+	log.Println(line)
+}
+
+// getEnvDuration читает длительность ("10s", "500ms") из переменной окружения
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil {
+		log.Fatalf("%s должен быть длительностью вроде 10s, получено '%s'", key, raw)
+	}
+	return value
+}
+
+// getEnvTimeout - getEnvDuration для таймаутов с точностью до миллисекунды: statement_timeout
+// задаётся в мс, и 500us превратились бы в 0, то есть "без лимита". Значение между 0 и 1ms -
+// почти наверняка опечатка в единицах, поэтому запуск останавливается
+func getEnvTimeout(key string, def time.Duration) time.Duration {
+	value := getEnvDuration(key, def)
+	if value > 0 && value < time.Millisecond {
+		log.Fatalf("%s должен быть 0 или не меньше 1ms, получено %s", key, value)
+	}
+	return value
+}
+
+// getEnvFloat читает число из переменной окружения, при пустом значении возвращает def
+func getEnvFloat(key string, def float64) float64 {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		log.Fatalf("%s должен быть числом, получено '%s'", key, raw)
+	}
+	return value
+}
+
+// getEnvInt читает целое из переменной окружения, при пустом значении возвращает def
+func getEnvInt(key string, def int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		log.Fatalf("%s должен быть целым числом, получено '%s'", key, raw)
+	}
+	return value
+}
+
+const templatesGlob = "templates/*"
+
+func main() {
+	// Загрузка .env файла
+	err := godotenv.Load()
+	if err != nil {
+		log.Println("Файл .env не найден, используются переменные окружения")
+	}
+
+	// ctx отменяется по SIGINT/SIGTERM: фоновые задачи останавливаются, сервер уходит в Shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Получаем переменные из окружения
+	databaseURL := os.Getenv("DATABASE_URL")
+	if databaseURL == "" {
+		log.Fatal("DATABASE_URL не установлен")
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080" // значение по умолчанию
+	}
+
+	staticDir := os.Getenv("STATIC_DIR")
+	if staticDir == "" {
+		staticDir = "./static"
+	}
+
+	// Стиль ключей JSON в ответах API: snake (по умолчанию) или camel
+	jsonFieldCase := os.Getenv("JSON_FIELD_CASE")
+	if jsonFieldCase == "" {
+		jsonFieldCase = "snake"
+	}
+	if jsonFieldCase != "snake" && jsonFieldCase != "camel" {
+		log.Fatalf("JSON_FIELD_CASE должен быть snake или camel, получено %q", jsonFieldCase)
+	}
+
+	// Символ валюты для цен в HTML (JSON API отдаёт цены числами)
+	currency := os.Getenv("CURRENCY")
+	if currency == "" {
+		currency = "₽"
+	}
+
+	// APP_ENV: development - шаблоны перечитываются на каждый запрос,
+	// production - gin в release-режиме, шаблоны грузятся один раз при старте
+	appEnv := os.Getenv("APP_ENV")
+	if appEnv == "production" && os.Getenv(gin.EnvGinMode) == "" {
+		gin.SetMode(gin.ReleaseMode)
+	}
+
+	// Трассировка OpenTelemetry: экспорт по OTLP, если задан OTEL_EXPORTER_OTLP_ENDPOINT
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		log.Fatalf("Не удалось настроить OpenTelemetry: %v", err)
+	}
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			log.Printf("Ошибка отправки оставшихся span: %v", err)
+		}
+	}()
+
+	// Создание пула соединений
+	poolConfig, err := pgxpool.ParseConfig(databaseURL)
+	if err != nil {
+		log.Fatalf("Неверный DATABASE_URL: %v", err)
+	}
+	configureRequestTagging(poolConfig)
+	configureStatementTimeout(poolConfig, getEnvTimeout("STATEMENT_TIMEOUT", 0))
+	breaker := newDBBreaker(getEnvInt("DB_BREAKER_THRESHOLD", 5), getEnvDuration("DB_BREAKER_COOLDOWN", 10*time.Second))
+	tracer := &poolTracer{
+		queryTimingTracer: queryTimingTracer{slowThreshold: getEnvDuration("SLOW_QUERY_THRESHOLD", 0)},
+		breaker:           breaker,
+		acquireTimeout:    getEnvTimeout("DB_ACQUIRE_TIMEOUT", 5*time.Second),
+	}
+	poolConfig.ConnConfig.Tracer = tracer
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		log.Fatalf("Не удалось создать пул соединений: %v", err)
+	}
+	defer pool.Close()
+
+	// Проверка подключения
+	if err := pool.Ping(ctx); err != nil {
+		log.Fatalf("Не удалось подключиться к БД: %v", err)
+	}
+	logStartupDiagnostics(ctx, pool, os.Getenv("SKIP_STARTUP_COUNTS") != "true")
+
+	// Создание сервера
+	stats := newStatsCache(getEnvDuration("STATS_CACHE_TTL", 5*time.Second))
+	server := &Server{
+		pool:              pool,
+		refs:              newReferenceCache(pool, stats),
+		maxOffset:         getEnvInt("MAX_OFFSET", 10000),
+		maxProductionTime: getEnvFloat("MAX_PRODUCTION_TIME", 1000),
+		maxWorkshops:      getEnvInt("MAX_WORKSHOPS_PER_PRODUCT", 50),
+		exports:           newExportRegistry(),
+		breaker:           breaker,
+		tracer:            tracer,
+		defaultPageSize:   getEnvInt("DEFAULT_PAGE_SIZE", 20),
+		maxPageSize:       getEnvInt("MAX_PAGE_SIZE", 100),
+		metrics:           newRequestMetrics(),
+		webhooks:          newWebhookDispatcher(os.Getenv("WEBHOOK_URL"), os.Getenv("WEBHOOK_SECRET")),
+		stats:             stats,
+		orphanLinks:       newOrphanLinkWatchdog(pool, getEnvDuration("ORPHAN_LINKS_CHECK_INTERVAL", time.Hour)),
+		// По умолчанию четверть пула: остальное гарантированно остаётся обычным запросам
+		heavyOps:        newHeavyOpLimiter(getEnvInt("HEAVY_OP_LIMIT", max(1, int(poolConfig.MaxConns)/4))),
+		fuzzyThreshold:  getEnvFloat("SEARCH_FUZZY_THRESHOLD", 0.3),
+		maxResponseRows: getEnvInt("MAX_RESPONSE_ROWS", 1000),
+		priceAboveCost:  os.Getenv("PRICE_ABOVE_COST") == "true",
+		totals:          newTotalRecomputer(pool, getEnvDuration("TOTAL_RECOMPUTE_WINDOW", 0)),
+	}
+
+	// Формат артикула, например ARTICLE_PATTERN=[A-Z]{3}-[0-9]{6}. Шаблон должен совпасть
+	// с артикулом целиком, сравнение после приведения к верхнему регистру
+	if pattern := os.Getenv("ARTICLE_PATTERN"); pattern != "" {
+		server.articlePattern, err = regexp.Compile(`^(?:` + pattern + `)$`)
+		if err != nil {
+			log.Fatalf("Неверный ARTICLE_PATTERN: %v", err)
+		}
+	}
+
+	// Допустимые символы названий продуктов. PRODUCT_NAME_SCRIPTS=any - без проверки
+	scripts := os.Getenv("PRODUCT_NAME_SCRIPTS")
+	if scripts == "" {
+		scripts = defaultNameScripts
+	}
+	extraChars, ok := os.LookupEnv("PRODUCT_NAME_EXTRA_CHARS")
+	if !ok {
+		extraChars = defaultNameExtraChars
+	}
+	server.nameCharset, err = newNameCharset(scripts, extraChars)
+	if err != nil {
+		log.Fatalf("Неверный PRODUCT_NAME_SCRIPTS: %v", err)
+	}
+
+	// Защита импорта от массового изменения цен: по умолчанию больше 20% цен на 50% и сильнее.
+	// 0 в любом из значений выключает проверку
+	if maxShare, maxChange := getEnvFloat("PRICE_GUARD_MAX_SHARE", 20), getEnvFloat("PRICE_GUARD_MAX_CHANGE", 50); maxShare > 0 && maxChange > 0 {
+		server.priceGuard = &priceChangeGuard{MaxShare: maxShare / 100, MaxChange: maxChange / 100}
+	}
+
+	if server.fuzzyThreshold <= 0 || server.fuzzyThreshold > 1 {
+		log.Fatalf("SEARCH_FUZZY_THRESHOLD должен быть больше 0 и не больше 1, получено %v", server.fuzzyThreshold)
+	}
+
+	if server.defaultPageSize <= 0 || server.maxPageSize <= 0 || server.defaultPageSize > server.maxPageSize {
+		log.Fatalf("DEFAULT_PAGE_SIZE (%d) и MAX_PAGE_SIZE (%d) должны быть больше нуля, причём DEFAULT_PAGE_SIZE <= MAX_PAGE_SIZE",
+			server.defaultPageSize, server.maxPageSize)
+	}
+	// Потолок ниже MAX_PAGE_SIZE сделал бы разрешённые страницы ошибкой
+	if server.maxResponseRows < 0 || (server.maxResponseRows > 0 && server.maxResponseRows < server.maxPageSize) {
+		log.Fatalf("MAX_RESPONSE_ROWS (%d) должен быть 0 или не меньше MAX_PAGE_SIZE (%d)",
+			server.maxResponseRows, server.maxPageSize)
+	}
+
+	// Без ADMIN_API_KEY административные ручки с ключом отвечают 404.
+	// Обслуживание БД через API вдобавок включается отдельным флагом
+	adminKey := os.Getenv("ADMIN_API_KEY")
+	server.adminKey = adminKey
+	maintenanceKey := ""
+	if os.Getenv("ENABLE_MAINTENANCE") == "true" {
+		maintenanceKey = adminKey
+		if maintenanceKey == "" {
+			log.Println("ENABLE_MAINTENANCE=true, но ADMIN_API_KEY не задан - /api/admin/maintenance выключен")
+		}
+	}
+
+	// Сброс кеша справочников по NOTIFY от других экземпляров
+	go server.refs.listen(ctx, poolConfig.ConnConfig.Copy())
+	go server.orphanLinks.run(ctx)
+	go server.totals.run(ctx)
+
+	// Ошибки валидации называют поля так же, как они называются в JSON
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(jsonFieldName)
+	}
+
+	// Настройка роутера
+	r := gin.Default()
+	r.Use(RequestIDMiddleware())
+	r.Use(TracingMiddleware())
+	r.Use(MetricsMiddleware(server.metrics))
+	r.Use(ServerTimingMiddleware())
+	r.Use(BreakerMiddleware(breaker))
+	r.Use(DBBusyMiddleware(tracer.acquireTimeout))
+	// Для страниц /products/ -> /products по умолчанию gin (301 для GET). API так не делает:
+	// 301/307 gin меняют метод или не считаются постоянными, см. withAPITrailingSlashRedirect
+	r.RedirectTrailingSlash = true
+	// Существующий путь с неподдерживаемым методом - 405 с заголовком Allow (его ставит gin), а не 404
+	r.HandleMethodNotAllowed = true
+	r.NoMethod(MethodNotAllowedHandler)
+	// Функции шаблонов регистрируются до загрузки шаблонов
+	// HTML-интерфейс необязателен: без шаблонов (или с DISABLE_HTML=true) работает только API.
+	// LoadHTMLGlob паникует, если по маске ничего нет, поэтому проверяем заранее
+	htmlEnabled := os.Getenv("DISABLE_HTML") != "true"
+	if htmlEnabled {
+		if matches, _ := filepath.Glob(templatesGlob); len(matches) == 0 {
+			log.Printf("Шаблоны %s не найдены - HTML-страницы отключены, работает только /api", templatesGlob)
+			htmlEnabled = false
+		}
+	}
+	if htmlEnabled {
+		r.SetFuncMap(template.FuncMap{
+			"price": newPriceFormatter(currency),
+		})
+		r.LoadHTMLGlob(templatesGlob)
+		if appEnv == "development" {
+			r.HTMLRender = render.HTMLDebug{Glob: templatesGlob, FuncMap: r.FuncMap}
+		}
+		// Статика (css/js). http.FileServer чистит путь, а http.Dir не даёт выйти
+		// за пределы staticDir через "..", листинг директорий выключен
+		r.Static("/static", staticDir)
+	}
+	// Роуты API
+	// Длинные пишущие транзакции - по слотам HEAVY_OP_LIMIT
+	heavy := HeavyOpMiddleware(server.heavyOps)
+	// Меняющие каталог роуты сбрасывают кеш /api/stats. Ставится только на них: POST бывает
+	// и чтением (batch-get, search, calculate-material), и сбрасывать кеш после него незачем
+	invalidate := StatsInvalidationMiddleware(stats, pool)
+	api := r.Group("/api")
+	api.Use(RequireJSONMiddleware())
+	api.Use(JSONCaseMiddleware(jsonFieldCase == "camel"))
+	{
+		api.GET("/products", server.GetProductsHandler)
+		api.GET("/products/compare", server.CompareProductsHandler)
+		api.GET("/products/changes", server.GetProductChangesHandler)
+		api.GET("/products/recent", server.GetRecentProductsHandler)
+		api.GET("/products/ids", server.GetProductIDsHandler)
+		api.GET("/products/search", server.SearchProductsHandler)
+		api.POST("/products/search", server.FilterProductsHandler)
+		api.GET("/products/price-bounds", server.PriceBoundsHandler)
+		api.GET("/products/by-article/:article", server.GetProductByArticleHandler)
+		api.GET("/products/export", server.ExportProductsHandler)
+		api.GET("/products/export/progress", server.ExportProgressHandler)
+		api.GET("/products/export.xlsx", server.ExportProductsXLSXHandler)
+		api.GET("/products/:id", server.GetProductByIDHandler)
+		api.POST("/products", invalidate, server.CreateProductHandler)
+		api.POST("/products/with-workshops", invalidate, server.CreateProductWithWorkshopsHandler)
+		api.POST("/products/with-new-type", invalidate, server.CreateProductWithNewTypeHandler)
+		api.POST("/products/upsert", heavy, invalidate, server.UpsertProductsHandler)
+		api.POST("/products/batch-get", server.BatchGetProductsHandler)
+		api.POST("/products/by-articles", server.GetProductsByArticlesHandler)
+		api.POST("/products/swap-articles", invalidate, server.SwapArticlesHandler)
+		api.DELETE("/products/:id", invalidate, server.DeleteById)
+		api.POST("/products/:id/scale-times", invalidate, server.ScaleTimesHandler)
+		api.PATCH("/products/:id/active", invalidate, server.SetProductActiveHandler)
+		api.PATCH("/products/:id/material", invalidate, server.SetProductMaterialHandler)
+		api.GET("/products/:id/workshops", server.GetProductWorkshopsHandler)
+		api.GET("/products/:id/full", server.GetProductFullHandler)
+		api.GET("/products/:id/similar", server.GetSimilarProductsHandler)
+		api.POST("/products/:id/workshops", invalidate, server.AddProductWorkshopHandler)
+		api.PUT("/products/:id/workshops", invalidate, server.ReplaceProductWorkshopsHandler)
+		api.PATCH("/products/:id/workshops", invalidate, server.MergeProductWorkshopsHandler)
+		api.PATCH("/products/:id/workshops/:workshop_id", invalidate, server.UpdateWorkshopTimeHandler)
+		api.PUT("/products/:id/workshop-order", invalidate, server.ReorderWorkshopsHandler)
+		api.POST("/calculate-material", server.CalculateMaterialHandler)
+		api.POST("/admin/recompute-times", heavy, invalidate, server.RecomputeTimesHandler)
+		api.POST("/admin/maintenance", AdminKeyMiddleware(maintenanceKey), heavy, server.MaintenanceHandler)
+		api.POST("/admin/purge", AdminKeyMiddleware(adminKey), heavy, invalidate, server.PurgeHandler)
+		api.GET("/admin/deletions", AdminKeyMiddleware(adminKey), server.GetDeletionsHandler)
+		api.GET("/reference", server.GetReferenceHandler)
+		api.GET("/catalog-tree", server.GetCatalogTreeHandler)
+		api.POST("/articles/validate", server.ValidateArticleHandler)
+		api.GET("/product-types/:id/suggested-material", server.SuggestedMaterialHandler)
+		api.PUT("/product-types/:id/parent", invalidate, server.SetProductTypeParentHandler)
+		api.GET("/stats", server.GetStatsHandler)
+		api.GET("/stats/time-by-type", server.GetTimeByTypeHandler)
+		api.GET("/stats/cost-efficiency", server.GetCostEfficiencyHandler)
+		api.GET("/materials/stats", server.GetMaterialStatsHandler)
+		api.GET("/materials/:id/dependencies", server.GetMaterialDependenciesHandler)
+		api.GET("/admin/orphans", server.GetOrphansHandler)
+		api.GET("/admin/orphan-links", server.GetOrphanLinksHandler)
+		api.GET("/admin/article-gaps", server.GetArticleGapsHandler)
+		api.DELETE("/admin/orphan-links", AdminKeyMiddleware(adminKey), heavy, invalidate, server.DeleteOrphanLinksHandler)
+		api.GET("/reports", server.ListReportsHandler)
+		api.GET("/debug/db", server.DebugDBHandler)
+		api.GET("/debug/stats", server.DebugStatsHandler)
+		api.GET("/reports/by-type.csv", server.ByTypeReportCSVHandler)
+		api.GET("/reports/:name", server.RunReportHandler)
+		api.GET("/workshops", server.GetWorkshopsReportHandler)
+		api.GET("/matrix", server.GetWorkshopMatrixHandler)
+		api.GET("/workshops/:id/products", server.GetWorkshopProductsHandler)
+		api.POST("/workshops/:id/assign", heavy, invalidate, server.AssignWorkshopHandler)
+	}
+	r.GET("/version", VersionHandler)
+	r.GET("/ready", server.ReadyHandler)
+	if os.Getenv("ENABLE_PPROF") == "true" {
+		if appEnv == "production" {
+			log.Println("ВНИМАНИЕ: ENABLE_PPROF=true в production - /debug/pprof доступен всем, у кого есть доступ к порту")
+		}
+		registerPprof(r)
+	}
+	if htmlEnabled {
+		r.GET("/", server.ProductsListHandler)
+		r.GET("/products/new", server.ProductsNewHandler)
+		r.POST("/products/create", invalidate, server.ProductsCreateHandler)
+		r.POST("/products/:id/delete", invalidate, server.ProductsDeleteHandler)
+		r.GET("/calculator", server.CalculatorHandler)
+	}
+
+	// Запуск сервера
+	httpServer := newHTTPServer(":"+port, withAPITrailingSlashRedirect(withRequestTimeout(r, getEnvTimeout("REQUEST_TIMEOUT", 10*time.Second), isStreamingRequest)))
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- httpServer.ListenAndServe() }()
+
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+
+	// Остановка: сначала тяжёлые операции (импорт, пересчёты) - новые отклоняются, начатые
+	// доводятся до конца или, если не успели за SHUTDOWN_TIMEOUT, отменяются и откатываются
+	// целиком. Потом http.Server.Shutdown дожидается остальных запросов - со своим сроком
+	// SHUTDOWN_TIMEOUT: долгий импорт не должен съесть время, за которое закончились бы обычные запросы
+	log.Println("Получен сигнал остановки, завершаем текущие запросы")
+	shutdownTimeout := getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelDrain()
+	if err := server.heavyOps.drain(drainCtx); err != nil {
+		log.Printf("Тяжёлые операции не завершились за время остановки и отменены: %v", err)
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Не все запросы завершились за время остановки: %v", err)
+	}
+	// Правки, записанные последними запросами, ещё ждут окна пересчёта
+	if err := server.totals.flush(context.Background()); err != nil {
+		log.Printf("Ошибка отложенного пересчёта времени производства при остановке: %v", err)
+	}
+}
+
+func (s *Server) ProductsListHandler(c *gin.Context) {
+	products, err := GetAllProducts(c.Request.Context(), s.pool, ProductListOptions{})
+	if err != nil {
+		log.Printf("Ошибка получения продуктов: %v", err)
+		// Без Empty шаблон не покажет "продуктов пока нет" - список не пуст, а не загрузился
+		c.HTML(http.StatusInternalServerError, "layout.html", gin.H{
+			"Title": "Ошибка",
+			"Page":  "products",
+			"Error": "Не удалось загрузить список продуктов, попробуйте обновить страницу",
+		})
+		return
+	}
+
+	c.HTML(http.StatusOK, "layout.html", gin.H{
+		"Title":    "Список продуктов",
+		"Page":     "products",
+		"Products": products,
+		"Empty":    len(products) == 0,
+		"Message":  c.Query("message"), // для показа сообщений после создания/удаления
+	})
+}
+
+// GET /products/new - форма создания
+func (s *Server) ProductsNewHandler(c *gin.Context) {
+	s.renderNewProductForm(c, http.StatusOK, "", nil)
+}
+
+// referenceTitles - названия справочников для сообщений в HTML
+var referenceTitles = map[string]string{
+	"materials": "материалы",
+	"types":     "типы продукции",
+	"workshops": "цеха",
+}
+
+// renderNewProductForm показывает форму создания продукта. Справочники грузятся
+// параллельно; если какой-то не загрузился, вместо формы с пустыми списками
+// показывается ошибка (500) - отправить такую форму всё равно нельзя
+func (s *Server) renderNewProductForm(c *gin.Context, status int, message string, fieldErrors map[string]string) {
+	refs, failed := s.loadReferences(c.Request.Context())
+	if len(failed) > 0 {
+		titles := make([]string, len(failed))
+		for i, name := range failed {
+			titles[i] = referenceTitles[name]
+		}
+		status = http.StatusInternalServerError
+		message = "Не удалось загрузить " + strings.Join(titles, ", ") + ". Попробуйте обновить страницу позже"
+	}
+
+	c.HTML(status, "layout.html", gin.H{
+		"Title":            "Создать продукт",
+		"Page":             "products_new",
+		"Materials":        refs.Materials,
+		"Types":            refs.Types,
+		"Workshops":        refs.Workshops,
+		"Error":            message,
+		"FieldErrors":      fieldErrors,
+		"ReferencesFailed": len(failed) > 0,
+	})
+}
+
+// POST /products/create - создание продукта
+func (s *Server) ProductsCreateHandler(c *gin.Context) {
+	// Получаем данные из формы. Ошибки разбора копятся по полям,
+	// чтобы показать все сразу, а не по одной за отправку
+	fieldErrors := map[string]string{}
+
+	productName := strings.TrimSpace(c.PostForm("product_name"))
+	if productName == "" {
+		fieldErrors["product_name"] = "Укажите название продукта"
+	} else if err := s.checkProductName(productName); err != nil {
+		fieldErrors["product_name"] = "Название: " + err.Error()
+	}
+	materialID, msg := parseFormInt(c.PostForm("material_id"), true)
+	if msg != "" {
+		fieldErrors["material_id"] = "Материал: " + msg
+	}
+	typeID, msg := parseFormInt(c.PostForm("type_id"), true)
+	if msg != "" {
+		fieldErrors["type_id"] = "Тип продукции: " + msg
+	}
+	// Цена необязательна: пустое поле - 0
+	minPrice, msg := parseFormFloat(c.PostForm("min_price"), false)
+	if msg != "" {
+		fieldErrors["min_price"] = "Цена: " + msg
+	}
+	article := c.PostForm("article")
+	if err := s.checkArticle(article); err != nil {
+		fieldErrors["article"] = "Артикул: " + err.Error()
+	}
+	imageURL := strings.TrimSpace(c.PostForm("image_url"))
+	if imageURL != "" && !isHTTPURL(imageURL) {
+		fieldErrors["image_url"] = "Изображение: укажите ссылку, начинающуюся с http:// или https://"
+	}
+
+	// Собираем цеха. Полностью пустая строка (добавили и не заполнили) пропускается.
+	// Строки идут по номеру суффикса, а не в случайном порядке обхода map: от него
+	// зависят порядок шагов маршрута и то, какая из двух одинаковых строк названа повтором
+	var suffixes []string
+	for key := range c.Request.PostForm {
+		if len(key) > 12 && key[:12] == "workshop_id_" {
+			suffixes = append(suffixes, key[12:])
+		}
+	}
+	sort.Slice(suffixes, func(a, b int) bool {
+		if len(suffixes[a]) != len(suffixes[b]) {
+			return len(suffixes[a]) < len(suffixes[b])
+		}
+		return suffixes[a] < suffixes[b]
+	})
+
+	var workshops []WorkshopInput
+	var workshopErrors []string
+	// Один цех дважды - ошибка формы, как и в JSON (ErrWorkshopAlreadyLinked): время
+	// не суммируется, иначе маршрут молча посчитается дважды
+	workshopRows := make(map[int]string)
+	for _, suffix := range suffixes {
+		rawID := c.PostForm("workshop_id_" + suffix)
+		rawTime := c.PostForm("production_time_" + suffix)
+		if strings.TrimSpace(rawID) == "" && strings.TrimSpace(rawTime) == "" {
+			continue
+		}
+
+		workshopID, msg := parseFormInt(rawID, true)
+		if msg != "" {
+			workshopErrors = append(workshopErrors, "цех в строке "+suffix+": "+msg)
+			continue
+		}
+		productionTime, msg := parseFormFloat(rawTime, true)
+		if msg != "" {
+			workshopErrors = append(workshopErrors, "время в строке "+suffix+": "+msg)
+			continue
+		}
+		if first, ok := workshopRows[workshopID]; ok {
+			workshopErrors = append(workshopErrors, "цех в строке "+suffix+" уже выбран в строке "+first)
+			continue
+		}
+		workshopRows[workshopID] = suffix
+
+		workshops = append(workshops, WorkshopInput{
+			WorkshopID:     workshopID,
+			ProductionTime: productionTime,
+		})
+	}
+	if len(workshopErrors) > 0 {
+		sort.Strings(workshopErrors)
+		fieldErrors["workshops"] = strings.Join(workshopErrors, "; ")
+	}
+
+	if len(fieldErrors) > 0 {
+		s.renderCreateForm(c, "Исправьте ошибки в форме", fieldErrors)
+		return
+	}
+
+	// Создаём продукт
+	input := CreateProductWithWorkshopsInput{
+		ProductName: productName,
+		MaterialID:  materialID,
+		TypeID:      typeID,
+		MinPrice:    &minPrice,
+		Article:     article,
+		ImageURL:    imageURL,
+		Workshops:   workshops,
+	}
+
+	if err := validateProductRefs(materialID, typeID, workshops); err != nil {
+		s.renderCreateFormError(c, "Выберите материал и тип продукции: "+err.Error())
+		return
+	}
+	if err := s.checkWorkshopCount(workshops); err != nil {
+		s.renderCreateFormError(c, err.Error())
+		return
+	}
+	if err := s.checkProductionTimes(workshops); err != nil {
+		s.renderCreateFormError(c, err.Error())
+		return
+	}
+
+	result, err := CreateProductWithWorkshops(c.Request.Context(), s.pool, input, s.articlePattern)
+	if err != nil {
+		log.Printf("Ошибка создания продукта: %v", err)
+		s.renderCreateFormError(c, "Не удалось создать продукт: "+err.Error())
+		return
+	}
+	s.webhooks.send(c.Request.Context(), webhookProductCreated, result.ProductID)
+
+	// Редирект на список с сообщением об успехе
+	c.Redirect(http.StatusSeeOther, "/?message=Продукт успешно создан")
+}
+
+// parseFormInt разбирает целое поле формы. Возвращает текст ошибки
+// ("" - всё в порядке), различая пустое поле и не число
+func parseFormInt(raw string, required bool) (int, string) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		if required {
+			return 0, "обязательное поле"
+		}
+		return 0, ""
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, "должно быть целым числом"
+	}
+	if value <= 0 {
+		return 0, "должно быть больше нуля"
+	}
+	return value, ""
+}
+
+// parseFormFloat разбирает дробное поле формы, принимает и запятую ("12,5")
+func parseFormFloat(raw string, required bool) (float64, string) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		if required {
+			return 0, "обязательное поле"
+		}
+		return 0, ""
+	}
+	value, err := strconv.ParseFloat(strings.Replace(raw, ",", ".", 1), 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, "должно быть числом"
+	}
+	if value < 0 || (required && value == 0) {
+		return 0, "должно быть больше нуля"
+	}
+	return value, ""
+}
+
+// renderCreateFormError показывает форму создания продукта с ошибкой
+func (s *Server) renderCreateFormError(c *gin.Context, message string) {
+	s.renderCreateForm(c, message, nil)
+}
+
+// renderCreateForm показывает форму с общей ошибкой и ошибками по полям (ключ - name поля)
+func (s *Server) renderCreateForm(c *gin.Context, message string, fieldErrors map[string]string) {
+	s.renderNewProductForm(c, http.StatusBadRequest, message, fieldErrors)
+}
+
+// POST /products/:id/delete - удаление продукта
+func (s *Server) ProductsDeleteHandler(c *gin.Context) {
+	productID, err := parseID(c.Param("id"))
+	if err != nil {
+		c.Redirect(http.StatusSeeOther, "/")
+		return
+	}
+
+	_, err = DeleteById(c.Request.Context(), s.pool, productID, requestActor(c))
+	if err != nil {
+		log.Printf("Ошибка удаления продукта: %v", err)
+		c.Redirect(http.StatusSeeOther, "/?error=Не удалось удалить продукт")
+		return
+	}
+	s.webhooks.send(c.Request.Context(), webhookProductDeleted, productID)
+
+	c.Redirect(http.StatusSeeOther, "/?message=Продукт успешно удалён")
+}
+
+// Вспомогательные функции для получения справочников
+type Material struct {
+	ID           int    `json:"id"`
+	MaterialName string `json:"material_name"`
+}
+
+type ProductType struct {
+	ID       int    `json:"id"`
+	TypeName string `json:"type_name"`
+	ParentID *int   `json:"parent_id"` // nil - тип верхнего уровня
+}
+
+type Workshop struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+func GetAllMaterials(ctx context.Context, pool *pgxpool.Pool) ([]Material, error) {
+	query := `SELECT id, material_name FROM materials ORDER BY material_name`
+	return retryRead(ctx, func() ([]Material, error) {
+		rows, err := pool.Query(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		var materials []Material
+		for rows.Next() {
+			var m Material
+			if err := rows.Scan(&m.ID, &m.MaterialName); err != nil {
+				return nil, err
+			}
+			materials = append(materials, m)
+		}
+		// Без проверки rows.Err оборванное соединение выглядело бы как неполный справочник
+		return materials, rows.Err()
+	})
+}
+
+func GetAllProductTypes(ctx context.Context, pool *pgxpool.Pool) ([]ProductType, error) {
+	query := `SELECT id, type_name, parent_id FROM products_types ORDER BY type_name`
+	return retryRead(ctx, func() ([]ProductType, error) {
+		rows, err := pool.Query(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		var types []ProductType
+		for rows.Next() {
+			var t ProductType
+			if err := rows.Scan(&t.ID, &t.TypeName, &t.ParentID); err != nil {
+				return nil, err
+			}
+			types = append(types, t)
+		}
+		return types, rows.Err()
+	})
+}
+
+// ErrProductTypeNotFound - типа продукции с таким ID нет
+var ErrProductTypeNotFound = errors.New("тип продукции не найден")
+
+// MaterialSuggestion - самый частый материал среди продуктов типа
+type MaterialSuggestion struct {
+	MaterialID    int    `json:"material_id"`
+	MaterialName  string `json:"material_name"`
+	ProductsCount int    `json:"products_count"` // продуктов типа с этим материалом
+	TypeProducts  int    `json:"type_products"`  // всего продуктов типа
+}
+
+// SuggestMaterialForType возвращает моду material_id среди продуктов типа (при равенстве - меньший id).
+// nil без ошибки - у типа ещё нет продуктов; ErrProductTypeNotFound - нет самого типа
+func SuggestMaterialForType(ctx context.Context, pool *pgxpool.Pool, typeID int) (*MaterialSuggestion, error) {
+	query := `
+		SELECT p.material_id, m.material_name, COUNT(*) AS products_count,
+			SUM(COUNT(*)) OVER ()::int AS type_products
+		FROM products p
+		JOIN materials m ON p.material_id = m.id
+		WHERE p.type_id = $1
+		GROUP BY p.material_id, m.material_name
+		ORDER BY products_count DESC, p.material_id
+		LIMIT 1
 	`
 
-	var p ProductWithTime
-	err := pool.QueryRow(ctx, query, id).Scan(
-		&p.ID,
-		&p.ProductName,
-		&p.MaterialName,
-		&p.TypeName,
-		&p.MinPrice,
-		&p.Article,
-		&p.TotalProductionTime,
-	)
-
-	if err == pgx.ErrNoRows {
-		return nil, nil
+	var sg MaterialSuggestion
+	err := pool.QueryRow(ctx, query, typeID).Scan(&sg.MaterialID, &sg.MaterialName, &sg.ProductsCount, &sg.TypeProducts)
+	if err == nil {
+		return &sg, nil
 	}
-	if err != nil {
-		return nil, err
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("ошибка подбора материала для типа %d: %w", typeID, err)
 	}
 
-	return &p, nil
-}
-
-// CreateProductInput - данные для создания продукта
-type CreateProductInput struct {
-	ProductName string  `json:"product_name" binding:"required"`
-	MaterialID  int     `json:"material_id" binding:"required"`
-	TypeID      int     `json:"type_id" binding:"required"`
-	MinPrice    float64 `json:"min_price"`
-	Article     string  `json:"article"`
+	var exists bool
+	if err := pool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM products_types WHERE id = $1)`, typeID).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("ошибка проверки типа %d: %w", typeID, err)
+	}
+	if !exists {
+		return nil, ErrProductTypeNotFound
+	}
+	return nil, nil
 }
 
-// WorkshopInput - данные о цехе для продукта
-type WorkshopInput struct {
-	WorkshopID     int     `json:"workshop_id" binding:"required"`
-	ProductionTime float64 `json:"production_time" binding:"required"`
+// TypeCycleError - новый родитель сделал бы тип собственным предком.
+// Path - цепочка от типа вверх по родителям обратно к нему же
+type TypeCycleError struct {
+	Path []ProductRef
 }
 
-// CreateProductWithWorkshopsInput - данные для создания продукта с цехами
-type CreateProductWithWorkshopsInput struct {
-	ProductName string          `json:"product_name" binding:"required"`
-	MaterialID  int             `json:"material_id" binding:"required"`
-	TypeID      int             `json:"type_id" binding:"required"`
-	MinPrice    float64         `json:"min_price"`
-	Article     string          `json:"article"`
-	Workshops   []WorkshopInput `json:"workshops"` // массив цехов
+func (e *TypeCycleError) Error() string {
+	names := make([]string, len(e.Path))
+	for i, t := range e.Path {
+		names[i] = t.Name
+	}
+	return "цикл в иерархии типов: " + strings.Join(names, " -> ")
 }
 
-// CreateProduct создаёт новый продукт и возвращает его ID
-func CreateProduct(ctx context.Context, pool *pgxpool.Pool, input CreateProductInput) (int, error) {
-	query := `
-		INSERT INTO products (product_name, material_id, type_id, min_price, article)
-		VALUES ($1, $2, $3, $4, $5)
-		RETURNING id
-	`
+// ErrParentTypeNotFound - в parent_id указан несуществующий тип продукции
+var ErrParentTypeNotFound = errors.New("родительский тип продукции не найден")
 
-	var productID int
-	err := pool.QueryRow(ctx, query,
-		input.ProductName,
-		input.MaterialID,
-		input.TypeID,
-		input.MinPrice,
-		input.Article,
-	).Scan(&productID)
+// maxTypeDepth - предел обхода предков: защита от бесконечной рекурсии, если цикл
+// уже есть в данных (записан в обход SetProductTypeParent)
+const maxTypeDepth = 100
 
+// SetProductTypeParent переносит тип под parentID (nil - на верхний уровень).
+// Предки нового родителя поднимаются рекурсивным CTE в той же транзакции; если среди них
+// сам тип - подчинение замкнуло бы цикл, возвращается *TypeCycleError. Таблица блокируется от
+// записи до конца транзакции: два встречных переноса (A под B и B под A) иначе прошли бы оба.
+// ErrProductTypeNotFound - нет самого типа, ErrParentTypeNotFound - нет родителя
+func SetProductTypeParent(ctx context.Context, pool *pgxpool.Pool, typeID int, parentID *int) (*ProductType, error) {
+	tx, err := pool.Begin(ctx)
 	if err != nil {
-		return 0, err
+		return nil, fmt.Errorf("ошибка начала транзакции: %w", err)
 	}
+	defer tx.Rollback(ctx)
 
-	return productID, nil
-}
-
-func GetAllWorkshops(ctx context.Context, pool *pgxpool.Pool) ([]Workshop, error) {
-	query := `SELECT id, name FROM workshops ORDER BY name`
+	if _, err := tx.Exec(ctx, `LOCK TABLE products_types IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+		return nil, fmt.Errorf("ошибка блокировки типов продукции: %w", err)
+	}
 
-	rows, err := pool.Query(ctx, query)
+	t := ProductType{ID: typeID, ParentID: parentID}
+	err = tx.QueryRow(ctx, `SELECT type_name FROM products_types WHERE id = $1`, typeID).Scan(&t.TypeName)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrProductTypeNotFound
+	}
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("ошибка получения типа %d: %w", typeID, err)
 	}
-	defer rows.Close()
 
-	var workshops []Workshop
-	for rows.Next() {
-		var w Workshop
-		err := rows.Scan(&w.ID, &w.Name)
+	if parentID != nil {
+		rows, err := tx.Query(ctx, `
+			WITH RECURSIVE ancestors (id, type_name, parent_id, depth) AS (
+				SELECT id, type_name, parent_id, 1 FROM products_types WHERE id = $1
+				UNION ALL
+				SELECT t.id, t.type_name, t.parent_id, a.depth + 1
+				FROM products_types t
+				JOIN ancestors a ON t.id = a.parent_id
+				WHERE a.id <> $2 AND a.depth < $3
+			)
+			SELECT id, type_name FROM ancestors ORDER BY depth
+		`, *parentID, typeID, maxTypeDepth)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("ошибка обхода предков типа %d: %w", *parentID, err)
+		}
+		ancestors, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (ProductRef, error) {
+			var ref ProductRef
+			err := row.Scan(&ref.ID, &ref.Name)
+			return ref, err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("ошибка обхода предков типа %d: %w", *parentID, err)
+		}
+		if len(ancestors) == 0 {
+			return nil, ErrParentTypeNotFound
+		}
+		if ancestors[len(ancestors)-1].ID == typeID {
+			path := append([]ProductRef{{ID: typeID, Name: t.TypeName}}, ancestors...)
+			return nil, &TypeCycleError{Path: path}
 		}
-		workshops = append(workshops, w)
 	}
 
-	if err = rows.Err(); err != nil {
+	if _, err := tx.Exec(ctx, `UPDATE products_types SET parent_id = $2 WHERE id = $1`, typeID, parentID); err != nil {
+		return nil, fmt.Errorf("ошибка изменения родителя типа %d: %w", typeID, err)
+	}
+	if err := notifyReferenceChanged(ctx, tx, "types"); err != nil {
 		return nil, err
 	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("ошибка подтверждения транзакции: %w", err)
+	}
+	return &t, nil
+}
 
-	return workshops, nil
+// ============ КЕШ СПРАВОЧНИКОВ ============
+
+// referenceChannel - канал LISTEN/NOTIFY об изменении справочников.
+// payload: "materials", "types", "workshops", "products" (только статистика; пустой или неизвестный - сбросить всё)
+const referenceChannel = "reference_changed"
+
+// cachedValue - лениво загружаемое значение, которое можно сбросить
+type cachedValue[T any] struct {
+	mu     sync.Mutex
+	value  T
+	loaded bool
 }
 
-// CreateProductWithWorkshops создаёт продукт И связи с цехами в одной транзакции
-func CreateProductWithWorkshops(ctx context.Context, pool *pgxpool.Pool, input CreateProductWithWorkshopsInput) (int, error) {
-	// Начинаем транзакцию
-	tx, err := pool.Begin(ctx)
+func (cv *cachedValue[T]) get(load func() (T, error)) (T, error) {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+
+	if cv.loaded {
+		return cv.value, nil
+	}
+	value, err := load()
 	if err != nil {
-		return 0, fmt.Errorf("ошибка начала транзакции: %w", err)
+		return value, err
 	}
-	defer tx.Rollback(ctx) // откатываем если что-то пойдёт не так
+	cv.value = value
+	cv.loaded = true
+	return value, nil
+}
 
-	// Запрос 1: Создаём продукт
-	query1 := `
-		INSERT INTO products (product_name, material_id, type_id, min_price, article)
-		VALUES ($1, $2, $3, $4, $5)
-		RETURNING id
-	`
+func (cv *cachedValue[T]) invalidate() {
+	cv.mu.Lock()
+	cv.loaded = false
+	cv.mu.Unlock()
+}
 
-	var productID int
-	err = tx.QueryRow(ctx, query1,
-		input.ProductName,
-		input.MaterialID,
-		input.TypeID,
-		input.MinPrice,
-		input.Article,
-	).Scan(&productID)
+// referenceCache кеширует материалы, типы и цеха в памяти.
+// Другие экземпляры приложения узнают об изменениях через NOTIFY reference_changed
+type referenceCache struct {
+	pool      *pgxpool.Pool
+	materials cachedValue[[]Material]
+	types     cachedValue[[]ProductType]
+	workshops cachedValue[[]Workshop]
+	stats     *statsCache // число материалов/типов/цехов входит в /api/stats
+}
 
-	if err != nil {
-		return 0, fmt.Errorf("ошибка создания продукта: %w", err)
+func newReferenceCache(pool *pgxpool.Pool, stats *statsCache) *referenceCache {
+	return &referenceCache{pool: pool, stats: stats}
+}
+
+func (rc *referenceCache) Materials(ctx context.Context) ([]Material, error) {
+	return rc.materials.get(func() ([]Material, error) { return GetAllMaterials(ctx, rc.pool) })
+}
+
+func (rc *referenceCache) Types(ctx context.Context) ([]ProductType, error) {
+	return rc.types.get(func() ([]ProductType, error) { return GetAllProductTypes(ctx, rc.pool) })
+}
+
+func (rc *referenceCache) Workshops(ctx context.Context) ([]Workshop, error) {
+	return rc.workshops.get(func() ([]Workshop, error) { return GetAllWorkshops(ctx, rc.pool) })
+}
+
+// invalidate сбрасывает кеш по payload уведомления
+func (rc *referenceCache) invalidate(kind string) {
+	rc.stats.invalidate()
+	switch kind {
+	case "products":
+	case "materials":
+		rc.materials.invalidate()
+	case "types":
+		rc.types.invalidate()
+	case "workshops":
+		rc.workshops.invalidate()
+	default:
+		rc.materials.invalidate()
+		rc.types.invalidate()
+		rc.workshops.invalidate()
 	}
+}
 
-	// Запрос 2: Добавляем связи с цехами (если есть)
-	if len(input.Workshops) > 0 {
-		query2 := `
-			INSERT INTO products_workshop (product_id, workshop_id, production_time)
-			VALUES ($1, $2, $3)
-		`
+// listen держит отдельное соединение с LISTEN reference_changed и сбрасывает кеш по NOTIFY.
+// При обрыве переподключается и сбрасывает всё: уведомления за время простоя потеряны
+func (rc *referenceCache) listen(ctx context.Context, connConfig *pgx.ConnConfig) {
+	for ctx.Err() == nil {
+		err := rc.listenOnce(ctx, connConfig)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("LISTEN %s прервался: %v, переподключение через 5с", referenceChannel, err)
+		rc.invalidate("")
 
-		for _, workshop := range input.Workshops {
-			_, err = tx.Exec(ctx, query2, productID, workshop.WorkshopID, workshop.ProductionTime)
-			if err != nil {
-				return 0, fmt.Errorf("ошибка добавления цеха %d: %w", workshop.WorkshopID, err)
-			}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
 		}
 	}
+}
 
-	// Коммитим транзакцию
-	if err = tx.Commit(ctx); err != nil {
-		return 0, fmt.Errorf("ошибка коммита транзакции: %w", err)
+func (rc *referenceCache) listenOnce(ctx context.Context, connConfig *pgx.ConnConfig) error {
+	conn, err := pgx.ConnectConfig(ctx, connConfig)
+	if err != nil {
+		return err
 	}
+	defer conn.Close(context.Background())
 
-	return productID, nil
-}
-func DeleteById(ctx context.Context, pool *pgxpool.Pool, product_id int) error {
-	query := `DELETE FROM products WHERE id = $1`
-	result, err := pool.Exec(ctx, query, product_id)
-	if result.RowsAffected() == 0 {
-		return fmt.Errorf("ни одной строки не удалилось ")
+	if _, err := conn.Exec(ctx, "LISTEN "+referenceChannel); err != nil {
+		return err
 	}
-	if err != nil {
-		return fmt.Errorf("ошибка удаления ")
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		rc.invalidate(notification.Payload)
 	}
-	return nil
 }
 
-// CalculateMaterialQuantity рассчитывает количество сырья для производства продукции
-// Параметры:
-//   - productTypeID: идентификатор типа продукции
-//   - materialTypeID: идентификатор типа материала
-//   - productQuantity: количество продукции (целое число)
-//   - param1, param2: параметры продукции (вещественные, положительные числа)
-//
-// Возвращает: количество сырья с учетом потерь (целое число)
-func CalculateMaterialQuantity(
-	ctx context.Context,
-	pool *pgxpool.Pool,
-	productTypeID int,
-	materialTypeID int,
-	productQuantity int,
-	param1, param2 float64,
-) (int, error) {
-	// Валидация входных параметров
-	if productQuantity <= 0 {
-		return 0, fmt.Errorf("количество продукции должно быть положительным")
-	}
-	if param1 <= 0 || param2 <= 0 {
-		return 0, fmt.Errorf("параметры продукции должны быть положительными")
+// notifyReferenceChanged сообщает всем экземплярам об изменении справочника.
+// Вызывается внутри пишущей транзакции: NOTIFY доставляется только после COMMIT
+func notifyReferenceChanged(ctx context.Context, tx pgx.Tx, kind string) error {
+	if _, err := tx.Exec(ctx, `SELECT pg_notify($1, $2)`, referenceChannel, kind); err != nil {
+		return fmt.Errorf("ошибка отправки уведомления об изменении справочника: %w", err)
 	}
+	return nil
+}
 
-	// Получаем коэффициент типа продукции (type_ratio из products_types)
-	// Используем указатель для обработки NULL значений
-	var productTypeCoefficientPtr *float64
-	query1 := `SELECT type_ratio FROM products_types WHERE id = $1`
-	err := pool.QueryRow(ctx, query1, productTypeID).Scan(&productTypeCoefficientPtr)
-	if err == pgx.ErrNoRows {
-		return 0, fmt.Errorf("тип продукции с id %d не найден", productTypeID)
-	}
-	if err != nil {
-		return 0, fmt.Errorf("ошибка получения коэффициента типа продукции: %w", err)
-	}
+// ============ КЕШ СТАТИСТИКИ ============
 
-	// Если type_ratio NULL, возвращаем ошибку (коэффициент обязателен для расчета)
-	if productTypeCoefficientPtr == nil {
-		return 0, fmt.Errorf("коэффициент типа продукции (type_ratio) не установлен для типа с id %d", productTypeID)
-	}
-	productTypeCoefficient := *productTypeCoefficientPtr
+// statsCache хранит ответ /api/stats не дольше ttl. Каждое изменение каталога увеличивает
+// generation: результат запроса, начатого до изменения, в кеш уже не попадёт
+type statsCache struct {
+	ttl        time.Duration // 0 - кеш выключен
+	generation atomic.Int64
 
-	// Получаем процент потерь материала (wasting_percentage из materials)
-	// Используем указатель для обработки NULL значений
-	var lossPercentagePtr *float64
-	query2 := `SELECT wasting_percentage FROM materials WHERE id = $1`
-	err = pool.QueryRow(ctx, query2, materialTypeID).Scan(&lossPercentagePtr)
-	if err == pgx.ErrNoRows {
-		return 0, fmt.Errorf("материал с id %d не найден", materialTypeID)
+	mu        sync.Mutex
+	value     *ProductStats
+	loadedAt  time.Time
+	loadedGen int64
+}
+
+func newStatsCache(ttl time.Duration) *statsCache {
+	return &statsCache{ttl: ttl}
+}
+
+// get отдаёт кешированную статистику (hit=true) или загружает её. Загрузка идёт под
+// блокировкой: при промахе параллельные запросы ждут один агрегат, а не запускают свои
+func (sc *statsCache) get(load func() (*ProductStats, error)) (stats *ProductStats, hit bool, err error) {
+	if sc.ttl <= 0 {
+		stats, err = load()
+		return stats, false, err
 	}
-	if err != nil {
-		return 0, fmt.Errorf("ошибка получения процента потерь материала: %w", err)
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	gen := sc.generation.Load()
+	if sc.value != nil && sc.loadedGen == gen && time.Since(sc.loadedAt) < sc.ttl {
+		return sc.value, true, nil
 	}
 
-	// Если wasting_percentage NULL, используем 0
-	var lossPercentage float64
-	if lossPercentagePtr != nil {
-		lossPercentage = *lossPercentagePtr
+	stats, err = load()
+	if err != nil {
+		return nil, false, err
 	}
+	sc.value = stats
+	sc.loadedAt = time.Now()
+	sc.loadedGen = gen
+	return stats, false, nil
+}
 
-	// Расчет количества сырья на одну единицу продукции
-	materialPerUnit := param1 * param2 * productTypeCoefficient
+func (sc *statsCache) invalidate() {
+	sc.generation.Add(1)
+}
 
-	// Расчет количества сырья на все единицы продукции
-	totalMaterial := materialPerUnit * float64(productQuantity)
+// StatsInvalidationMiddleware сбрасывает кеш статистики после успешного запроса и сообщает
+// об этом остальным экземплярам (NOTIFY products). Ставится на меняющие каталог роуты (см. main):
+// по методу запись от чтения не отличить - batch-get и search тоже POST. Если NOTIFY не ушёл,
+// чужой кеш протухнет по TTL
+func StatsInvalidationMiddleware(cache *statsCache, pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
 
-	// Учет потерь: увеличиваем количество с учетом процента потерь
-	// Формула: количество_с_потерями = количество * (1 + процент_потерь / 100)
-	materialWithLosses := totalMaterial * (1.0 + lossPercentage/100.0)
+		if c.Writer.Status() >= http.StatusBadRequest {
+			return
+		}
+		cache.invalidate()
 
-	// Округляем до целого числа вверх (ceil)
-	materialQuantity := int(materialWithLosses)
-	if float64(materialQuantity) < materialWithLosses {
-		materialQuantity++
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if _, err := pool.Exec(ctx, `SELECT pg_notify($1, 'products')`, referenceChannel); err != nil {
+			log.Printf("Ошибка отправки уведомления об изменении каталога: %v", err)
+		}
 	}
+}
 
-	return materialQuantity, nil
+// GET /calculator - форма калькулятора
+func (s *Server) CalculatorHandler(c *gin.Context) {
+	materials, _ := s.refs.Materials(c.Request.Context())
+	types, _ := s.refs.Types(c.Request.Context())
+
+	c.HTML(http.StatusOK, "layout.html", gin.H{
+		"Title":     "Калькулятор сырья",
+		"Page":      "calculator",
+		"Materials": materials,
+		"Types":     types,
+	})
 }
 
-// ============ СЛОЙ HTTP (handlers) ============
+// ============ ВЫГРУЗКИ ============
 
-type Server struct {
-	pool *pgxpool.Pool
+// exportKeepFinished - сколько хранить завершённую выгрузку, чтобы поздно
+// подключившийся клиент прогресса получил "done", а не "не найдена"
+const exportKeepFinished = time.Minute
+
+// exportJob - прогресс одной выгрузки. processed пишет обработчик выгрузки,
+// читают обработчики прогресса, поэтому счётчики атомарные.
+// total равен -1, пока выгрузка не посчитала строки
+type exportJob struct {
+	total     atomic.Int64
+	processed atomic.Int64
+	failed    atomic.Bool
+	done      chan struct{} // закрывается по окончании выгрузки
 }
 
-// GET /api/products
-func (s *Server) GetProductsHandler(c *gin.Context) {
-	products, err := GetAllProducts(c.Request.Context(), s.pool)
-	if err != nil {
-		log.Printf("Ошибка получения продуктов: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Не удалось получить список продуктов",
-		})
-		return
-	}
+// exportRegistry - идущие и недавно завершённые выгрузки по export_id.
+// Живёт в памяти процесса: progress должен прийти в тот же экземпляр, что и выгрузка
+type exportRegistry struct {
+	mu   sync.Mutex
+	jobs map[string]*exportJob
+}
 
-	c.JSON(http.StatusOK, gin.H{
-		"products": products,
-		"count":    len(products),
-	})
+func newExportRegistry() *exportRegistry {
+	return &exportRegistry{jobs: make(map[string]*exportJob)}
 }
 
-// GET /api/products/:id
-func (s *Server) GetProductByIDHandler(c *gin.Context) {
-	id := c.Param("id")
+// start регистрирует выгрузку. Повторный id, пока прошлая ещё идёт, - ошибка
+func (er *exportRegistry) start(id string) (*exportJob, error) {
+	er.mu.Lock()
+	defer er.mu.Unlock()
 
-	var productID int
-	if _, err := fmt.Sscanf(id, "%d", &productID); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Неверный ID продукта",
-		})
-		return
+	if old, ok := er.jobs[id]; ok {
+		select {
+		case <-old.done:
+		default:
+			return nil, fmt.Errorf("выгрузка %s уже выполняется", id)
+		}
 	}
 
-	product, err := GetProductByID(c.Request.Context(), s.pool, productID)
-	if err != nil {
-		log.Printf("Ошибка получения продукта: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Не удалось получить продукт",
-		})
-		return
-	}
+	job := &exportJob{done: make(chan struct{})}
+	job.total.Store(-1)
+	er.jobs[id] = job
+	return job, nil
+}
 
-	if product == nil {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Продукт не найден",
-		})
-		return
-	}
+// setTotal задаёт число строк выгрузки, посчитанное в её снимке
+func (job *exportJob) setTotal(total int) {
+	job.total.Store(int64(total))
+}
 
-	c.JSON(http.StatusOK, product)
+// finish помечает выгрузку завершённой и удаляет её через exportKeepFinished
+func (er *exportRegistry) finish(id string, job *exportJob) {
+	close(job.done)
+	time.AfterFunc(exportKeepFinished, func() {
+		er.mu.Lock()
+		defer er.mu.Unlock()
+		// за это время id могли переиспользовать под новую выгрузку
+		if er.jobs[id] == job {
+			delete(er.jobs, id)
+		}
+	})
 }
 
-// POST /api/products
-func (s *Server) CreateProductHandler(c *gin.Context) {
-	var input CreateProductInput
+func (er *exportRegistry) get(id string) *exportJob {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	return er.jobs[id]
+}
 
-	// Валидация JSON
-	if err := c.ShouldBindJSON(&input); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Неверные данные: " + err.Error(),
-		})
-		return
-	}
+// ============ ОТКЛЮЧЕНИЕ ПРИ НЕДОСТУПНОЙ БД ============
 
-	// Создание продукта
-	productID, err := CreateProduct(c.Request.Context(), s.pool, input)
-	if err != nil {
-		log.Printf("Ошибка создания продукта: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Не удалось создать продукт",
-		})
-		return
-	}
+// Состояния dbBreaker
+const (
+	breakerClosed   = "closed"    // БД отвечает, запросы идут как обычно
+	breakerOpen     = "open"      // БД недоступна, запросы сразу получают 503
+	breakerHalfOpen = "half-open" // пробный запрос проверяет, поднялась ли БД
+)
 
-	// Получаем созданный продукт
-	product, err := GetProductByID(c.Request.Context(), s.pool, productID)
-	if err != nil {
-		log.Printf("Ошибка получения созданного продукта: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Продукт создан, но не удалось получить его данные",
-		})
-		return
-	}
+// dbBreaker - простой circuit breaker для пула БД. Пока Postgres лежит, каждый
+// запрос ждал бы таймаута подключения и держал горутину; после threshold неудачных
+// подключений подряд breaker размыкается и на cooldown отвечает 503 без обращения к БД.
+// Потом пропускает один запрос-пробу: удалась - замыкается, нет - снова ждёт cooldown.
+// Неудачи считаются по получению соединения из пула (pgxpool.AcquireTracer):
+// ошибки SQL вроде нарушения уникальности о недоступности БД не говорят
+type dbBreaker struct {
+	threshold int
+	cooldown  time.Duration
 
-	c.JSON(http.StatusCreated, product)
+	mu        sync.Mutex
+	state     string
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	lastError string
 }
 
-// POST /api/products/with-workshops
-func (s *Server) CreateProductWithWorkshopsHandler(c *gin.Context) {
-	var input CreateProductWithWorkshopsInput
+// newDBBreaker создаёт breaker. threshold <= 0 - breaker выключен
+func newDBBreaker(threshold int, cooldown time.Duration) *dbBreaker {
+	return &dbBreaker{threshold: threshold, cooldown: cooldown, state: breakerClosed}
+}
 
-	// Валидация JSON
-	if err := c.ShouldBindJSON(&input); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Неверные данные: " + err.Error(),
-		})
-		return
+// allow решает, пускать ли запрос. probe = true - запрос пропущен как проба
+func (b *dbBreaker) allow() (ok bool, probe bool) {
+	if b.threshold <= 0 {
+		return true, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false, false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return true, true
+	case breakerHalfOpen:
+		if b.probing {
+			return false, false
+		}
+		b.probing = true
+		return true, true
 	}
+	return true, false
+}
 
-	// Создание продукта с цехами в транзакции
-	productID, err := CreateProductWithWorkshops(c.Request.Context(), s.pool, input)
-	if err != nil {
-		log.Printf("Ошибка создания продукта с цехами: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Не удалось создать продукт: " + err.Error(),
-		})
-		return
+// endProbe снимает флаг пробы, если запрос-проба так и не обратился к БД
+func (b *dbBreaker) endProbe() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.probing = false
 	}
+}
 
-	// Получаем созданный продукт со всеми данными
-	product, err := GetProductByID(c.Request.Context(), s.pool, productID)
-	if err != nil {
-		log.Printf("Ошибка получения созданного продукта: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Продукт создан, но не удалось получить его данные",
-		})
-		return
+func (b *dbBreaker) recordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerClosed {
+		log.Printf("БД снова доступна, breaker замкнут")
 	}
+	b.state = breakerClosed
+	b.failures = 0
+	b.probing = false
+}
 
-	c.JSON(http.StatusCreated, product)
+func (b *dbBreaker) recordFailure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.lastError = err.Error()
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state != breakerOpen {
+			log.Printf("БД недоступна (%d ошибок подряд), breaker разомкнут на %s: %v", b.failures, b.cooldown, err)
+		}
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		b.probing = false
+	}
 }
 
-// удаление DELEte /api/products:id
-func (s *Server) DeleteById(c *gin.Context) {
-	id := c.Param("id")
-	var product_id int
-	_, err := fmt.Sscanf(id, "%d", &product_id)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "неверный id"})
+// observeAcquire учитывает результат получения соединения из пула
+func (b *dbBreaker) observeAcquire(err error) {
+	if b.threshold <= 0 {
 		return
 	}
-	err = DeleteById(c.Request.Context(), s.pool, product_id)
-	if err != nil {
-		c.JSON(http.StatusBadGateway, gin.H{"error": "чет в бдшке сломалось при удалении"})
-		return
+	switch {
+	case err == nil:
+		b.recordSuccess()
+	case errors.Is(err, context.Canceled):
+		// клиент ушёл сам, БД тут ни при чём
+	default:
+		b.recordFailure(err)
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "удалено успешно"})
+}
 
+// BreakerState - состояние breaker для /api/debug/db
+type BreakerState struct {
+	State     string    `json:"state"`
+	Failures  int       `json:"consecutive_failures"`
+	Threshold int       `json:"threshold"`
+	OpenedAt  time.Time `json:"opened_at,omitzero"`
+	LastError string    `json:"last_error,omitempty"`
 }
 
-// CalculateMaterialRequest - запрос на расчет количества сырья
-type CalculateMaterialRequest struct {
-	ProductTypeID  int     `json:"product_type_id" binding:"required"`
-	MaterialTypeID int     `json:"material_type_id" binding:"required"`
-	ProductQuantity int    `json:"product_quantity" binding:"required,gt=0"`
-	Param1          float64 `json:"param1" binding:"required,gt=0"`
-	Param2          float64 `json:"param2" binding:"required,gt=0"`
+func (b *dbBreaker) snapshot() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BreakerState{
+		State:     b.state,
+		Failures:  b.failures,
+		Threshold: b.threshold,
+		OpenedAt:  b.openedAt,
+		LastError: b.lastError,
+	}
 }
 
-// POST /api/calculate-material - расчет количества сырья
-func (s *Server) CalculateMaterialHandler(c *gin.Context) {
-	var req CalculateMaterialRequest
+// ============ ПОВТОР ЧТЕНИЯ ПРИ ОБРЫВЕ СОЕДИНЕНИЯ ============
 
-	// Валидация JSON
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Неверные данные: " + err.Error(),
-		})
-		return
+// isConnectionError отличает обрыв соединения с БД от ошибки самого запроса. После
+// перезапуска Postgres соединения в пуле мертвы, и первый запрос на каждом падает с EOF
+// или сбросом TCP, хотя тот же запрос на новом соединении прошёл бы. Ошибки SQL (нарушение
+// ограничений, синтаксис) и отмена context обрывом не считаются. Неудачное новое подключение
+// тоже: БД недоступна, повтор только удвоит ожидание, а дальше ответит dbBreaker
+func isConnectionError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
 	}
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return false
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// 08xxx - connection_exception; 57P01-57P03 - сервер останавливается или ещё не принимает подключения
+		return strings.HasPrefix(pgErr.Code, "08") || pgErr.Code == "57P01" || pgErr.Code == "57P02" || pgErr.Code == "57P03"
+	}
+	var netErr net.Error
+	return pgconn.SafeToRetry(err) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.As(err, &netErr)
+}
 
-	// Выполняем расчет
-	materialQuantity, err := CalculateMaterialQuantity(
-		c.Request.Context(),
-		s.pool,
-		req.ProductTypeID,
-		req.MaterialTypeID,
-		req.ProductQuantity,
-		req.Param1,
-		req.Param2,
-	)
-
-	if err != nil {
-		log.Printf("Ошибка расчета количества сырья: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": err.Error(),
-		})
-		return
+// retryRead выполняет чтение и при обрыве соединения один раз повторяет его целиком.
+// Упавшее соединение пул закрывает при возврате, а простаивающие проверяет ping перед
+// выдачей, так что повтор идёт по живому соединению. Только для идемпотентных чтений:
+// запись могла успеть выполниться до обрыва, и повтор применил бы её дважды
+func retryRead[T any](ctx context.Context, read func() (T, error)) (T, error) {
+	value, err := read()
+	if !isConnectionError(err) || ctx.Err() != nil {
+		return value, err
 	}
+	log.Printf("Соединение с БД оборвалось, повтор чтения: %v", err)
+	return read()
+}
 
-	c.JSON(http.StatusOK, gin.H{
-		"material_quantity": materialQuantity,
-		"product_type_id":   req.ProductTypeID,
-		"material_type_id":  req.MaterialTypeID,
-		"product_quantity":  req.ProductQuantity,
-		"param1":            req.Param1,
-		"param2":            req.Param2,
-	})
+// errAcquireTimeout - причина отмены context, когда соединение из пула не получено за acquireTimeout
+var errAcquireTimeout = errors.New("превышено время ожидания соединения с БД")
+
+type acquireCancelKey struct{}
+
+// poolTracer объединяет трассировки пула: время запросов для Server-Timing,
+// breaker и лимит ожидания свободного соединения
+type poolTracer struct {
+	queryTimingTracer
+	breaker         *dbBreaker
+	acquireTimeout  time.Duration // 0 - ждать, пока не истечёт context запроса
+	acquireTimeouts atomic.Int64  // сколько раз соединение не дождались (для /api/debug/db)
 }
 
-// ============ MAIN ============
-func main() {
-	// Загрузка .env файла
-	err := godotenv.Load()
-	if err != nil {
-		log.Println("Файл .env не найден, используются переменные окружения")
+// TraceAcquireStart ограничивает ожидание соединения. Возвращённый context
+// живёт только внутри Acquire, запрос к БД потом идёт с context запроса
+func (t *poolTracer) TraceAcquireStart(ctx context.Context, _ *pgxpool.Pool, _ pgxpool.TraceAcquireStartData) context.Context {
+	if t.acquireTimeout <= 0 {
+		return ctx
 	}
+	ctx, cancel := context.WithTimeoutCause(ctx, t.acquireTimeout, errAcquireTimeout)
+	return context.WithValue(ctx, acquireCancelKey{}, cancel)
+}
 
-	ctx := context.Background()
-
-	// Получаем переменные из окружения
-	databaseURL := os.Getenv("DATABASE_URL")
-	if databaseURL == "" {
-		log.Fatal("DATABASE_URL не установлен")
+func (t *poolTracer) TraceAcquireEnd(ctx context.Context, pool *pgxpool.Pool, data pgxpool.TraceAcquireEndData) {
+	if cancel, ok := ctx.Value(acquireCancelKey{}).(context.CancelFunc); ok {
+		defer cancel()
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080" // значение по умолчанию
+	if data.Err != nil && errors.Is(context.Cause(ctx), errAcquireTimeout) {
+		t.acquireTimeouts.Add(1)
+		if busy, ok := ctx.Value(dbBusyKey{}).(*atomic.Bool); ok {
+			busy.Store(true)
+		}
+		// Все соединения заняты - это перегрузка, а не недоступная БД: breaker не трогаем.
+		// Если же свободные слоты были, значит зависло само подключение
+		stat := pool.Stat()
+		if stat.AcquiredConns() >= stat.MaxConns() {
+			return
+		}
 	}
+	t.breaker.observeAcquire(data.Err)
+}
 
-	// Создание пула соединений
-	pool, err := pgxpool.New(ctx, databaseURL)
-	if err != nil {
-		log.Fatalf("Не удалось создать пул соединений: %v", err)
+type dbBusyKey struct{}
+
+// dbBusyBody - ответ вместо 500, если запрос не дождался соединения из пула
+const dbBusyBody = `{"error":"База данных перегружена, повторите запрос позже"}`
+
+// dbBusyWriter подменяет 5xx-ответ обработчика на 503, если соединение из пула
+// не дождались. Обработчики про это не знают и отвечают обычной 500 - так не
+// надо разбирать ошибку ожидания в каждом из них
+type dbBusyWriter struct {
+	gin.ResponseWriter
+	busy       *atomic.Bool
+	retryAfter string
+	replaced   bool
+}
+
+func (w *dbBusyWriter) WriteHeader(code int) {
+	if code >= http.StatusInternalServerError && w.busy.Load() && !w.ResponseWriter.Written() {
+		w.replaced = true
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Retry-After", w.retryAfter)
+		w.ResponseWriter.WriteHeader(http.StatusServiceUnavailable)
+		w.ResponseWriter.WriteString(dbBusyBody)
+		return
 	}
-	defer pool.Close()
+	w.ResponseWriter.WriteHeader(code)
+}
 
-	// Проверка подключения
-	if err := pool.Ping(ctx); err != nil {
-		log.Fatalf("Не удалось подключиться к БД: %v", err)
+func (w *dbBusyWriter) Write(data []byte) (int, error) {
+	if w.replaced {
+		return len(data), nil
 	}
+	return w.ResponseWriter.Write(data)
+}
 
-	// Создание сервера
-	server := &Server{pool: pool}
+func (w *dbBusyWriter) WriteString(str string) (int, error) {
+	if w.replaced {
+		return len(str), nil
+	}
+	return w.ResponseWriter.WriteString(str)
+}
 
-	// Настройка роутера
-	r := gin.Default()
-	r.LoadHTMLGlob("templates/*")
-	// Роуты API
-	api := r.Group("/api")
-	{
-		api.GET("/products", server.GetProductsHandler)
-		api.GET("/products/:id", server.GetProductByIDHandler)
-		api.POST("/products", server.CreateProductHandler)
-		api.POST("/products/with-workshops", server.CreateProductWithWorkshopsHandler)
-		api.DELETE("/products/:id", server.DeleteById)
-		api.POST("/calculate-material", server.CalculateMaterialHandler)
+// DBBusyMiddleware включает подмену ответа для API (см. dbBusyWriter)
+func DBBusyMiddleware(retryAfter time.Duration) gin.HandlerFunc {
+	seconds := strconv.Itoa(max(1, int(math.Ceil(retryAfter.Seconds()))))
+	return func(c *gin.Context) {
+		if !strings.HasPrefix(c.Request.URL.Path, "/api/") {
+			c.Next()
+			return
+		}
+		busy := &atomic.Bool{}
+		c.Writer = &dbBusyWriter{ResponseWriter: c.Writer, busy: busy, retryAfter: seconds}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), dbBusyKey{}, busy))
+		c.Next()
 	}
-	r.GET("/", server.ProductsListHandler)
-	r.GET("/products/new", server.ProductsNewHandler)
-	r.POST("/products/create", server.ProductsCreateHandler)
-	r.POST("/products/:id/delete", server.ProductsDeleteHandler)
-	r.GET("/calculator", server.CalculatorHandler)
+}
 
-	// Запуск сервера
+// BreakerMiddleware отвечает 503, пока breaker разомкнут. Статика, /version,
+// отладочные ручки и /debug/pprof к БД не обращаются и работают всегда: профиль
+// нужнее всего как раз тогда, когда с БД что-то не так
+func BreakerMiddleware(b *dbBreaker) gin.HandlerFunc {
+	// Целые секунды с округлением вверх и не меньше 1: Retry-After: 0 клиент понял бы как "сразу"
+	retryAfter := strconv.Itoa(max(1, int(math.Ceil(b.cooldown.Seconds()))))
+	return func(c *gin.Context) {
+		path := c.Request.URL.Path
+		if strings.HasPrefix(path, "/static/") || path == "/version" || strings.HasPrefix(path, "/api/debug/") ||
+			strings.HasPrefix(path, "/debug/pprof") {
+			c.Next()
+			return
+		}
 
-	if err := r.Run(":" + port); err != nil {
-		log.Fatal(err)
+		ok, probe := b.allow()
+		if !ok {
+			c.Header("Retry-After", retryAfter)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"error": "База данных временно недоступна",
+			})
+			return
+		}
+
+		c.Next()
+		if probe {
+			b.endProbe()
+		}
 	}
 }
 
-func (s *Server) ProductsListHandler(c *gin.Context) {
-	products, err := GetAllProducts(c.Request.Context(), s.pool)
-	if err != nil {
-		log.Printf("Ошибка получения продуктов: %v", err)
-		c.HTML(http.StatusInternalServerError, "layout.html", gin.H{
-			"Title": "Ошибка",
-			"Page":  "products",
-		})
-		return
+// heavyOpLimiter ограничивает число одновременных тяжёлых операций (импорт, пересчёты,
+// очистка): каждая держит соединение на всю длинную транзакцию, и без лимита они
+// забирают весь пул у обычных запросов. Лишние не ждут, а сразу получают 503
+//
+// Он же учитывает идущие тяжёлые операции для остановки сервера (drain), в том числе без лимита
+type heavyOpLimiter struct {
+	slots    chan struct{} // nil - без лимита
+	rejected atomic.Int64
+
+	mu       sync.Mutex
+	draining bool           // идёт остановка: новые операции не начинаются
+	running  sync.WaitGroup // идущие операции; Add только под mu и до draining
+
+	abortCtx context.Context // отменяется, если операции не успели завершиться при остановке
+	abort    context.CancelFunc
+}
+
+func newHeavyOpLimiter(limit int) *heavyOpLimiter {
+	l := &heavyOpLimiter{}
+	if limit > 0 {
+		l.slots = make(chan struct{}, limit)
 	}
+	l.abortCtx, l.abort = context.WithCancel(context.Background())
+	return l
+}
 
-	c.HTML(http.StatusOK, "layout.html", gin.H{
-		"Title":    "Список продуктов",
-		"Page":     "products",
-		"Products": products,
-		"Message":  c.Query("message"), // для показа сообщений после создания/удаления
-	})
+// enter регистрирует новую операцию; false - сервер останавливается
+func (l *heavyOpLimiter) enter() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.draining {
+		return false
+	}
+	l.running.Add(1)
+	return true
 }
 
-// GET /products/new - форма создания
-func (s *Server) ProductsNewHandler(c *gin.Context) {
-	materials, _ := GetAllMaterials(c.Request.Context(), s.pool)
-	types, _ := GetAllProductTypes(c.Request.Context(), s.pool)
-	workshops, _ := GetAllWorkshops(c.Request.Context(), s.pool)
+// heavyOpAbortGrace - сколько ждать отката отменённых операций после истечения срока остановки
+const heavyOpAbortGrace = 5 * time.Second
 
-	templateData := gin.H{
-		"Title":     "Создать продукт",
-		"Page":      "products_new",
-		"Materials": materials,
-		"Types":     types,
-		"Workshops": workshops,
+// drain перестаёт принимать тяжёлые операции и ждёт идущие до истечения ctx. Не успевшие
+// отменяются через context запроса: транзакция откатывается целиком, а не обрывается
+// выходом процесса на середине. Ошибка - пришлось отменять
+func (l *heavyOpLimiter) drain(ctx context.Context) error {
+	l.mu.Lock()
+	l.draining = true
+	l.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		l.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
 	}
 
-	c.HTML(http.StatusOK, "layout.html", templateData)
+	l.abort()
+	select {
+	case <-done:
+	case <-time.After(heavyOpAbortGrace):
+		log.Printf("Тяжёлые операции не откатились за %s после отмены", heavyOpAbortGrace)
+	}
+	return ctx.Err()
 }
 
-// POST /products/create - создание продукта
-func (s *Server) ProductsCreateHandler(c *gin.Context) {
-	// Получаем данные из формы
-	productName := c.PostForm("product_name")
-	materialID, _ := strconv.Atoi(c.PostForm("material_id"))
-	typeID, _ := strconv.Atoi(c.PostForm("type_id"))
-	minPrice, _ := strconv.ParseFloat(c.PostForm("min_price"), 64)
-	article := c.PostForm("article")
+// snapshot - состояние для /api/debug/db
+func (l *heavyOpLimiter) snapshot() gin.H {
+	if l.slots == nil {
+		return gin.H{"limit": 0}
+	}
+	return gin.H{
+		"limit":    cap(l.slots),
+		"running":  len(l.slots),
+		"rejected": l.rejected.Load(),
+	}
+}
 
-	// Собираем цеха
-	var workshops []WorkshopInput
-	for key := range c.Request.PostForm {
-		if len(key) > 12 && key[:12] == "workshop_id_" {
-			suffix := key[12:]
-			workshopID, _ := strconv.Atoi(c.PostForm("workshop_id_" + suffix))
-			productionTime, _ := strconv.ParseFloat(c.PostForm("production_time_"+suffix), 64)
-
-			if workshopID > 0 && productionTime > 0 {
-				workshops = append(workshops, WorkshopInput{
-					WorkshopID:     workshopID,
-					ProductionTime: productionTime,
-				})
-			}
+// HeavyOpMiddleware пропускает запрос, только если есть свободный слот тяжёлой операции
+// и сервер не останавливается. Context запроса дополнительно отменяется из drain
+func HeavyOpMiddleware(l *heavyOpLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !l.enter() {
+			c.Header("Retry-After", "5")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"error": "Сервер останавливается, повторите запрос позже",
+			})
+			return
 		}
-	}
+		defer l.running.Done()
 
-	// Создаём продукт
-	input := CreateProductWithWorkshopsInput{
-		ProductName: productName,
-		MaterialID:  materialID,
-		TypeID:      typeID,
-		MinPrice:    minPrice,
-		Article:     article,
-		Workshops:   workshops,
-	}
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+		defer context.AfterFunc(l.abortCtx, cancel)()
+		c.Request = c.Request.WithContext(ctx)
 
-	_, err := CreateProductWithWorkshops(c.Request.Context(), s.pool, input)
-	if err != nil {
-		log.Printf("Ошибка создания продукта: %v", err)
+		if l.slots == nil {
+			c.Next()
+			return
+		}
 
-		// Показываем форму с ошибкой
-		materials, _ := GetAllMaterials(c.Request.Context(), s.pool)
-		types, _ := GetAllProductTypes(c.Request.Context(), s.pool)
-		workshopsData, _ := GetAllWorkshops(c.Request.Context(), s.pool)
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			l.rejected.Add(1)
+			c.Header("Retry-After", "5")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"error": fmt.Sprintf("Уже выполняется %d тяжёлых операций, повторите позже", cap(l.slots)),
+			})
+			return
+		}
+		defer func() { <-l.slots }()
 
-		c.HTML(http.StatusBadRequest, "layout.html", gin.H{
-			"Title":     "Создать продукт",
-			"Page":      "products_new",
-			"Materials": materials,
-			"Types":     types,
-			"Workshops": workshopsData,
-			"Error":     "Не удалось создать продукт: " + err.Error(),
-		})
-		return
+		c.Next()
 	}
+}
 
-	// Редирект на список с сообщением об успехе
-	c.Redirect(http.StatusSeeOther, "/?message=Продукт успешно создан")
+// ============ ВЕБХУКИ ============
+
+// События вебхуков
+const (
+	webhookProductCreated = "product.created"
+	webhookProductDeleted = "product.deleted"
+)
+
+const (
+	webhookQueueSize       = 256
+	webhookAttempts        = 3
+	webhookTimeout         = 5 * time.Second
+	webhookRetryDelay      = time.Second // удваивается после каждой неудачи
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// webhookEvent - тело POST на WEBHOOK_URL
+type webhookEvent struct {
+	Event     string            `json:"event"`
+	ProductID int               `json:"product_id"`
+	SentAt    time.Time         `json:"sent_at"`
+	trace     trace.SpanContext // span запроса, вызвавшего событие: доставка идёт в его трассе
 }
 
-// POST /products/:id/delete - удаление продукта
-func (s *Server) ProductsDeleteHandler(c *gin.Context) {
-	id := c.Param("id")
-	productID, err := strconv.Atoi(id)
-	if err != nil {
-		c.Redirect(http.StatusSeeOther, "/")
-		return
+// webhookDispatcher отправляет события асинхронно, после ответа клиенту.
+// События ставятся в очередь только после COMMIT, поэтому о несостоявшихся
+// изменениях внешняя система не узнает. Ошибки доставки только логируются
+type webhookDispatcher struct {
+	url    string
+	secret string
+	client *http.Client
+	queue  chan webhookEvent
+}
+
+// newWebhookDispatcher возвращает nil, если url не задан: send у nil ничего не делает
+func newWebhookDispatcher(url, secret string) *webhookDispatcher {
+	if url == "" {
+		return nil
+	}
+	d := &webhookDispatcher{
+		url:    url,
+		secret: secret,
+		// otelhttp создаёт span доставки и передаёт получателю traceparent
+		client: &http.Client{Timeout: webhookTimeout, Transport: otelhttp.NewTransport(http.DefaultTransport)},
+		queue:  make(chan webhookEvent, webhookQueueSize),
 	}
+	go d.run()
+	return d
+}
 
-	err = DeleteById(c.Request.Context(), s.pool, productID)
-	if err != nil {
-		log.Printf("Ошибка удаления продукта: %v", err)
-		c.Redirect(http.StatusSeeOther, "/?error=Не удалось удалить продукт")
+// send ставит событие в очередь, не блокируя обработчик запроса. Из ctx берётся только
+// span запроса: доставка идёт уже после ответа, и отмена запроса её не прерывает
+func (d *webhookDispatcher) send(ctx context.Context, event string, productID int) {
+	if d == nil {
 		return
 	}
-
-	c.Redirect(http.StatusSeeOther, "/?message=Продукт успешно удалён")
+	select {
+	case d.queue <- webhookEvent{Event: event, ProductID: productID, SentAt: time.Now().UTC(), trace: trace.SpanContextFromContext(ctx)}:
+	default:
+		log.Printf("Очередь вебхуков переполнена, событие %s для продукта %d пропущено", event, productID)
+	}
 }
 
-// Вспомогательные функции для получения справочников
-type Material struct {
-	ID           int    `json:"id"`
-	MaterialName string `json:"material_name"`
+func (d *webhookDispatcher) run() {
+	for event := range d.queue {
+		d.deliver(event)
+	}
 }
 
-type ProductType struct {
-	ID       int    `json:"id"`
-	TypeName string `json:"type_name"`
-}
+// deliver отправляет событие с повторами. 4xx (кроме 429) не повторяем:
+// получатель явно отверг запрос, повтор даст тот же ответ
+func (d *webhookDispatcher) deliver(event webhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Ошибка сериализации вебхука %s: %v", event.Event, err)
+		return
+	}
 
-type Workshop struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
+	delay := webhookRetryDelay
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		status, err := d.post(event, body)
+		if err == nil && status < 300 {
+			return
+		}
+		if err == nil && status >= 400 && status < 500 && status != http.StatusTooManyRequests {
+			log.Printf("Вебхук %s для продукта %d отклонён: HTTP %d", event.Event, event.ProductID, status)
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("HTTP %d", status)
+		}
+		log.Printf("Вебхук %s для продукта %d, попытка %d из %d: %v", event.Event, event.ProductID, attempt, webhookAttempts, err)
+
+		if attempt < webhookAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
 }
 
-func GetAllMaterials(ctx context.Context, pool *pgxpool.Pool) ([]Material, error) {
-	query := `SELECT id, material_name FROM materials ORDER BY material_name`
-	rows, err := pool.Query(ctx, query)
+// post делает один запрос. Подпись - HMAC-SHA256 тела ключом WEBHOOK_SECRET
+func (d *webhookDispatcher) post(event webhookEvent, body []byte) (int, error) {
+	ctx := trace.ContextWithSpanContext(context.Background(), event.trace)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(body))
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if d.secret != "" {
+		mac := hmac.New(sha256.New, []byte(d.secret))
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
 	}
-	defer rows.Close()
 
-	var materials []Material
-	for rows.Next() {
-		var m Material
-		if err := rows.Scan(&m.ID, &m.MaterialName); err != nil {
-			return nil, err
-		}
-		materials = append(materials, m)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
 	}
-	return materials, nil
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
 }
 
-func GetAllProductTypes(ctx context.Context, pool *pgxpool.Pool) ([]ProductType, error) {
-	query := `SELECT id, type_name FROM products_types ORDER BY type_name`
-	rows, err := pool.Query(ctx, query)
+// ============ ТРАССИРОВКА (OpenTelemetry) ============
+
+// tracerName - имя инструментации в span
+const tracerName = "praktica"
+
+// setupTracing настраивает OpenTelemetry по стандартным переменным OTEL_*. Экспорт включается,
+// только если задан OTEL_EXPORTER_OTLP_ENDPOINT или OTEL_EXPORTER_OTLP_TRACES_ENDPOINT
+// (и не OTEL_SDK_DISABLED=true): адрес, заголовки, протокол, OTEL_SERVICE_NAME,
+// OTEL_RESOURCE_ATTRIBUTES и OTEL_TRACES_SAMPLER читают сами экспортёр и SDK.
+// Распространение traceparent/baggage работает всегда: без экспорта входящий trace id
+// всё равно передаётся дальше. Возвращает функцию, досылающую накопленные span
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	noop := func(context.Context) error { return nil }
+	if os.Getenv("OTEL_SDK_DISABLED") == "true" {
+		return noop, nil
+	}
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return noop, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(provider)
+	log.Println("OpenTelemetry: span экспортируются по OTLP")
+	return provider.Shutdown, nil
+}
 
-	var types []ProductType
-	for rows.Next() {
-		var t ProductType
-		if err := rows.Scan(&t.ID, &t.TypeName); err != nil {
-			return nil, err
+// TracingMiddleware открывает серверный span на запрос, продолжая trace из входящего
+// traceparent. Span кладётся в context запроса: запросы к БД (queryTimingTracer) становятся
+// его дочерними span. Имя - метод и шаблон маршрута (/api/products/:id), а не сам путь,
+// чтобы span группировались по ручкам
+func TracingMiddleware() gin.HandlerFunc {
+	tracer := otel.Tracer(tracerName)
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+		name := c.Request.Method
+		if route := c.FullPath(); route != "" {
+			name += " " + route
+		}
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Request.Method),
+				attribute.String("http.route", c.FullPath()),
+				attribute.String("url.path", c.Request.URL.Path),
+				attribute.String("request.id", requestIDFromContext(c.Request.Context())),
+			))
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
 		}
-		types = append(types, t)
 	}
-	return types, nil
 }
 
-// GET /calculator - форма калькулятора
-func (s *Server) CalculatorHandler(c *gin.Context) {
-	materials, _ := GetAllMaterials(c.Request.Context(), s.pool)
-	types, _ := GetAllProductTypes(c.Request.Context(), s.pool)
-
-	c.HTML(http.StatusOK, "layout.html", gin.H{
-		"Title":     "Калькулятор сырья",
-		"Page":      "calculator",
-		"Materials": materials,
-		"Types":     types,
-	})
+// dbSpanName - имя span запроса к БД: операция SQL (SELECT, UPDATE, WITH...), не весь текст
+func dbSpanName(sql string) string {
+	fields := strings.Fields(sql)
+	if len(fields) == 0 {
+		return "postgresql"
+	}
+	return "postgresql " + strings.ToUpper(fields[0])
 }
@@ -0,0 +1,879 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func TestParseProductSort(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    []SortKey
+		wantErr bool
+	}{
+		{name: "пусто", raw: "", want: nil},
+		{name: "только пробелы", raw: "   ", want: nil},
+		{name: "одно поле", raw: "name", want: []SortKey{{Field: "name"}}},
+		{name: "направление", raw: "price desc", want: []SortKey{{Field: "price", Desc: true}}},
+		{name: "регистр", raw: "Price DESC", want: []SortKey{{Field: "price", Desc: true}}},
+		{name: "явный asc", raw: "time asc", want: []SortKey{{Field: "time"}}},
+		{
+			name: "порядок ключей сохраняется",
+			raw:  "type, name desc,article",
+			want: []SortKey{{Field: "type"}, {Field: "name", Desc: true}, {Field: "article"}},
+		},
+		{name: "поле не из whitelist", raw: "p.id; DROP TABLE products", wantErr: true},
+		{name: "неизвестное поле", raw: "cost", wantErr: true},
+		{name: "неверное направление", raw: "name up", wantErr: true},
+		{name: "лишнее слово", raw: "name desc nulls", wantErr: true},
+		{name: "пустой ключ", raw: "name,,price", wantErr: true},
+		{name: "повтор поля", raw: "name, NAME desc", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseProductSort(tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseProductSort(%q) = %v, ожидалась ошибка", tt.raw, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseProductSort(%q): %v", tt.raw, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseProductSort(%q) = %v, ожидалось %v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildProductsOrderBy(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []SortKey
+		want string
+	}{
+		{name: "без ключей", keys: nil, want: "p.id"},
+		{name: "p.id в конце", keys: []SortKey{{Field: "name"}}, want: "p.product_name, p.id"},
+		{
+			name: "несколько ключей",
+			keys: []SortKey{{Field: "type"}, {Field: "price", Desc: true}},
+			want: "pt.type_name, p.min_price DESC, p.id",
+		},
+		{name: "время по выходной колонке", keys: []SortKey{{Field: "time"}}, want: "total_production_time, p.id"},
+		{name: "id без дубля", keys: []SortKey{{Field: "id", Desc: true}}, want: "p.id DESC"},
+		{
+			name: "ключи после id отбрасываются",
+			keys: []SortKey{{Field: "material"}, {Field: "id"}, {Field: "name"}},
+			want: "m.material_name, p.id",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := buildProductsOrderBy(tt.keys); got != tt.want {
+				t.Errorf("buildProductsOrderBy(%v) = %q, ожидалось %q", tt.keys, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestStaticNoTraversal - /static отдаёт файлы только из staticDir и не показывает листинг
+func TestStaticNoTraversal(t *testing.T) {
+	root := t.TempDir()
+	staticDir := filepath.Join(root, "static")
+	if err := os.MkdirAll(filepath.Join(staticDir, "css"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(staticDir, "css", "app.css"), []byte("body{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "secret.txt"), []byte("DATABASE_URL=secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.Static("/static", staticDir)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	if w := get("/static/css/app.css"); w.Code != http.StatusOK || w.Body.String() != "body{}" {
+		t.Fatalf("GET /static/css/app.css = %d %q, ожидался 200 с содержимым файла", w.Code, w.Body.String())
+	}
+
+	for _, target := range []string{
+		"/static/../secret.txt",
+		"/static/..%2fsecret.txt",
+		"/static/css/../../secret.txt",
+		"/static/%2e%2e/secret.txt",
+	} {
+		w := get(target)
+		if strings.Contains(w.Body.String(), "secret") {
+			t.Errorf("GET %s отдал файл вне staticDir: %d %q", target, w.Code, w.Body.String())
+		}
+		if w.Code == http.StatusOK {
+			t.Errorf("GET %s = 200, ожидалась ошибка", target)
+		}
+	}
+
+	for _, target := range []string{"/static/", "/static/css/"} {
+		if w := get(target); strings.Contains(w.Body.String(), "app.css") || strings.Contains(w.Body.String(), "css/") {
+			t.Errorf("GET %s показывает листинг директории: %d %q", target, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRequireJSONMiddleware(t *testing.T) {
+	r := gin.New()
+	r.Use(RequireJSONMiddleware())
+	ok := func(c *gin.Context) { c.Status(http.StatusNoContent) }
+	r.POST("/x", ok)
+	r.PUT("/x", ok)
+	r.PATCH("/x", ok)
+	r.DELETE("/x", ok)
+	r.GET("/x", ok)
+
+	tests := []struct {
+		name        string
+		method      string
+		body        string
+		contentType string
+		chunked     bool
+		want        int
+	}{
+		{name: "json", method: http.MethodPost, body: "{}", contentType: "application/json", want: http.StatusNoContent},
+		{name: "json с charset", method: http.MethodPut, body: "{}", contentType: "application/json; charset=utf-8", want: http.StatusNoContent},
+		{name: "+json", method: http.MethodPatch, body: "{}", contentType: "application/merge-patch+json", want: http.StatusNoContent},
+		{name: "форма", method: http.MethodPost, body: "a=1", contentType: "application/x-www-form-urlencoded", want: http.StatusUnsupportedMediaType},
+		{name: "text/plain", method: http.MethodPatch, body: "{}", contentType: "text/plain", want: http.StatusUnsupportedMediaType},
+		{name: "без Content-Type", method: http.MethodPost, body: "{}", want: http.StatusUnsupportedMediaType},
+		{name: "битый Content-Type", method: http.MethodPost, body: "{}", contentType: "application/json;;", want: http.StatusUnsupportedMediaType},
+		{name: "chunked без Content-Type", method: http.MethodPost, body: "{}", chunked: true, want: http.StatusUnsupportedMediaType},
+		{name: "POST без тела", method: http.MethodPost, want: http.StatusNoContent},
+		{name: "DELETE с телом не проверяется", method: http.MethodDelete, body: "a=1", contentType: "text/plain", want: http.StatusNoContent},
+		{name: "GET не проверяется", method: http.MethodGet, want: http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/x", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.want {
+				t.Fatalf("%s с Content-Type %q = %d, ожидалось %d", tt.method, tt.contentType, w.Code, tt.want)
+			}
+			if w.Code == http.StatusUnsupportedMediaType && !strings.Contains(w.Body.String(), `"error"`) {
+				t.Errorf("тело 415 без error: %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestWorkshopInsertOrder(t *testing.T) {
+	tests := []struct {
+		name      string
+		workshops []int
+		want      []int
+	}{
+		{name: "пусто", workshops: nil, want: []int{}},
+		{name: "уже по возрастанию", workshops: []int{1, 2, 3}, want: []int{0, 1, 2}},
+		{name: "обратный порядок", workshops: []int{9, 5, 2}, want: []int{2, 1, 0}},
+		{name: "вперемешку", workshops: []int{4, 1, 7, 3}, want: []int{1, 3, 0, 2}},
+		{name: "повтор сохраняет порядок", workshops: []int{5, 2, 5, 1}, want: []int{3, 1, 0, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workshops := make([]WorkshopInput, len(tt.workshops))
+			for i, id := range tt.workshops {
+				workshops[i] = WorkshopInput{WorkshopID: id, ProductionTime: float64(i + 1)}
+			}
+
+			got := workshopInsertOrder(workshops)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("workshopInsertOrder(%v) = %v, ожидалось %v", tt.workshops, got, tt.want)
+			}
+			for k := 1; k < len(got); k++ {
+				if workshops[got[k-1]].WorkshopID > workshops[got[k]].WorkshopID {
+					t.Errorf("вставка не по возрастанию workshop_id: %v", got)
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizeArticle(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{raw: "", want: ""},
+		{raw: "   ", want: ""},
+		{raw: "ABC-000001", want: "ABC-000001"},
+		{raw: "abc-000001", want: "ABC-000001"},
+		{raw: "  Abc-000001\t", want: "ABC-000001"},
+		{raw: "стл-000001", want: "СТЛ-000001"},
+		{raw: "ab c-1", want: "AB C-1"},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeArticle(tt.raw); got != tt.want {
+			t.Errorf("normalizeArticle(%q) = %q, ожидалось %q", tt.raw, got, tt.want)
+		}
+	}
+	if normalizeArticle("abc-1") != normalizeArticle(" ABC-1 ") {
+		t.Error("артикулы, отличающиеся регистром и пробелами, должны совпадать")
+	}
+}
+
+func TestParseID(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    int
+		wantErr bool
+	}{
+		{raw: "1", want: 1},
+		{raw: "42", want: 42},
+		{raw: "2147483647", want: maxDBID},
+		{raw: "2147483648", wantErr: true},
+		{raw: "99999999999999999999", wantErr: true},
+		{raw: "0", wantErr: true},
+		{raw: "-1", wantErr: true},
+		{raw: "12abc", wantErr: true},
+		{raw: "1.5", wantErr: true},
+		{raw: " 1", wantErr: true},
+		{raw: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := parseID(tt.raw)
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidID) {
+					t.Fatalf("parseID(%q) = %d, %v, ожидалась errInvalidID", tt.raw, got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("parseID(%q) = %d, %v, ожидалось %d", tt.raw, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseProductID(t *testing.T) {
+	id, err := parseProductID("7")
+	if err != nil || id != 7 {
+		t.Fatalf("parseProductID(\"7\") = %d, %v", id, err)
+	}
+
+	for _, raw := range []string{"0", "abc", "2147483648"} {
+		_, err := parseProductID(raw)
+		if !errors.Is(err, ErrInvalidProductID) {
+			t.Errorf("parseProductID(%q): %v, ожидалась ErrInvalidProductID", raw, err)
+		}
+		if status, _ := statusForError(err); status != http.StatusBadRequest {
+			t.Errorf("parseProductID(%q): статус %d, ожидался 400", raw, status)
+		}
+	}
+}
+
+// TestBuildProductsQueryTieBreak - у страниц списка порядок всегда доопределён по p.id,
+// иначе при равных ценах/названиях строки между страницами повторяются или пропадают
+func TestBuildProductsQueryTieBreak(t *testing.T) {
+	sorts := []string{"", "price", "price desc", "type, name", "time desc", "material desc, article"}
+	for _, raw := range sorts {
+		for _, timeMode := range []string{timeModeSum, timeModeMax} {
+			keys, err := ParseProductSort(raw)
+			if err != nil {
+				t.Fatalf("ParseProductSort(%q): %v", raw, err)
+			}
+			query, args := buildProductsQuery(ProductListOptions{Sort: keys, Limit: 20, Offset: 40, TimeMode: timeMode})
+
+			orderBy := query[strings.LastIndex(query, " ORDER BY "):]
+			if !strings.Contains(orderBy, ", p.id LIMIT") && !strings.Contains(orderBy, "BY p.id LIMIT") {
+				t.Errorf("sort=%q time_mode=%s: ORDER BY без p.id в конце: %s", raw, timeMode, orderBy)
+			}
+			if len(args) < 2 || args[len(args)-2] != 20 || args[len(args)-1] != 40 {
+				t.Errorf("sort=%q: limit/offset не в конце аргументов: %v", raw, args)
+			}
+		}
+	}
+}
+
+// TestProductPagesStableOnEqualPrices - страницы sort=price по продуктам с одинаковой ценой
+// покрывают каждый продукт ровно один раз и при повторном чтении идут в том же порядке
+func TestProductPagesStableOnEqualPrices(t *testing.T) {
+	pool := testDB(t, nil)
+	ctx := context.Background()
+	materialID, typeID, prefix := createTestRefs(t, pool)
+
+	const n = 7
+	want := make(map[int]bool, n)
+	for i := range n {
+		price := 500.0
+		created, err := CreateProduct(ctx, pool, CreateProductInput{
+			ProductName: fmt.Sprintf("Изделие %s %d", prefix, i),
+			MaterialID:  materialID,
+			TypeID:      typeID,
+			MinPrice:    &price,
+		}, nil)
+		if err != nil {
+			t.Fatalf("создание продукта %d: %v", i, err)
+		}
+		want[created.ProductID] = true
+	}
+
+	keys, err := ParseProductSort("price")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readPages := func() []int {
+		var ids []int
+		for offset := 0; ; offset += 2 {
+			page, total, err := GetProductsPaginated(ctx, pool, ProductListOptions{
+				Sort: keys, Limit: 2, Offset: offset, TypeID: typeID,
+			})
+			if err != nil {
+				t.Fatalf("страница offset=%d: %v", offset, err)
+			}
+			if total != n {
+				t.Fatalf("total %d, ожидалось %d", total, n)
+			}
+			if len(page) == 0 {
+				return ids
+			}
+			for _, p := range page {
+				ids = append(ids, p.ID)
+			}
+		}
+	}
+
+	first := readPages()
+	seen := make(map[int]bool, n)
+	for _, id := range first {
+		if !want[id] {
+			t.Errorf("чужой продукт %d в выборке", id)
+		}
+		if seen[id] {
+			t.Errorf("продукт %d попал на страницы дважды: %v", id, first)
+		}
+		seen[id] = true
+	}
+	if len(seen) != n {
+		t.Errorf("на страницах %d продуктов из %d: %v", len(seen), n, first)
+	}
+
+	for range 3 {
+		if again := readPages(); !reflect.DeepEqual(again, first) {
+			t.Fatalf("порядок страниц изменился: %v, затем %v", first, again)
+		}
+	}
+}
+
+func TestAPITrailingSlashRedirect(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	h := withAPITrailingSlashRedirect(next)
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		want     int
+		location string
+	}{
+		{name: "GET", method: http.MethodGet, target: "/api/products/", want: http.StatusPermanentRedirect, location: "/api/products"},
+		{name: "query сохраняется", method: http.MethodGet, target: "/api/products/?limit=5&sort=name", want: http.StatusPermanentRedirect, location: "/api/products?limit=5&sort=name"},
+		{name: "POST тоже 308", method: http.MethodPost, target: "/api/products/", want: http.StatusPermanentRedirect, location: "/api/products"},
+		{name: "несколько слэшей", method: http.MethodDelete, target: "/api/products/5//", want: http.StatusPermanentRedirect, location: "/api/products/5"},
+		{name: "канонический путь", method: http.MethodGet, target: "/api/products", want: http.StatusNoContent},
+		{name: "сам /api/", method: http.MethodGet, target: "/api/", want: http.StatusNoContent},
+		{name: "не API", method: http.MethodGet, target: "/products/", want: http.StatusNoContent},
+		{name: "статика", method: http.MethodGet, target: "/static/css/", want: http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, strings.NewReader("")))
+
+			if w.Code != tt.want {
+				t.Fatalf("%s %s = %d, ожидалось %d", tt.method, tt.target, w.Code, tt.want)
+			}
+			if got := w.Header().Get("Location"); got != tt.location {
+				t.Errorf("%s %s: Location %q, ожидалось %q", tt.method, tt.target, got, tt.location)
+			}
+		})
+	}
+}
+
+func TestCamelCaseJSON(t *testing.T) {
+	type inner struct {
+		WorkshopID int `json:"workshop_id"`
+	}
+	type Base struct {
+		CreatedAt time.Time `json:"created_at"`
+	}
+	type product struct {
+		Base
+		ProductName string         `json:"product_name"`
+		MinPrice    *float64       `json:"min_price"`
+		ImageURL    string         `json:"image_url,omitempty"`
+		Secret      string         `json:"-"`
+		Workshops   []inner        `json:"workshops"`
+		ByType      map[string]int `json:"by_type"`
+		Raw         []byte         `json:"raw_data"`
+		NoTag       int
+	}
+	price := 12.5
+
+	tests := []struct {
+		name string
+		in   any
+		want string
+	}{
+		{
+			name: "структура",
+			in: product{
+				Base:        Base{CreatedAt: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)},
+				ProductName: "Стол",
+				MinPrice:    &price,
+				Secret:      "x",
+				Workshops:   []inner{{WorkshopID: 3}},
+				ByType:      map[string]int{"type_name": 1},
+				Raw:         []byte("ab"),
+				NoTag:       1,
+			},
+			want: `{"productName":"Стол","minPrice":12.5,"workshops":[{"workshopId":3}],"byType":{"type_name":1},"rawData":"YWI=","NoTag":1,"createdAt":"2025-01-02T03:04:05Z"}`,
+		},
+		{
+			name: "gin.H переименовывается",
+			in:   gin.H{"error": "нет", "existing_id": 5, "details": []gin.H{{"field_name": "a"}}},
+			want: `{"details":[{"fieldName":"a"}],"error":"нет","existingId":5}`,
+		},
+		{name: "nil", in: nil, want: `null`},
+		{name: "nil-указатель", in: (*product)(nil), want: `null`},
+		{name: "nil-срез", in: struct {
+			Items []int `json:"item_list"`
+		}{}, want: `{"itemList":null}`},
+		{name: "строка без изменений", in: "snake_case", want: `"snake_case"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := camelCaseJSON(tt.in)
+			if err != nil {
+				t.Fatalf("camelCaseJSON: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("camelCaseJSON =\n%s\nожидалось\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCamelCase(t *testing.T) {
+	for in, want := range map[string]string{
+		"product_name":          "productName",
+		"total_production_time": "totalProductionTime",
+		"id":                    "id",
+		"_internal":             "_internal",
+		"ProductName":           "ProductName",
+	} {
+		if got := camelCase(in); got != want {
+			t.Errorf("camelCase(%q) = %q, ожидалось %q", in, got, want)
+		}
+	}
+}
+
+// testDB подключается к TEST_DATABASE_URL - отдельной базе с применённым schema.sql.
+// Без переменной тесты с БД пропускаются. configure (может быть nil) меняет настройки пула
+func testDB(t *testing.T, configure func(*pgxpool.Config)) *pgxpool.Pool {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL не задан")
+	}
+	config, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		t.Fatalf("TEST_DATABASE_URL: %v", err)
+	}
+	if configure != nil {
+		configure(config)
+	}
+	pool, err := pgxpool.NewWithConfig(context.Background(), config)
+	if err != nil {
+		t.Fatalf("подключение к БД: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+// createTestRefs создаёт материал и тип продукции со случайным латинским префиксом артикула,
+// чтобы нумерация не пересекалась с данными в базе. По окончании теста удаляет их вместе с продуктами
+func createTestRefs(t *testing.T, pool *pgxpool.Pool) (materialID, typeID int, prefix string) {
+	t.Helper()
+	ctx := context.Background()
+	letters := make([]rune, 3)
+	for i := range letters {
+		letters[i] = rune('A' + rand.IntN(26))
+	}
+	prefix = string(letters)
+
+	if err := pool.QueryRow(ctx, `INSERT INTO materials (material_name) VALUES ($1) RETURNING id`,
+		"тест "+prefix).Scan(&materialID); err != nil {
+		t.Fatalf("создание материала: %v", err)
+	}
+	if err := pool.QueryRow(ctx, `INSERT INTO products_types (type_name) VALUES ($1) RETURNING id`,
+		prefix+" тест").Scan(&typeID); err != nil {
+		t.Fatalf("создание типа: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx := context.Background()
+		pool.Exec(ctx, `DELETE FROM products WHERE type_id = $1 OR material_id = $2`, typeID, materialID)
+		pool.Exec(ctx, `DELETE FROM products_types WHERE id = $1`, typeID)
+		pool.Exec(ctx, `DELETE FROM materials WHERE id = $1`, materialID)
+	})
+	return materialID, typeID, prefix
+}
+
+// TestGenerateArticleConcurrent - параллельные создания с одним префиксом получают
+// разные номера подряд: нумерацию сериализует advisory-блокировка generateArticle
+func TestGenerateArticleConcurrent(t *testing.T) {
+	pool := testDB(t, nil)
+	materialID, typeID, prefix := createTestRefs(t, pool)
+
+	const n = 40
+	articles := make([]string, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			price := 100.0
+			result, err := CreateProduct(context.Background(), pool, CreateProductInput{
+				ProductName: fmt.Sprintf("Изделие %s %d", prefix, i),
+				MaterialID:  materialID,
+				TypeID:      typeID,
+				MinPrice:    &price,
+			}, nil)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			articles[i] = result.Product.Article
+		}()
+	}
+	wg.Wait()
+
+	seen := make(map[int]bool, n)
+	minNumber, maxNumber := 0, 0
+	for i := range n {
+		if errs[i] != nil {
+			t.Fatalf("создание %d: %v", i, errs[i])
+		}
+		gotPrefix, number, ok := parseArticleNumber(articles[i])
+		if !ok || gotPrefix != prefix {
+			t.Fatalf("артикул %q не в формате %s-NNNNNN", articles[i], prefix)
+		}
+		if seen[number] {
+			t.Fatalf("артикул %q выдан дважды", articles[i])
+		}
+		seen[number] = true
+		if minNumber == 0 || number < minNumber {
+			minNumber = number
+		}
+		maxNumber = max(maxNumber, number)
+	}
+	if maxNumber-minNumber != n-1 {
+		t.Errorf("номера не подряд: от %d до %d для %d продуктов", minNumber, maxNumber, n)
+	}
+}
+
+func TestRetryRead(t *testing.T) {
+	tests := []struct {
+		name      string
+		errs      []error // ошибки попыток по порядку, nil - успех
+		cancelled bool
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "успех сразу", errs: []error{nil}, wantCalls: 1},
+		{name: "обрыв, затем успех", errs: []error{io.ErrUnexpectedEOF, nil}, wantCalls: 2},
+		{name: "код 08006", errs: []error{&pgconn.PgError{Code: "08006"}, nil}, wantCalls: 2},
+		{name: "повтор только один", errs: []error{io.EOF, io.EOF}, wantCalls: 2, wantErr: true},
+		{name: "ошибка SQL не повторяется", errs: []error{&pgconn.PgError{Code: "23505"}}, wantCalls: 1, wantErr: true},
+		{name: "отменённый запрос не повторяется", errs: []error{io.EOF}, cancelled: true, wantCalls: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancelled {
+				cancel()
+			}
+
+			calls := 0
+			got, err := retryRead(ctx, func() (int, error) {
+				err := tt.errs[calls]
+				calls++
+				if err != nil {
+					return 0, err
+				}
+				return 42, nil
+			})
+			if calls != tt.wantCalls {
+				t.Errorf("попыток %d, ожидалось %d", calls, tt.wantCalls)
+			}
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("ошибка %v, ожидалась: %v", err, tt.wantErr)
+			}
+			if err == nil && got != 42 {
+				t.Errorf("значение %d, ожидалось 42", got)
+			}
+		})
+	}
+}
+
+// TestRetryReadDroppedConnection закрывает сокет единственного соединения пула так, что пул
+// об этом не знает: первое чтение падает на мёртвом соединении, повтор идёт по новому
+func TestRetryReadDroppedConnection(t *testing.T) {
+	pool := testDB(t, func(config *pgxpool.Config) {
+		config.MaxConns = 1
+		// без пинга перед выдачей: иначе пул сам отбросит мёртвое соединение и повтор не понадобится
+		config.ShouldPing = func(context.Context, pgxpool.ShouldPingParams) bool { return false }
+	})
+	ctx := context.Background()
+
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if err := conn.Conn().PgConn().Conn().Close(); err != nil {
+		t.Fatalf("закрытие сокета: %v", err)
+	}
+	conn.Release()
+
+	calls := 0
+	total, err := retryRead(ctx, func() (int, error) {
+		calls++
+		var n int
+		err := pool.QueryRow(ctx, `SELECT COUNT(*) FROM products`).Scan(&n)
+		return n, err
+	})
+	if err != nil {
+		t.Fatalf("чтение после обрыва: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("попыток %d, ожидалось 2 (первая - на закрытом соединении)", calls)
+	}
+	if total < 0 {
+		t.Errorf("COUNT = %d", total)
+	}
+}
+
+// TestReadHeaderTimeoutDropsSlowClient - клиент, который не дослал заголовки за
+// HTTP_READ_HEADER_TIMEOUT, теряет соединение; обычный запрос при этом обслуживается
+func TestReadHeaderTimeoutDropsSlowClient(t *testing.T) {
+	const headerTimeout = 200 * time.Millisecond
+	t.Setenv("HTTP_READ_HEADER_TIMEOUT", headerTimeout.String())
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	ts := httptest.NewUnstartedServer(handler)
+	ts.Config = newHTTPServer("", handler)
+	ts.Start()
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("обычный запрос: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("обычный запрос: статус %d", resp.StatusCode)
+	}
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Начало запроса без завершающей пустой строки - сервер ждёт остальные заголовки
+	start := time.Now()
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nX-Slow: "); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	for err == nil {
+		// ответ (если сервер его отправил) не должен быть успешным
+		if strings.Contains(string(buf[:n]), " 204 ") {
+			t.Fatalf("медленный клиент получил ответ обработчика: %q", buf[:n])
+		}
+		n, err = conn.Read(buf)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		t.Fatalf("сервер не закрыл соединение за 5s при HTTP_READ_HEADER_TIMEOUT=%s", headerTimeout)
+	}
+	if elapsed := time.Since(start); elapsed < headerTimeout {
+		t.Errorf("соединение закрыто через %s, раньше таймаута %s", elapsed, headerTimeout)
+	}
+}
+
+// TestNonFiniteFloatsRejected - NaN и бесконечности не проходят ни в JSON API, ни в HTML-форме.
+// Запросы отсекаются до обращения к БД, поэтому Server без пула
+func TestNonFiniteFloatsRejected(t *testing.T) {
+	s := &Server{maxProductionTime: 1000, maxWorkshops: 50}
+	r := gin.New()
+	r.POST("/api/products", s.CreateProductHandler)
+	r.PATCH("/api/products/:id/workshops/:workshop_id", s.UpdateWorkshopTimeHandler)
+	r.PUT("/api/products/:id/workshops", s.ReplaceProductWorkshopsHandler)
+
+	// encoding/json не знает литералов NaN/Infinity, строку не берёт в float64, а 1e999 не помещается
+	values := []string{`NaN`, `Infinity`, `-Infinity`, `"NaN"`, `"+Inf"`, `1e999`, `-1e999`}
+	for _, v := range values {
+		requests := []struct{ method, target, body string }{
+			{http.MethodPost, "/api/products", `{"product_name":"Стол","material_id":1,"type_id":1,"min_price":` + v + `}`},
+			{http.MethodPost, "/api/products", `{"product_name":"Стол","material_id":1,"type_id":1,"markup_percent":` + v + `}`},
+			{http.MethodPatch, "/api/products/1/workshops/2", `{"production_time":` + v + `}`},
+			{http.MethodPut, "/api/products/1/workshops", `{"workshops":[{"workshop_id":2,"production_time":` + v + `}]}`},
+		}
+		for _, req := range requests {
+			w := httptest.NewRecorder()
+			httpReq := httptest.NewRequest(req.method, req.target, strings.NewReader(req.body))
+			httpReq.Header.Set("Content-Type", "application/json")
+			r.ServeHTTP(w, httpReq)
+
+			if w.Code != http.StatusBadRequest && w.Code != http.StatusUnprocessableEntity {
+				t.Errorf("%s %s с %s = %d %s, ожидалось 400/422", req.method, req.target, v, w.Code, w.Body.String())
+			}
+		}
+	}
+
+	for _, raw := range []string{"NaN", "nan", "Inf", "+Inf", "-Inf", "Infinity", "1e999", "1,5e999"} {
+		for _, required := range []bool{true, false} {
+			value, msg := parseFormFloat(raw, required)
+			if msg == "" {
+				t.Errorf("parseFormFloat(%q, %v) = %v без ошибки", raw, required, value)
+			}
+		}
+	}
+	if value, msg := parseFormFloat("12,5", true); msg != "" || value != 12.5 {
+		t.Errorf("parseFormFloat(\"12,5\") = %v, %q", value, msg)
+	}
+}
+
+// createTestWorkshop создаёт цех и удаляет его по окончании теста (связи уходят каскадом)
+func createTestWorkshop(t *testing.T, pool *pgxpool.Pool, name string) int {
+	t.Helper()
+	ctx := context.Background()
+	var id int
+	if err := pool.QueryRow(ctx, `INSERT INTO workshops (name) VALUES ($1) RETURNING id`, name).Scan(&id); err != nil {
+		t.Fatalf("создание цеха: %v", err)
+	}
+	t.Cleanup(func() {
+		pool.Exec(context.Background(), `DELETE FROM workshops WHERE id = $1`, id)
+	})
+	return id
+}
+
+// TestProductWorkshopsNullTime - шаг маршрута с production_time = NULL отдаётся как 0,
+// и разбивка по шагам сходится с кешированным total_production_time
+func TestProductWorkshopsNullTime(t *testing.T) {
+	pool := testDB(t, nil)
+	ctx := context.Background()
+	materialID, typeID, prefix := createTestRefs(t, pool)
+	filled := createTestWorkshop(t, pool, "Цех "+prefix+" 1")
+	empty := createTestWorkshop(t, pool, "Цех "+prefix+" 2")
+
+	price := 100.0
+	created, err := CreateProduct(ctx, pool, CreateProductInput{
+		ProductName: "Изделие " + prefix,
+		MaterialID:  materialID,
+		TypeID:      typeID,
+		MinPrice:    &price,
+	}, nil)
+	if err != nil {
+		t.Fatalf("создание продукта: %v", err)
+	}
+	if _, err := AddProductWorkshop(ctx, pool, created.ProductID, WorkshopInput{WorkshopID: filled, ProductionTime: 2.5}, 50, nil); err != nil {
+		t.Fatalf("добавление цеха: %v", err)
+	}
+	// API не даёт записать NULL - такие связи остаются от старых данных и ручных правок
+	if _, err := pool.Exec(ctx, `
+		INSERT INTO products_workshop (product_id, workshop_id, production_time, step_order)
+		VALUES ($1, $2, NULL, 2)`, created.ProductID, empty); err != nil {
+		t.Fatalf("вставка связи с NULL: %v", err)
+	}
+	if _, err := RecomputeProductionTimes(ctx, pool); err != nil {
+		t.Fatalf("пересчёт времени: %v", err)
+	}
+
+	steps, err := GetProductWorkshops(ctx, pool, created.ProductID, 0, 0)
+	if err != nil {
+		t.Fatalf("GetProductWorkshops: %v", err)
+	}
+	if len(steps) != 2 {
+		t.Fatalf("шагов %d, ожидалось 2: %+v", len(steps), steps)
+	}
+	sum := 0.0
+	for _, step := range steps {
+		if step.WorkshopID == empty && step.ProductionTime != 0 {
+			t.Errorf("шаг с NULL: время %v, ожидалось 0", step.ProductionTime)
+		}
+		sum += step.ProductionTime
+	}
+
+	product, err := GetProductByID(ctx, pool, created.ProductID)
+	if err != nil {
+		t.Fatalf("GetProductByID: %v", err)
+	}
+	if product.TotalProductionTime != sum || sum != 2.5 {
+		t.Errorf("total_production_time %v, сумма шагов %v, ожидалось 2.5", product.TotalProductionTime, sum)
+	}
+}
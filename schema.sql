@@ -4,14 +4,20 @@
 CREATE TABLE materials (
     id SERIAL PRIMARY KEY,
     material_name VARCHAR(255) NOT NULL,
-    wasting_percentage DECIMAL(5,2)
+    wasting_percentage DECIMAL(5,2),
+    -- себестоимость материала на единицу продукции (для расчёта цены по наценке)
+    cost DECIMAL(10,2)
 );
 
 -- Таблица типов продукции
 CREATE TABLE products_types (
     id SERIAL PRIMARY KEY,
     type_name VARCHAR(255) NOT NULL,
-    type_ratio DECIMAL(10,2)
+    type_ratio DECIMAL(10,2),
+    -- родитель для подкатегорий, NULL - верхний уровень. Циклы проверяет приложение
+    -- (PUT /api/product-types/:id/parent), CHECK ловит только родителя самого себя
+    parent_id INTEGER REFERENCES products_types(id) ON DELETE SET NULL,
+    CHECK (parent_id <> id)
 );
 
 -- Таблица цехов
@@ -29,6 +35,15 @@ CREATE TABLE products (
     type_id INTEGER NOT NULL,
     min_price DECIMAL(10,2),
     article VARCHAR(100),
+    -- ссылка на изображение (http/https), сами файлы хранятся вне приложения
+    image_url TEXT,
+    -- кешированная сумма production_time из products_workshop
+    total_production_time DECIMAL(10,2) NOT NULL DEFAULT 0,
+    -- неактивные продукты остаются в БД и отчётах, но скрываются из каталога
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    -- для инкрементальной синхронизации (/api/products/changes), updated_at ведёт триггер
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
     CONSTRAINT fk_products_material 
         FOREIGN KEY (material_id) 
         REFERENCES materials(id) 
@@ -45,6 +60,8 @@ CREATE TABLE products_workshop (
     product_id INTEGER NOT NULL,
     workshop_id INTEGER NOT NULL,
     production_time DECIMAL(10,2),
+    -- порядок шага в маршруте производства (1, 2, 3...)
+    step_order INTEGER NOT NULL DEFAULT 0,
     CONSTRAINT fk_pw_product 
         FOREIGN KEY (product_id) 
         REFERENCES products(id) 
@@ -60,5 +77,66 @@ CREATE TABLE products_workshop (
 -- Индексы
 CREATE INDEX idx_products_material ON products(material_id);
 CREATE INDEX idx_products_type ON products(type_id);
+-- уникальность артикула без учёта регистра (пустые артикулы у старых записей не мешают)
+CREATE UNIQUE INDEX idx_products_article ON products(UPPER(article)) WHERE article IS NOT NULL AND article <> '';
+-- Нечёткий поиск (/api/products/search?fuzzy=true): операторы pg_trgm по индексам
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX idx_products_name_trgm ON products USING gin (product_name gin_trgm_ops);
+CREATE INDEX idx_products_article_trgm ON products USING gin (article gin_trgm_ops);
+-- Один продукт на название (без учёта регистра), материал и тип; имя индекса сверяется в main.go
+CREATE UNIQUE INDEX idx_products_name_material_type ON products (LOWER(product_name), material_id, type_id);
 CREATE INDEX idx_pw_product ON products_workshop(product_id);
 CREATE INDEX idx_pw_workshop ON products_workshop(workshop_id);
+CREATE INDEX idx_products_updated_at ON products(updated_at);
+
+-- updated_at обновляется при любом UPDATE продукта, в том числе при пересчёте
+-- total_production_time после изменения цехов
+CREATE FUNCTION set_updated_at() RETURNS trigger AS $$
+BEGIN
+    NEW.updated_at = now();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trg_products_updated_at
+    BEFORE UPDATE ON products
+    FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+
+-- Журнал удалений продуктов (DELETE /api/products/:id, форма, /api/admin/purge).
+-- Без внешнего ключа: продукта к моменту чтения журнала уже нет
+CREATE TABLE product_deletions (
+    id SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL,
+    product_name VARCHAR(255) NOT NULL,
+    article VARCHAR(100),
+    -- заголовок X-User запроса; NULL - неизвестно
+    deleted_by VARCHAR(255),
+    deleted_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX idx_product_deletions_deleted_at ON product_deletions(deleted_at);
+
+-- Версии применённых миграций. Приложение сверяет MAX(version) с ожидаемой
+-- (expectedSchemaVersion в main.go) и до совпадения отвечает 503 на GET /ready.
+-- Каждое изменение схемы добавляет сюда следующую версию
+CREATE TABLE schema_migrations (
+    version INTEGER PRIMARY KEY,
+    applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+INSERT INTO schema_migrations (version) VALUES (1);
+-- 2: таблица product_deletions
+INSERT INTO schema_migrations (version) VALUES (2);
+-- 3: иерархия типов продукции. На существующей базе:
+-- ALTER TABLE products_types ADD COLUMN parent_id INTEGER REFERENCES products_types(id) ON DELETE SET NULL,
+--     ADD CHECK (parent_id <> id);
+INSERT INTO schema_migrations (version) VALUES (3);
+-- 4: составная уникальность продукта. На существующей базе сначала убрать дубликаты
+-- (SELECT LOWER(product_name), material_id, type_id FROM products GROUP BY 1, 2, 3 HAVING COUNT(*) > 1), затем:
+-- CREATE UNIQUE INDEX idx_products_name_material_type ON products (LOWER(product_name), material_id, type_id);
+INSERT INTO schema_migrations (version) VALUES (4);
+-- 5: нечёткий поиск. На существующей базе:
+-- CREATE EXTENSION IF NOT EXISTS pg_trgm;
+-- CREATE INDEX idx_products_name_trgm ON products USING gin (product_name gin_trgm_ops);
+-- CREATE INDEX idx_products_article_trgm ON products USING gin (article gin_trgm_ops);
+INSERT INTO schema_migrations (version) VALUES (5);
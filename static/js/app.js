@@ -0,0 +1,7 @@
+function confirmDelete(event, itemName) {
+    if (!confirm(`Вы уверены, что хотите удалить "${itemName}"?`)) {
+        event.preventDefault();
+        return false;
+    }
+    return true;
+}